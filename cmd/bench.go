@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+	"twin-peaks-programming-language/internal/bytecode"
+	"twin-peaks-programming-language/internal/lexer"
+	"twin-peaks-programming-language/internal/optimizer"
+	"twin-peaks-programming-language/internal/parser"
+	"twin-peaks-programming-language/internal/runtime"
+)
+
+// benchmarkRounds is the number of runs of every sample, the fastest one is reported
+const benchmarkRounds = 3
+
+var benchmarks = []struct {
+	name string
+	code string
+}{
+	{"nbody", nbody},
+	{"quick_sort", quick_sort},
+	{"sieve_of_eratosthenes", sieve_of_eratosthenes},
+}
+
+// runBenchmarks runs the samples on the stack and the register backends and prints their best times
+func runBenchmarks() {
+	fmt.Printf("%-24s %12s %12s %8s\n", "sample", "stack", "register", "speedup")
+	for _, benchmark := range benchmarks {
+		stackTime, err := timeSample(benchmark.code, false)
+		if err != nil {
+			fmt.Printf("%-24s error: %v\n", benchmark.name, err)
+			continue
+		}
+		registerTime, err := timeSample(benchmark.code, true)
+		if err != nil {
+			fmt.Printf("%-24s error: %v\n", benchmark.name, err)
+			continue
+		}
+		fmt.Printf("%-24s %12v %12v %7.2fx\n", benchmark.name, stackTime.Round(time.Millisecond),
+			registerTime.Round(time.Millisecond), float64(stackTime)/float64(registerTime))
+	}
+}
+
+// timeSample compiles the sample and returns the best execution time, print output is discarded
+func timeSample(code string, registers bool) (time.Duration, error) {
+	tokens, err := lexer.NewLexer(code).Tokenize()
+	if err != nil {
+		return 0, err
+	}
+	ast, err := parser.NewParser(tokens).ParseProgram()
+	if err != nil {
+		return 0, err
+	}
+
+	best := time.Duration(0)
+	for i := 0; i < benchmarkRounds; i++ {
+		bc, err := bytecode.NewCompiler().Compile(ast)
+		if err != nil {
+			return 0, err
+		}
+		optimizer.ForLevel(optimizationLevel()).Optimize(bc)
+
+		virtualMachine := runtime.NewVM(bc, true, false)
+		virtualMachine.SetOverflowChecks(*overflowChecks)
+		virtualMachine.SetOutput(io.Discard)
+		if registers {
+			if err := virtualMachine.UseRegisterBackend(); err != nil {
+				return 0, err
+			}
+		}
+
+		start := time.Now()
+		if err := virtualMachine.Run(); err != nil {
+			return 0, err
+		}
+		if elapsed := time.Since(start); best == 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+	return best, nil
+}
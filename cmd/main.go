@@ -1,17 +1,62 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"os"
 	"strings"
 	"twin-peaks-programming-language/internal/bytecode"
 	"twin-peaks-programming-language/internal/lexer"
+	"twin-peaks-programming-language/internal/optimizer"
 	"twin-peaks-programming-language/internal/parser"
 	"twin-peaks-programming-language/internal/runtime"
 )
 
 const PrintInfo = false
 
+var (
+	overflowChecks = flag.Bool("overflow-checks", false, "raise a runtime error on int overflow instead of wrapping around")
+	optimizeNone   = flag.Bool("O0", false, "disable bytecode optimization")
+	optimizeBasic  = flag.Bool("O1", false, "peephole rewrites, jump threading and superinstructions (default)")
+	optimizeFull   = flag.Bool("O2", false, "also remove unreachable code and unused constants")
+	backend        = flag.String("backend", "stack", "execution backend: stack or register")
+	bench          = flag.Bool("bench", false, "time nbody, quick_sort and sieve_of_eratosthenes on both backends")
+	compileAfter   = flag.Int("compile-threshold", runtime.DefaultCompileThreshold, "calls after which a function is compiled to Go closures, 0 disables compilation")
+	memoLimit      = flag.Int("memo-limit", runtime.DefaultMemoLimit, "calls cached by the JIT, the least recently used are evicted, 0 is unlimited")
+	memoPerFunc    = flag.Int("memo-function-limit", runtime.DefaultMemoFunctionLimit, "calls of one function cached by the JIT, 0 is unlimited")
+	memoCache      = flag.String("memo-cache", "", "file to preload JIT cached call results from and save them to after the run")
+	jitVerify      = flag.Int("jit-verify", 0, "re-execute every n-th call answered from the JIT cache in the interpreter and compare the results, 0 disables")
+	jitReport      = flag.String("jit-report", "", "print JIT decisions and cache statistics after the run to stderr: text or json")
+	traceAfter     = flag.Int("trace-threshold", runtime.DefaultTraceThreshold, "backward jumps after which a loop is traced, 0 disables tracing")
+	native         = flag.Bool("native", false, "run pure numeric functions as amd64 machine code (experimental, needs -tags nativejit)")
+	specializeAt   = flag.Int("specialize-threshold", runtime.DefaultSpecializeThreshold, "executions after which int-only or float-only arithmetic is specialized, 0 disables specialization")
+	typeFeedback   = flag.String("type-feedback", "", "file to specialize the bytecode ahead of time from and save the collected type feedback to after the run")
+)
+
+// optimizationLevel returns the highest requested -O level
+func optimizationLevel() int {
+	switch {
+	case *optimizeFull:
+		return 2
+	case *optimizeBasic:
+		return 1
+	case *optimizeNone:
+		return 0
+	default:
+		return 1
+	}
+}
+
 func main() {
+	flag.Parse()
+
+	if *bench {
+		runBenchmarks()
+		return
+	}
+
 	//code, err := io.ReadAll(os.Stdin)
 	code := factorial
 
@@ -48,6 +93,15 @@ func main() {
 		return
 	}
 
+	optimizer.ForLevel(optimizationLevel()).Optimize(bc)
+	if err := loadTypeFeedback(bc); err != nil {
+		fmt.Printf("Type feedback is not loaded: %v\n", err)
+	}
+	if err := bc.Verify(); err != nil {
+		fmt.Printf("Bytecode verification error: %v\n", err)
+		return
+	}
+
 	if PrintInfo {
 		fmt.Println("\nBytecode:")
 		for i, instr := range bc.Instructions {
@@ -61,13 +115,149 @@ func main() {
 
 	}
 	virtualMachine := runtime.NewVM(bc, true, PrintInfo)
+	virtualMachine.SetOverflowChecks(*overflowChecks)
+	virtualMachine.SetCompileThreshold(*compileAfter)
+	virtualMachine.SetTraceThreshold(*traceAfter)
+	virtualMachine.SetSpecializeThreshold(*specializeAt)
+	virtualMachine.SetMemoLimits(*memoPerFunc, *memoLimit)
+	virtualMachine.SetJITVerify(*jitVerify)
+	if *native {
+		if err := virtualMachine.UseNativeCode(); err != nil {
+			fmt.Printf("Native code is not available, running on the stack VM: %v\n", err)
+		}
+	}
+	if err := loadMemoCache(virtualMachine); err != nil {
+		fmt.Printf("Memo cache is not loaded: %v\n", err)
+	}
+	switch *jitReport {
+	case "", "text", "json":
+	default:
+		fmt.Printf("Unknown JIT report format: %s\n", *jitReport)
+		return
+	}
+	switch *backend {
+	case "stack":
+	case "register":
+		if err := virtualMachine.UseRegisterBackend(); err != nil {
+			fmt.Printf("Register backend is not available, running on the stack VM: %v\n", err)
+		}
+	default:
+		fmt.Printf("Unknown backend: %s\n", *backend)
+		return
+	}
 
 	if err := virtualMachine.Run(); err != nil {
 
 		fmt.Printf("VM error: %v\n", err)
+		var rtErr *runtime.RuntimeError
+		if errors.As(err, &rtErr) {
+			fmt.Print(rtErr.StackTrace())
+		}
+	}
+
+	if err := saveMemoCache(virtualMachine); err != nil {
+		fmt.Printf("Memo cache is not saved: %v\n", err)
+	}
+	if err := saveTypeFeedback(virtualMachine); err != nil {
+		fmt.Printf("Type feedback is not saved: %v\n", err)
+	}
+	if err := writeJITReport(virtualMachine); err != nil {
+		fmt.Printf("JIT report error: %v\n", err)
+	}
+	// Cached results that differ from the interpreter are bugs, the text report already lists them
+	if discrepancies := virtualMachine.JITReport().Discrepancies; len(discrepancies) > 0 {
+		if *jitReport != "text" {
+			for _, d := range discrepancies {
+				fmt.Fprintf(os.Stderr, "JIT bug: %s\n", d)
+			}
+		}
+		os.Exit(1)
 	}
 
 	if PrintInfo {
 		virtualMachine.PrintHeapSize()
 	}
 }
+
+// writeJITReport prints the report requested by -jit-report
+func writeJITReport(virtualMachine *runtime.VM) error {
+	switch *jitReport {
+	case "text":
+		return virtualMachine.JITReport().WriteText(os.Stderr)
+	case "json":
+		return virtualMachine.JITReport().WriteJSON(os.Stderr)
+	}
+	return nil
+}
+
+// loadMemoCache preloads the file given by -memo-cache, a missing file is an empty cache
+func loadMemoCache(virtualMachine *runtime.VM) error {
+	if *memoCache == "" {
+		return nil
+	}
+	file, err := os.Open(*memoCache)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = virtualMachine.LoadMemoCache(file)
+	return err
+}
+
+// saveMemoCache replaces the file given by -memo-cache with the results cached in this run
+func saveMemoCache(virtualMachine *runtime.VM) error {
+	if *memoCache == "" {
+		return nil
+	}
+	file, err := os.Create(*memoCache)
+	if err != nil {
+		return err
+	}
+	if err := virtualMachine.SaveMemoCache(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// loadTypeFeedback specializes the bytecode by the file given by -type-feedback, a missing file is no feedback
+func loadTypeFeedback(bc *bytecode.Bytecode) error {
+	if *typeFeedback == "" {
+		return nil
+	}
+	file, err := os.Open(*typeFeedback)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var feedback bytecode.TypeFeedback
+	if err := json.NewDecoder(file).Decode(&feedback); err != nil {
+		return err
+	}
+	optimizer.Specialize(bc, &feedback)
+	return nil
+}
+
+// saveTypeFeedback replaces the file given by -type-feedback with the feedback collected in this run
+func saveTypeFeedback(virtualMachine *runtime.VM) error {
+	if *typeFeedback == "" {
+		return nil
+	}
+	file, err := os.Create(*typeFeedback)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(virtualMachine.TypeFeedback()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,123 @@
+package analysis
+
+import (
+	"slices"
+	"twin-peaks-programming-language/internal/bytecode"
+)
+
+// Successors returns addresses execution may continue to after the instruction, calls are not followed.
+// A TRY continues at its handler too
+func Successors(instructions []bytecode.Instruction, addr int) []int {
+	instr := instructions[addr]
+	switch {
+	case instr.Opcode == bytecode.OpJmp:
+		return []int{instr.Operands[0]}
+	case instr.IsConditionalJump() || instr.Opcode == bytecode.OpTry:
+		return []int{instr.Operands[0], addr + 1}
+	case instr.IsTerminator():
+		return nil
+	default:
+		return []int{addr + 1}
+	}
+}
+
+// Reachable marks instructions reachable from the entry without entering called functions.
+// It reports whether all paths stay inside the program
+func Reachable(instructions []bytecode.Instruction, entry int, reachable []bool) bool {
+	inside := true
+	work := []int{entry}
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		if addr < 0 || addr >= len(instructions) {
+			inside = false
+			continue
+		}
+		if reachable[addr] {
+			continue
+		}
+		reachable[addr] = true
+		work = append(work, Successors(instructions, addr)...)
+	}
+	return inside
+}
+
+// Block is a basic block: instructions from Start up to End (exclusive) run one after another
+type Block struct {
+	Start, End int
+	Successors []int // indices of blocks
+}
+
+// Call is a direct call (CALL or TAIL_CALL) of a function
+type Call struct {
+	Addr   int // address of the call instruction
+	Callee int // entry of the called function
+}
+
+// Graph is the control flow graph of a function. Bodies of nested functions are jumped over,
+// so they are not part of the enclosing function's graph
+type Graph struct {
+	Entry      int
+	Blocks     []Block // in address order
+	Calls      []Call  // in address order
+	Returns    bool    // some path reaches RETURN or a tail call
+	OutOfRange bool    // some path leaves the program
+}
+
+// FunctionGraph builds the control flow graph of the code reachable from the entry
+func FunctionGraph(bc *bytecode.Bytecode, entry int) *Graph {
+	instructions := bc.Instructions
+	reachable := make([]bool, len(instructions))
+	graph := &Graph{Entry: entry, OutOfRange: !Reachable(instructions, entry, reachable)}
+
+	// A block starts at the entry, at a jump target and after a jump or a terminator
+	leaders := make([]bool, len(instructions)+1)
+	if entry >= 0 && entry < len(instructions) {
+		leaders[entry] = true
+	}
+	for addr, ok := range reachable {
+		if !ok {
+			continue
+		}
+		instr := instructions[addr]
+		if instr.Opcode == bytecode.OpCall || instr.Opcode == bytecode.OpTailCall {
+			graph.Calls = append(graph.Calls, Call{Addr: addr, Callee: instr.Operands[0]})
+		}
+		if instr.IsReturn() || instr.Opcode == bytecode.OpTailCall {
+			graph.Returns = true
+		}
+		successors := Successors(instructions, addr)
+		if len(successors) == 1 && successors[0] == addr+1 {
+			continue
+		}
+		for _, successor := range successors {
+			if successor >= 0 && successor <= len(instructions) {
+				leaders[successor] = true
+			}
+		}
+		leaders[addr+1] = true
+	}
+
+	blockAt := make(map[int]int)
+	for addr := 0; addr < len(instructions); addr++ {
+		if !reachable[addr] {
+			continue
+		}
+		end := addr + 1
+		for end < len(instructions) && reachable[end] && !leaders[end] {
+			end++
+		}
+		blockAt[addr] = len(graph.Blocks)
+		graph.Blocks = append(graph.Blocks, Block{Start: addr, End: end})
+		addr = end - 1
+	}
+	for i := range graph.Blocks {
+		block := &graph.Blocks[i]
+		for _, successor := range Successors(instructions, block.End-1) {
+			if index, ok := blockAt[successor]; ok && !slices.Contains(block.Successors, index) {
+				block.Successors = append(block.Successors, index)
+			}
+		}
+	}
+	return graph
+}
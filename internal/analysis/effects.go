@@ -0,0 +1,155 @@
+package analysis
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"twin-peaks-programming-language/internal/bytecode"
+)
+
+// Effect is a set of effects of executing code besides computing its results from its arguments.
+// Runtime errors are not effects: a call that fails produces no result
+type Effect uint16
+
+const (
+	EffectOutput     Effect = 1 << iota // PRINT, HALT
+	EffectHeapRead                      // loads from arrays
+	EffectHeapWrite                     // stores to arrays
+	EffectAlloc                         // allocates arrays, a result may refer to a new one
+	EffectClosures                      // closures, cells, upvalues and calls of function values
+	EffectExceptions                    // try blocks and THROW
+	EffectUnknown                       // control leaves the program or calls a missing function
+)
+
+var effectNames = []string{"output", "heap read", "heap write", "alloc", "closures", "exceptions", "unknown"}
+
+// Pure reports whether a call has no effects, so its result depends only on its arguments
+func (e Effect) Pure() bool {
+	return e == 0
+}
+
+// ReadOnly reports whether a call has no effects besides reading arrays, so its result depends only on
+// its arguments and the contents of the arrays it reads
+func (e Effect) ReadOnly() bool {
+	return e&^EffectHeapRead == 0
+}
+
+func (e Effect) String() string {
+	if e.Pure() {
+		return "pure"
+	}
+	var names []string
+	for i, name := range effectNames {
+		if e&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// instructionEffect returns effects of the instruction itself, calls are accounted by the call graph
+func instructionEffect(instr bytecode.Instruction) Effect {
+	switch instr.Opcode {
+	case bytecode.OpPrint, bytecode.OpHalt:
+		return EffectOutput
+	case bytecode.OpArrayLoad:
+		return EffectHeapRead
+	case bytecode.OpArrayStore:
+		return EffectHeapWrite
+	case bytecode.OpArrayLoadIndirect:
+		return EffectHeapRead | EffectClosures
+	case bytecode.OpArrayStoreIndirect:
+		return EffectHeapWrite | EffectClosures
+	case bytecode.OpArrayAlloc:
+		return EffectAlloc
+	case bytecode.OpClosure, bytecode.OpCallIndirect, bytecode.OpMakeCell, bytecode.OpLoadCell, bytecode.OpStoreCell,
+		bytecode.OpGetUpvalue, bytecode.OpSetUpvalue:
+		return EffectClosures
+	case bytecode.OpTry, bytecode.OpEndTry, bytecode.OpThrow:
+		return EffectExceptions
+	default:
+		return 0
+	}
+}
+
+// FunctionEffects describes effects of a function
+type FunctionEffects struct {
+	Graph  *Graph
+	Own    Effect // effects of the function's own instructions
+	Effect Effect // effects of a call: own ones and effects of all functions it calls
+	Cause  int    // address of an instruction or a call that makes the function impure, -1 for pure functions
+}
+
+// Effects is the result of the effect analysis of all functions of a program
+type Effects struct {
+	functions map[int]*FunctionEffects
+}
+
+// Analyze computes effects of every function. A function's effects are the effects of instructions reachable
+// from its entry joined with the effects of the functions it calls, so they are found as a fixed point over
+// the call graph: recursive and mutually recursive functions converge as effects only grow
+func Analyze(bc *bytecode.Bytecode) *Effects {
+	effects := &Effects{functions: make(map[int]*FunctionEffects, len(bc.FuncAddresses))}
+	for entry := range bc.FuncAddresses {
+		graph := FunctionGraph(bc, entry)
+		function := &FunctionEffects{Graph: graph, Cause: -1}
+		if graph.OutOfRange {
+			function.Own = EffectUnknown
+			function.Cause = entry
+		}
+		for _, block := range graph.Blocks {
+			for addr := block.Start; addr < block.End; addr++ {
+				if effect := instructionEffect(bc.Instructions[addr]); effect != 0 {
+					function.Own |= effect
+					if function.Cause < 0 {
+						function.Cause = addr
+					}
+				}
+			}
+		}
+		function.Effect = function.Own
+		effects.functions[entry] = function
+	}
+
+	// Entries in address order make the causes deterministic
+	entries := slices.Sorted(maps.Keys(effects.functions))
+	for changed := true; changed; {
+		changed = false
+		for _, entry := range entries {
+			function := effects.functions[entry]
+			for _, call := range function.Graph.Calls {
+				callee := EffectUnknown
+				if calleeEffects, ok := effects.functions[call.Callee]; ok {
+					callee = calleeEffects.Effect
+				}
+				if function.Effect|callee == function.Effect {
+					continue
+				}
+				function.Effect |= callee
+				if function.Cause < 0 {
+					function.Cause = call.Addr
+				}
+				changed = true
+			}
+		}
+	}
+	return effects
+}
+
+// Function returns effects of the function with the entry address, ok is false if there is no such function
+func (e *Effects) Function(entry int) (function *FunctionEffects, ok bool) {
+	function, ok = e.functions[entry]
+	return function, ok
+}
+
+// Pure reports whether the function with the entry address has no effects
+func (e *Effects) Pure(entry int) bool {
+	function, ok := e.functions[entry]
+	return ok && function.Effect.Pure()
+}
+
+// ReadOnly reports whether the function with the entry address has no effects besides reading arrays
+func (e *Effects) ReadOnly(entry int) bool {
+	function, ok := e.functions[entry]
+	return ok && function.Effect.ReadOnly()
+}
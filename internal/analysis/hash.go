@@ -0,0 +1,86 @@
+package analysis
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"twin-peaks-programming-language/internal/bytecode"
+)
+
+// Hashes returns a hash of the code of every function: its instructions reachable from the entry and the code
+// of all functions it calls. Addresses are hashed relative to the function and constants by value, so the hash
+// changes only when the function or a function it calls changes, not when unrelated code moves
+func (e *Effects) Hashes(bc *bytecode.Bytecode) map[int]string {
+	hashes := make(map[int]string, len(e.functions))
+	for entry := range e.functions {
+		hashes[entry] = e.hash(bc, entry)
+	}
+	return hashes
+}
+
+// hash hashes the functions reachable over calls from the entry in the order of discovery,
+// calls are hashed as indices in that order
+func (e *Effects) hash(bc *bytecode.Bytecode, entry int) string {
+	order := []int{entry}
+	index := map[int]int{entry: 0}
+	for i := 0; i < len(order); i++ {
+		function, ok := e.functions[order[i]]
+		if !ok {
+			continue
+		}
+		for _, call := range function.Graph.Calls {
+			if _, seen := index[call.Callee]; !seen {
+				index[call.Callee] = len(order)
+				order = append(order, call.Callee)
+			}
+		}
+	}
+
+	hash := sha256.New()
+	var encoded []byte
+	for _, function := range order {
+		encoded = binary.AppendVarint(encoded[:0], -1)
+		info, ok := bc.FuncAddresses[function]
+		effects, analyzed := e.functions[function]
+		if !ok || !analyzed || effects.Graph.OutOfRange {
+			hash.Write(binary.AppendVarint(encoded, int64(function)))
+			continue
+		}
+		encoded = binary.AppendVarint(encoded, int64(info.ParamCount))
+		encoded = binary.AppendVarint(encoded, int64(info.LocalCount))
+		encoded = binary.AppendVarint(encoded, int64(info.ReturnCount))
+		encoded = binary.AppendVarint(encoded, int64(info.UpvalueCount))
+		hash.Write(encoded)
+
+		for _, block := range effects.Graph.Blocks {
+			for addr := block.Start; addr < block.End; addr++ {
+				hash.Write(appendInstruction(encoded[:0], bc, addr-function, bc.Instructions[addr].Generic(), function, index))
+			}
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// appendInstruction encodes the instruction at the offset from the function's entry
+func appendInstruction(encoded []byte, bc *bytecode.Bytecode, offset int, instr bytecode.Instruction, entry int, index map[int]int) []byte {
+	encoded = binary.AppendVarint(encoded, int64(offset))
+	encoded = append(encoded, instr.Opcode)
+	encoded = binary.AppendVarint(encoded, int64(len(instr.Operands)))
+	for i, operand := range instr.Operands {
+		switch {
+		case i == 0 && (instr.Opcode == bytecode.OpCall || instr.Opcode == bytecode.OpTailCall):
+			operand = index[operand]
+		case i == 0 && (instr.IsJump() || instr.Opcode == bytecode.OpTry):
+			operand -= entry
+		case i == 0 && (instr.Opcode == bytecode.OpConst || instr.Opcode == bytecode.OpAddInt),
+			i == 1 && instr.Opcode == bytecode.OpIncLocal:
+			constant := fmt.Sprintf("%T:%v", bc.Constants[operand], bc.Constants[operand])
+			encoded = binary.AppendUvarint(encoded, uint64(len(constant)))
+			encoded = append(encoded, constant...)
+			continue
+		}
+		encoded = binary.AppendVarint(encoded, int64(operand))
+	}
+	return encoded
+}
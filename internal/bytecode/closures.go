@@ -0,0 +1,158 @@
+package bytecode
+
+import (
+	"fmt"
+	"twin-peaks-programming-language/internal/parser"
+)
+
+// upvalue describes a variable captured by a nested function
+type upvalue struct {
+	name    string
+	isLocal bool // captured from enclosing function's locals, otherwise from its upvalues
+	index   int  // local index or upvalue index in the enclosing function
+}
+
+// plainLocal returns index of a local variable that is not stored in a cell
+func (c *Compiler) plainLocal(name string) (int, bool) {
+	index, ok := c.currentScope.variables[name]
+	if !ok || c.currentScope.captured[name] {
+		return 0, false
+	}
+	return index, true
+}
+
+// isVariable reports whether name is a local or a captured variable of the current function
+func (c *Compiler) isVariable(name string) bool {
+	if _, ok := c.currentScope.variables[name]; ok {
+		return true
+	}
+	_, ok := c.resolveUpvalue(c.currentScope, name)
+	return ok
+}
+
+// resolveUpvalue finds variable in enclosing functions and registers it as upvalue of the scope
+func (c *Compiler) resolveUpvalue(scope *Scope, name string) (int, bool) {
+	if scope.enclosing == nil {
+		return 0, false
+	}
+	for i, uv := range scope.upvalues {
+		if uv.name == name {
+			return i, true
+		}
+	}
+
+	if index, ok := scope.enclosing.variables[name]; ok && scope.enclosing.captured[name] {
+		scope.upvalues = append(scope.upvalues, upvalue{name: name, isLocal: true, index: index})
+		return len(scope.upvalues) - 1, true
+	}
+	if index, ok := c.resolveUpvalue(scope.enclosing, name); ok {
+		scope.upvalues = append(scope.upvalues, upvalue{name: name, isLocal: false, index: index})
+		return len(scope.upvalues) - 1, true
+	}
+	return 0, false
+}
+
+// emitLoadVariable pushes value of a local, a captured variable or a top-level function
+func (c *Compiler) emitLoadVariable(name string) error {
+	if index, ok := c.currentScope.variables[name]; ok {
+		if c.currentScope.captured[name] {
+			c.emit(OpLoadCell, index)
+		} else {
+			c.emit(OpLoad, index)
+		}
+		return nil
+	}
+	if index, ok := c.resolveUpvalue(c.currentScope, name); ok {
+		c.emit(OpGetUpvalue, index)
+		return nil
+	}
+	if _, ok := c.funcTable[name]; ok {
+		// Function value without captured variables
+		c.emitJump(OpClosure, funcLabel(name))
+		return nil
+	}
+	return fmt.Errorf("variable not found: %s", name)
+}
+
+// emitStoreVariable pops value into a local or a captured variable
+func (c *Compiler) emitStoreVariable(name string) error {
+	if index, ok := c.currentScope.variables[name]; ok {
+		if c.currentScope.captured[name] {
+			c.emit(OpStoreCell, index)
+		} else {
+			c.emit(OpStore, index)
+		}
+		return nil
+	}
+	if index, ok := c.resolveUpvalue(c.currentScope, name); ok {
+		c.emit(OpSetUpvalue, index)
+		return nil
+	}
+	return fmt.Errorf("variable not declared: %s", name)
+}
+
+// capturedVariables returns names used by functions nested in the statements but not declared inside them.
+// Such variables of the enclosing function are stored in cells shared with closures
+func capturedVariables(nodes ...*parser.ASTNode) map[string]bool {
+	captured := make(map[string]bool)
+	for _, node := range nodes {
+		inspect(node, func(n *parser.ASTNode) bool {
+			if n.Type != parser.NodeFuncDecl && n.Type != parser.NodeFuncLiteral {
+				return true
+			}
+			for name := range freeVariables(n) {
+				captured[name] = true
+			}
+			return false
+		})
+	}
+	return captured
+}
+
+// freeVariables returns names referenced in the function (including its nested functions) that it does not declare
+func freeVariables(fn *parser.ASTNode) map[string]bool {
+	declared := make(map[string]bool)
+	for _, param := range fn.Children[0].Children {
+		declared[param.Children[0].Value.(string)] = true
+	}
+
+	referenced := make(map[string]bool)
+	inspect(fn.Children[2], func(n *parser.ASTNode) bool {
+		switch n.Type {
+		case parser.NodeFuncDecl, parser.NodeFuncLiteral:
+			if name, ok := n.Value.(string); ok {
+				declared[name] = true
+			}
+			for name := range freeVariables(n) {
+				referenced[name] = true
+			}
+			return false
+		case parser.NodeVarDecl, parser.NodeArrayDecl:
+			declared[n.Children[0].Value.(string)] = true
+		case parser.NodeTry:
+			declared[n.Children[1].Value.(string)] = true // catch variable
+		case parser.NodeConstDecl:
+			return false // replaced with values
+		case parser.NodeIdentifier, parser.NodeCall:
+			if name, ok := n.Value.(string); ok {
+				referenced[name] = true
+			}
+		}
+		return true
+	})
+
+	for name := range declared {
+		delete(referenced, name)
+	}
+	return referenced
+}
+
+// inspect traverses the AST in depth-first order, children are skipped when f returns false
+func inspect(node *parser.ASTNode, f func(*parser.ASTNode) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	for _, child := range node.Children {
+		inspect(child, f)
+	}
+}
@@ -2,7 +2,9 @@ package bytecode
 
 import (
 	"fmt"
+	"math/big"
 	"strconv"
+	"twin-peaks-programming-language/internal/checker"
 	"twin-peaks-programming-language/internal/lexer"
 	"twin-peaks-programming-language/internal/parser"
 )
@@ -15,10 +17,22 @@ type Compiler struct {
 	labels       map[string]int
 	labelCounter int
 	unresolved   map[string][]int
+	currentLine  int // source line of the node being compiled, recorded in emitted instructions
 }
 
 type Scope struct {
-	variables map[string]int // имя -> индекс локальной переменной
+	variables map[string]int  // имя -> индекс локальной переменной
+	captured  map[string]bool // локальные переменные, захваченные вложенными функциями (хранятся в ячейках)
+	enclosing *Scope          // область видимости объемлющей функции (только для вложенных функций)
+	upvalues  []upvalue       // переменные, захваченные из объемлющих функций
+}
+
+func newScope(enclosing *Scope, body ...*parser.ASTNode) *Scope {
+	return &Scope{
+		variables: make(map[string]int),
+		captured:  capturedVariables(body...),
+		enclosing: enclosing,
+	}
 }
 
 func NewCompiler() *Compiler {
@@ -28,7 +42,7 @@ func NewCompiler() *Compiler {
 			Constants:     []interface{}{},
 			FuncAddresses: make(map[int]*FunctionInfo),
 		},
-		currentScope: &Scope{variables: make(map[string]int)},
+		currentScope: newScope(nil),
 		funcTable:    make(map[string]*FunctionInfo),
 		labels:       make(map[string]int),
 		unresolved:   make(map[string][]int),
@@ -41,7 +55,32 @@ func (c *Compiler) Compile(ast *parser.ASTNode) (*Bytecode, error) {
 		return nil, fmt.Errorf("expected Program node")
 	}
 
+	if err := checker.Check(ast); err != nil {
+		return nil, err
+	}
+	if err := foldConstants(ast); err != nil {
+		return nil, err
+	}
+
+	if err := c.declareFunctions(ast); err != nil {
+		return nil, err
+	}
+
+	// Functions are stored before the main program
+	var statements []*parser.ASTNode
 	for _, child := range ast.Children {
+		if child.Type != parser.NodeFuncDecl {
+			statements = append(statements, child)
+			continue
+		}
+		if err := c.compileFuncDecl(child); err != nil {
+			return nil, err
+		}
+	}
+	c.bytecode.ProgramStart = len(c.bytecode.Instructions)
+
+	c.currentScope.captured = capturedVariables(statements...)
+	for _, child := range statements {
 		if err := c.compileNode(child); err != nil {
 			return nil, err
 		}
@@ -61,6 +100,10 @@ func (c *Compiler) Compile(ast *parser.ASTNode) (*Bytecode, error) {
 }
 
 func (c *Compiler) compileNode(node *parser.ASTNode) error {
+	if node.Token.Line > 0 {
+		c.currentLine = node.Token.Line
+	}
+
 	switch node.Type {
 	case parser.NodeVarDecl:
 		return c.compileVarDecl(node)
@@ -80,14 +123,28 @@ func (c *Compiler) compileNode(node *parser.ASTNode) error {
 		return c.compileCall(node)
 	case parser.NodeIf:
 		return c.compileIf(node)
+	case parser.NodeTernary:
+		return c.compileTernary(node)
 	case parser.NodeFor:
 		return c.compileFor(node)
 	case parser.NodeReturn:
 		return c.compileReturn(node)
 	case parser.NodeFuncDecl:
-		return c.compileFuncDecl(node)
+		return c.compileNestedFuncDecl(node)
+	case parser.NodeFuncLiteral:
+		return c.compileFuncLiteral(node)
+	case parser.NodeCallIndirect:
+		return c.compileCallIndirect(node)
+	case parser.NodeTupleAssign:
+		return c.compileTupleAssign(node)
+	case parser.NodeTry:
+		return c.compileTry(node)
+	case parser.NodeThrow:
+		return c.compileThrow(node)
 	case parser.NodeBlock:
 		return c.compileBlock(node)
+	case parser.NodeConstDecl:
+		return nil // uses are replaced with the value by foldConstants
 
 	default:
 		return fmt.Errorf("unsupported node type: \n%s", node.String())
@@ -102,17 +159,43 @@ func (c *Compiler) compileVarDecl(node *parser.ASTNode) error {
 	varName := node.Children[0].Value.(string)
 
 	localIndex := c.allocateLocal(varName)
+	if c.currentScope.captured[varName] {
+		c.emit(OpMakeCell, localIndex)
+	}
 
 	if len(node.Children) > 2 {
 		if err := c.compileNode(node.Children[2]); err != nil {
 			return err
 		}
-		c.emit(OpStore, localIndex)
+		return c.emitStoreVariable(varName)
+	}
+
+	// Numbers start at zero of their type, so arithmetic never sees a missing value
+	if zero, ok := zeroValue(node.Children[1]); ok {
+		c.emit(OpConst, c.addConstant(zero))
+		return c.emitStoreVariable(varName)
 	}
 
 	return nil
 }
 
+func zeroValue(typeNode *parser.ASTNode) (interface{}, bool) {
+	if typeNode.Type != parser.NodeVarType {
+		return nil, false
+	}
+	switch typeNode.Value {
+	case checker.TypeInt:
+		return 0, true
+	case checker.TypeUint:
+		return uint64(0), true
+	case checker.TypeFloat:
+		return 0.0, true
+	case checker.TypeBigInt:
+		return new(big.Int), true
+	}
+	return nil, false
+}
+
 func (c *Compiler) compileArrayDecl(node *parser.ASTNode) error {
 	if len(node.Children) < 3 {
 		return fmt.Errorf("invalid ArrayDeclNode node")
@@ -128,29 +211,55 @@ func (c *Compiler) compileArrayDecl(node *parser.ASTNode) error {
 
 	c.emit(OpArrayAlloc, arrayIndex)
 	c.emit(OpStore, arrayIndex)
+	if c.currentScope.captured[arrayName] {
+		c.emit(OpMakeCell, arrayIndex)
+	}
 
 	return nil
 }
 
 func (c *Compiler) compileArrayLoad(node *parser.ASTNode) error {
+	arrayName := node.Children[0].Value.(string)
+
+	if localIndex, ok := c.plainLocal(arrayName); ok {
+		if err := c.compileNode(node.Children[1]); err != nil {
+			return err
+		}
+		c.emit(OpArrayLoad, localIndex)
+		return nil
+	}
 
-	localIndex := c.currentScope.variables[node.Children[0].Value.(string)]
+	// Array is captured by a closure: pointer to it is loaded on the stack
+	if err := c.emitLoadVariable(arrayName); err != nil {
+		return err
+	}
 	if err := c.compileNode(node.Children[1]); err != nil {
 		return err
 	}
-	c.emit(OpArrayLoad, localIndex)
+	c.emit(OpArrayLoadIndirect)
 
 	return nil
 }
 
 func (c *Compiler) compileArrayStore(l, r *parser.ASTNode) error {
-	localIndex := c.currentScope.variables[l.Children[0].Value.(string)]
+	arrayName := l.Children[0].Value.(string)
+
+	localIndex, isPlainLocal := c.plainLocal(arrayName)
+	if !isPlainLocal {
+		if err := c.emitLoadVariable(arrayName); err != nil {
+			return err
+		}
+	}
 	if err := c.compileNode(l.Children[1]); err != nil {
 		return err
 	}
 	if err := c.compileNode(r); err != nil {
 		return err
 	}
+	if !isPlainLocal {
+		c.emit(OpArrayStoreIndirect)
+		return nil
+	}
 	c.emit(OpArrayStore, localIndex)
 	return nil
 }
@@ -177,8 +286,7 @@ func (c *Compiler) compileBinaryOp(node *parser.ASTNode) error {
 		}
 
 		varName := left.Value.(string)
-		localIndex, ok := c.currentScope.variables[varName]
-		if !ok {
+		if !c.isVariable(varName) {
 			return fmt.Errorf("variable not declared: %s", varName)
 		}
 
@@ -186,8 +294,7 @@ func (c *Compiler) compileBinaryOp(node *parser.ASTNode) error {
 			return err
 		}
 
-		c.emit(OpStore, localIndex)
-		return nil
+		return c.emitStoreVariable(varName)
 	}
 
 	// Left operand
@@ -257,13 +364,7 @@ func (c *Compiler) compileUnaryOp(node *parser.ASTNode) error {
 }
 
 func (c *Compiler) compileIdentifier(node *parser.ASTNode) error {
-	varName := node.Value.(string)
-	localIndex, ok := c.currentScope.variables[varName]
-	if !ok {
-		return fmt.Errorf("variable not found: %s", varName)
-	}
-	c.emit(OpLoad, localIndex)
-	return nil
+	return c.emitLoadVariable(node.Value.(string))
 }
 
 func (c *Compiler) compileLiteral(node *parser.ASTNode) error {
@@ -271,6 +372,30 @@ func (c *Compiler) compileLiteral(node *parser.ASTNode) error {
 
 	switch node.Token.Type {
 	case lexer.ConstNum:
+		// Untyped constants have the type of their context
+		switch node.DataType {
+		case checker.TypeUint:
+			uintVal, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid uint literal: %s", value)
+			}
+			c.emit(OpConst, c.addConstant(uintVal))
+			return nil
+		case checker.TypeFloat:
+			floatVal, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid float literal: %s", value)
+			}
+			c.emit(OpConst, c.addConstant(floatVal))
+			return nil
+		case checker.TypeBigInt:
+			bigVal, ok := new(big.Int).SetString(value, 10)
+			if !ok {
+				return fmt.Errorf("invalid bigint literal: %s", value)
+			}
+			c.emit(OpConst, c.addConstant(bigVal))
+			return nil
+		}
 		if intVal, err := strconv.ParseInt(value, 10, 64); err == nil {
 			constIndex := c.addConstant(int(intVal))
 			c.emit(OpConst, constIndex)
@@ -335,6 +460,98 @@ func (c *Compiler) compileIf(node *parser.ASTNode) error {
 	return nil
 }
 
+// compileTernary leaves exactly one value on the stack: the result of the taken branch
+func (c *Compiler) compileTernary(node *parser.ASTNode) error {
+	if len(node.Children) < 3 {
+		return fmt.Errorf("invalid Ternary node")
+	}
+
+	// Condition
+	if err := c.compileNode(node.Children[0]); err != nil {
+		return err
+	}
+
+	elseLabel := c.newLabel("ternary_else")
+	endLabel := c.newLabel("ternary_end")
+
+	c.emitJump(OpJmpIfFalse, elseLabel)
+
+	if err := c.compileNode(node.Children[1]); err != nil {
+		return err
+	}
+
+	c.emitJump(OpJmp, endLabel)
+
+	c.placeLabel(elseLabel)
+
+	if err := c.compileNode(node.Children[2]); err != nil {
+		return err
+	}
+
+	c.placeLabel(endLabel)
+
+	return nil
+}
+
+// compileTry registers the catch block as the handler while the try block runs.
+// The catch block starts with the error value on the stack
+func (c *Compiler) compileTry(node *parser.ASTNode) error {
+	if len(node.Children) < 3 {
+		return fmt.Errorf("invalid Try node")
+	}
+
+	catchLabel := c.newLabel("catch")
+	endLabel := c.newLabel("endtry")
+
+	c.emitJump(OpTry, catchLabel)
+
+	if c.currentFunc != nil {
+		c.currentFunc.TryDepth++
+	}
+	err := c.compileNode(node.Children[0])
+	if c.currentFunc != nil {
+		c.currentFunc.TryDepth--
+	}
+	if err != nil {
+		return err
+	}
+
+	c.emit(OpEndTry)
+	c.emitJump(OpJmp, endLabel)
+
+	c.placeLabel(catchLabel)
+
+	errName := node.Children[1].Value.(string)
+	errIndex := c.allocateLocal(errName)
+	if c.currentScope.captured[errName] {
+		c.emit(OpMakeCell, errIndex)
+	}
+	if err := c.emitStoreVariable(errName); err != nil {
+		return err
+	}
+
+	if err := c.compileNode(node.Children[2]); err != nil {
+		return err
+	}
+
+	c.placeLabel(endLabel)
+
+	return nil
+}
+
+func (c *Compiler) compileThrow(node *parser.ASTNode) error {
+	if len(node.Children) < 1 {
+		return fmt.Errorf("invalid Throw node")
+	}
+
+	if err := c.compileNode(node.Children[0]); err != nil {
+		return err
+	}
+	c.emit(OpThrow)
+
+	return nil
+}
+
 func (c *Compiler) compileFor(node *parser.ASTNode) error {
 	if len(node.Children) < 4 {
 		return fmt.Errorf("invalid For node")
@@ -394,11 +611,13 @@ func (c *Compiler) emit(opcode byte, operands ...int) {
 	c.bytecode.Instructions = append(c.bytecode.Instructions, Instruction{
 		Opcode:   opcode,
 		Operands: operands,
+		Line:     c.currentLine,
 	})
 }
 
-func (c *Compiler) emitJump(opcode byte, label string) {
-	instr := Instruction{Opcode: opcode, Operands: []int{0}}
+// emitJump emits an instruction whose first operand is the address of the label, extra operands follow it
+func (c *Compiler) emitJump(opcode byte, label string, operands ...int) {
+	instr := Instruction{Opcode: opcode, Operands: append([]int{0}, operands...), Line: c.currentLine}
 	c.bytecode.Instructions = append(c.bytecode.Instructions, instr)
 	idx := len(c.bytecode.Instructions) - 1
 
@@ -412,10 +631,14 @@ func (c *Compiler) emitJump(opcode byte, label string) {
 }
 
 func (c *Compiler) addConstant(value interface{}) int {
+	bigValue, isBig := value.(*big.Int)
 	for i, v := range c.bytecode.Constants {
 		if v == value {
 			return i
 		}
+		if other, ok := v.(*big.Int); ok && isBig && other.Cmp(bigValue) == 0 {
+			return i
+		}
 	}
 	c.bytecode.Constants = append(c.bytecode.Constants, value)
 	return len(c.bytecode.Constants) - 1
@@ -469,6 +692,11 @@ func (c *Compiler) resolveUnresolvedLabels() error {
 }
 
 func (c *Compiler) compileCall(node *parser.ASTNode) error {
+	return c.compileCallResults(node, 1)
+}
+
+// compileCallResults compiles a call whose result is used as the given number of values
+func (c *Compiler) compileCallResults(node *parser.ASTNode, results int) error {
 	funcName := node.Value.(string)
 
 	isBuiltin, err := c.tryCompileBuiltInFunc(node)
@@ -476,6 +704,26 @@ func (c *Compiler) compileCall(node *parser.ASTNode) error {
 		return err
 	}
 	if isBuiltin {
+		if results > 1 {
+			return fmt.Errorf("function %s returns 1 value, %d expected", funcName, results)
+		}
+		return nil
+	}
+
+	// Function value stored in a variable
+	if c.isVariable(funcName) {
+		if results > 1 {
+			return fmt.Errorf("cannot destructure result of function value %s", funcName)
+		}
+		for i := len(node.Children) - 1; i >= 0; i-- {
+			if err := c.compileNode(node.Children[i]); err != nil {
+				return err
+			}
+		}
+		if err := c.emitLoadVariable(funcName); err != nil {
+			return err
+		}
+		c.emit(OpCallIndirect, len(node.Children))
 		return nil
 	}
 
@@ -489,6 +737,10 @@ func (c *Compiler) compileCall(node *parser.ASTNode) error {
 			funcName, funcInfo.ParamCount, len(node.Children))
 	}
 
+	if (results > 1 || funcInfo.ReturnCount > 1) && results != funcInfo.ReturnCount {
+		return fmt.Errorf("function %s returns %d values, %d expected", funcName, funcInfo.ReturnCount, results)
+	}
+
 	// Reverse order of arguments
 	for i := len(node.Children) - 1; i >= 0; i-- {
 		if err := c.compileNode(node.Children[i]); err != nil {
@@ -496,11 +748,36 @@ func (c *Compiler) compileCall(node *parser.ASTNode) error {
 		}
 	}
 
-	c.emit(OpCall, funcInfo.Address)
+	// Address may be unknown yet (forward reference), so the call is patched through the function's label
+	c.emitJump(OpCall, funcLabel(funcName))
 
 	return nil
 }
 
+// compileCallIndirect calls a function value produced by an expression: callee is the first child
+func (c *Compiler) compileCallIndirect(node *parser.ASTNode) error {
+	args := node.Children[1:]
+	for i := len(args) - 1; i >= 0; i-- {
+		if err := c.compileNode(args[i]); err != nil {
+			return err
+		}
+	}
+	if err := c.compileNode(node.Children[0]); err != nil {
+		return err
+	}
+	c.emit(OpCallIndirect, len(args))
+	return nil
+}
+
+var conversions = map[string]int{
+	checker.TypeInt:    ConvertInt,
+	checker.TypeUint:   ConvertUint,
+	checker.TypeFloat:  ConvertFloat,
+	checker.TypeString: ConvertString,
+	checker.TypeBool:   ConvertBool,
+	checker.TypeBigInt: ConvertBigInt,
+}
+
 func (c *Compiler) tryCompileBuiltInFunc(node *parser.ASTNode) (bool, error) {
 	funcName := node.Value.(string)
 
@@ -522,6 +799,15 @@ func (c *Compiler) tryCompileBuiltInFunc(node *parser.ASTNode) (bool, error) {
 		}
 		c.emit(OpSqrt)
 		return true, nil
+	case checker.TypeInt, checker.TypeUint, checker.TypeFloat, checker.TypeString, checker.TypeBool, checker.TypeBigInt:
+		if len(node.Children) != 1 {
+			return true, fmt.Errorf("conversion to %s expects 1 argument, got %d", funcName, len(node.Children))
+		}
+		if err := c.compileNode(node.Children[0]); err != nil {
+			return true, err
+		}
+		c.emit(OpConvert, conversions[funcName])
+		return true, nil
 	}
 	return false, nil
 }
@@ -531,13 +817,73 @@ func (c *Compiler) compileReturn(node *parser.ASTNode) error {
 		c.currentFunc.HasReturn = true
 	}
 
-	if len(node.Children) > 0 {
-		if err := c.compileNode(node.Children[0]); err != nil {
+	if c.currentFunc != nil && c.currentFunc.ReturnCount > 1 && len(node.Children) != c.currentFunc.ReturnCount {
+		return fmt.Errorf("function %s returns %d values, got %d", c.currentFunc.Name, c.currentFunc.ReturnCount, len(node.Children))
+	}
+
+	if c.isSelfTailCall(node) {
+		call := node.Children[0]
+		for i := len(call.Children) - 1; i >= 0; i-- {
+			if err := c.compileNode(call.Children[i]); err != nil {
+				return err
+			}
+		}
+		c.emitJump(OpTailCall, funcLabel(c.currentFunc.Name))
+		return nil
+	}
+
+	for _, child := range node.Children {
+		if err := c.compileNode(child); err != nil {
 			return err
 		}
-		c.emit(OpReturn)
-	} else {
+	}
+
+	switch len(node.Children) {
+	case 0:
 		c.emit(OpReturnVoid)
+	case 1:
+		c.emit(OpReturn)
+	default:
+		c.emit(OpReturn, len(node.Children)) // values are left on the stack in order
+	}
+
+	return nil
+}
+
+// isSelfTailCall reports whether the return statement is `return f(...)` inside f itself,
+// such call may reuse the frame. Functions held in variables and calls inside try blocks are excluded
+func (c *Compiler) isSelfTailCall(node *parser.ASTNode) bool {
+	if c.currentFunc == nil || c.currentFunc.TryDepth > 0 || c.currentFunc.ReturnCount != 1 || len(node.Children) != 1 {
+		return false
+	}
+	call := node.Children[0]
+	if call.Type != parser.NodeCall || call.Value != c.currentFunc.Name || c.isVariable(c.currentFunc.Name) {
+		return false
+	}
+	info, ok := c.funcTable[c.currentFunc.Name]
+	return ok && info.Address == c.currentFunc.Address && len(call.Children) == info.ParamCount
+}
+
+// compileTupleAssign stores values returned by a function call: q, r = divmod(7, 2);
+func (c *Compiler) compileTupleAssign(node *parser.ASTNode) error {
+	targets := node.Children[:len(node.Children)-1]
+	value := node.Children[len(node.Children)-1]
+
+	if value.Type != parser.NodeCall {
+		return fmt.Errorf("right side of tuple assignment must be a function call")
+	}
+	if err := c.compileCallResults(value, len(targets)); err != nil {
+		return err
+	}
+
+	// The last value is on top of the stack
+	for i := len(targets) - 1; i >= 0; i-- {
+		if targets[i].Type != parser.NodeIdentifier {
+			return fmt.Errorf("left side of assignment must be identifier")
+		}
+		if err := c.emitStoreVariable(targets[i].Value.(string)); err != nil {
+			return err
+		}
 	}
 
 	return nil
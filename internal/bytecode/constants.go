@@ -33,4 +33,62 @@ const (
 	OpArrayAlloc
 	OpArrayLoad
 	OpArrayStore
+
+	OpClosure            // Создать замыкание (адрес функции, пары isLocal/индекс захваченных переменных)
+	OpCallIndirect       // Вызов значения-функции со стека
+	OpMakeCell           // Переместить локальную переменную в ячейку (захватывается замыканием)
+	OpLoadCell           // Загрузить переменную из ячейки
+	OpStoreCell          // Сохранить переменную в ячейку
+	OpGetUpvalue         // Загрузить захваченную переменную
+	OpSetUpvalue         // Сохранить захваченную переменную
+	OpArrayLoadIndirect  // Загрузить элемент массива, указатель на массив на стеке
+	OpArrayStoreIndirect // Сохранить элемент массива, указатель на массив на стеке
+
+	OpTry    // Начало блока try (адрес обработчика catch)
+	OpEndTry // Конец блока try
+	OpThrow  // Выбросить исключение
+
+	OpConvert // Явное преобразование типа (операнд - один из Convert*)
+
+	OpStoreKeep // Сохранить в переменную, оставив значение на стеке (STORE x; LOAD x)
+
+	OpTailCall // Рекурсивный вызов в хвостовой позиции, переиспользует текущий фрейм
+
+	// Суперинструкции, создаются оптимизатором из частых последовательностей
+	OpIncLocal     // Прибавить константу к переменной (LOAD x; CONST k; ADD; STORE x)
+	OpLoadLoad     // Загрузить две переменные (LOAD x; LOAD y)
+	OpLtJmpIfFalse // Переход, если не меньше (LT; JMP_IF_FALSE)
+	OpAddInt       // Прибавить целую константу к вершине стека (CONST k; ADD)
+
+	// Специализированные инструкции, интерпретатор подставляет их вместо мономорфных операций по собранным
+	// типам операндов и возвращает общую операцию, если операнды другого типа
+	OpIntAdd
+	OpIntSub
+	OpIntMul
+	OpIntEq
+	OpIntNeq
+	OpIntLt
+	OpIntLe
+	OpIntGt
+	OpIntGe
+	OpFloatAdd
+	OpFloatSub
+	OpFloatMul
+	OpFloatDiv
+	OpFloatEq
+	OpFloatNeq
+	OpFloatLt
+	OpFloatLe
+	OpFloatGt
+	OpFloatGe
+)
+
+// Целевые типы OpConvert
+const (
+	ConvertInt = iota
+	ConvertUint
+	ConvertFloat
+	ConvertString
+	ConvertBool
+	ConvertBigInt
 )
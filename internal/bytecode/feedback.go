@@ -0,0 +1,121 @@
+package bytecode
+
+import "fmt"
+
+// OperandKinds is the set of kinds of operands an instruction was executed with
+type OperandKinds uint8
+
+const (
+	KindsInt   OperandKinds = 1 << iota // both operands were ints
+	KindsFloat                          // both operands were floats
+	KindsOther                          // any other combination
+)
+
+// Monomorphic reports whether the instruction was executed with operands of a single kind it has a specialization for
+func (k OperandKinds) Monomorphic() bool {
+	return k == KindsInt || k == KindsFloat
+}
+
+func (k OperandKinds) String() string {
+	switch k {
+	case 0:
+		return "none"
+	case KindsInt:
+		return "int"
+	case KindsFloat:
+		return "float"
+	default:
+		return "mixed"
+	}
+}
+
+func (k OperandKinds) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *OperandKinds) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "none":
+		*k = 0
+	case "int":
+		*k = KindsInt
+	case "float":
+		*k = KindsFloat
+	case "mixed":
+		*k = KindsOther
+	default:
+		return fmt.Errorf("unknown operand kinds %q", text)
+	}
+	return nil
+}
+
+// TypeFeedback is the profile of operand kinds the interpreter collected for arithmetic and comparisons.
+// It is saved after a run and specializes the same program ahead of time in the next one
+type TypeFeedback struct {
+	Sites []SiteFeedback `json:"sites"`
+}
+
+// SiteFeedback describes one instruction, the opcode and the line identify it when the code has changed
+type SiteFeedback struct {
+	Addr   int          `json:"addr"`
+	Opcode string       `json:"opcode"` // name of the generic instruction
+	Line   int          `json:"line"`
+	Kinds  OperandKinds `json:"kinds"`
+	Count  int          `json:"count"`  // executions by the generic instruction
+	Deopts int          `json:"deopts"` // times the specialized instruction met other operands
+}
+
+var intSpecializations = map[byte]byte{
+	OpAdd: OpIntAdd, OpSub: OpIntSub, OpMul: OpIntMul,
+	OpEq: OpIntEq, OpNeq: OpIntNeq, OpLt: OpIntLt, OpLe: OpIntLe, OpGt: OpIntGt, OpGe: OpIntGe,
+}
+
+// floatSpecializations has division as well, floats are divided by zero without an error
+var floatSpecializations = map[byte]byte{
+	OpAdd: OpFloatAdd, OpSub: OpFloatSub, OpMul: OpFloatMul, OpDiv: OpFloatDiv,
+	OpEq: OpFloatEq, OpNeq: OpFloatNeq, OpLt: OpFloatLt, OpLe: OpFloatLe, OpGt: OpFloatGt, OpGe: OpFloatGe,
+}
+
+// generics maps specialized opcodes back to the generic ones
+var generics = func() map[byte]byte {
+	generics := make(map[byte]byte)
+	for _, specializations := range []map[byte]byte{intSpecializations, floatSpecializations} {
+		for generic, specialized := range specializations {
+			generics[specialized] = generic
+		}
+	}
+	return generics
+}()
+
+// Specialize returns the opcode specialized for monomorphic operands, false if there is none
+func Specialize(opcode byte, kinds OperandKinds) (byte, bool) {
+	var specialized byte
+	var ok bool
+	switch kinds {
+	case KindsInt:
+		specialized, ok = intSpecializations[opcode]
+	case KindsFloat:
+		specialized, ok = floatSpecializations[opcode]
+	}
+	return specialized, ok
+}
+
+// Generic returns the instruction with the generic opcode of a specialized one. Code generators and analyses
+// read instructions through it, since the interpreter rewrites opcodes while the program runs
+func (i Instruction) Generic() Instruction {
+	if generic, ok := generics[i.Opcode]; ok {
+		i.Opcode = generic
+	}
+	return i
+}
+
+// SpecializedKinds returns the operand kinds the instruction was specialized for, 0 for generic instructions
+func (i Instruction) SpecializedKinds() OperandKinds {
+	switch {
+	case i.Opcode >= OpIntAdd && i.Opcode <= OpIntGe:
+		return KindsInt
+	case i.Opcode >= OpFloatAdd && i.Opcode <= OpFloatGe:
+		return KindsFloat
+	}
+	return 0
+}
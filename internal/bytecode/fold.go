@@ -0,0 +1,523 @@
+package bytecode
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"twin-peaks-programming-language/internal/checker"
+	"twin-peaks-programming-language/internal/lexer"
+	"twin-peaks-programming-language/internal/parser"
+)
+
+// folder replaces constant subexpressions of the type-checked AST with literals and
+// substitutes values of named constants. Expressions that would fail at run time
+// (division by zero, int overflow) are left as is, so the VM reports them
+type folder struct {
+	scope *constScope
+}
+
+// constScope maps names to literal values of constants, nil value is a variable shadowing a constant
+type constScope struct {
+	values    map[string]*parser.ASTNode
+	enclosing *constScope
+}
+
+func newConstScope(enclosing *constScope) *constScope {
+	return &constScope{values: make(map[string]*parser.ASTNode), enclosing: enclosing}
+}
+
+func (s *constScope) lookup(name string) *parser.ASTNode {
+	for ; s != nil; s = s.enclosing {
+		if value, ok := s.values[name]; ok {
+			return value
+		}
+	}
+	return nil
+}
+
+// foldConstants runs the folding pass, top-level constants are visible in top-level functions
+func foldConstants(program *parser.ASTNode) error {
+	globals := newConstScope(nil)
+	f := &folder{scope: globals}
+	for _, child := range program.Children {
+		if child.Type == parser.NodeConstDecl {
+			if err := f.foldConstDecl(child); err != nil {
+				return err
+			}
+		}
+	}
+
+	f.scope = newConstScope(globals)
+	for _, child := range program.Children {
+		var err error
+		switch child.Type {
+		case parser.NodeFuncDecl:
+			err = f.foldFunction(child, globals)
+		case parser.NodeConstDecl:
+			// already folded
+		default:
+			err = f.foldNode(child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *folder) declareVariable(name string) {
+	f.scope.values[name] = nil
+}
+
+func (f *folder) foldConstDecl(node *parser.ASTNode) error {
+	name := node.Children[0].Value.(string)
+	if err := f.foldNode(node.Children[2]); err != nil {
+		return err
+	}
+	if node.Children[2].Type != parser.NodeLiteral {
+		return fmt.Errorf("cannot evaluate constant %s at line %d", name, node.Token.Line)
+	}
+	f.scope.values[name] = node.Children[2]
+	return nil
+}
+
+func (f *folder) foldFunction(node *parser.ASTNode, enclosing *constScope) error {
+	prevScope := f.scope
+	f.scope = newConstScope(enclosing)
+	for _, param := range node.Children[0].Children {
+		f.declareVariable(param.Children[0].Value.(string))
+	}
+	err := f.foldNode(node.Children[2])
+	f.scope = prevScope
+	return err
+}
+
+func (f *folder) foldChildren(nodes []*parser.ASTNode) error {
+	for _, child := range nodes {
+		if err := f.foldNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *folder) foldNode(node *parser.ASTNode) error {
+	switch node.Type {
+	case parser.NodeConstDecl:
+		return f.foldConstDecl(node)
+
+	case parser.NodeVarDecl:
+		if err := f.foldChildren(node.Children[2:]); err != nil {
+			return err
+		}
+		f.declareVariable(node.Children[0].Value.(string))
+		return nil
+
+	case parser.NodeArrayDecl:
+		if err := f.foldNode(node.Children[1]); err != nil {
+			return err
+		}
+		f.declareVariable(node.Children[0].Value.(string))
+		return nil
+
+	case parser.NodeFuncDecl:
+		f.declareVariable(node.Value.(string))
+		return f.foldFunction(node, f.scope)
+
+	case parser.NodeFuncLiteral:
+		return f.foldFunction(node, f.scope)
+
+	case parser.NodeTry:
+		if err := f.foldNode(node.Children[0]); err != nil {
+			return err
+		}
+		f.declareVariable(node.Children[1].Value.(string))
+		return f.foldNode(node.Children[2])
+
+	case parser.NodeArrayAccess:
+		return f.foldNode(node.Children[1]) // array name is not a value
+
+	case parser.NodeTupleAssign:
+		for _, target := range node.Children[:len(node.Children)-1] {
+			if target.Type == parser.NodeArrayAccess {
+				if err := f.foldNode(target); err != nil {
+					return err
+				}
+			}
+		}
+		return f.foldNode(node.Children[len(node.Children)-1])
+
+	case parser.NodeIdentifier:
+		if name, ok := node.Value.(string); ok {
+			if value := f.scope.lookup(name); value != nil {
+				literal := *value
+				literal.Token.Line = node.Token.Line
+				*node = literal
+			}
+		}
+		return nil
+
+	case parser.NodeBinaryOp:
+		if node.Value == "=" {
+			left := node.Children[0]
+			if left.Type == parser.NodeArrayAccess {
+				if err := f.foldNode(left); err != nil {
+					return err
+				}
+			}
+			return f.foldNode(node.Children[1])
+		}
+	}
+
+	if err := f.foldChildren(node.Children); err != nil {
+		return err
+	}
+	f.evaluate(node)
+	return nil
+}
+
+// evaluate replaces the expression with a literal if all its operands are literals
+func (f *folder) evaluate(node *parser.ASTNode) {
+	switch node.Type {
+	case parser.NodeTernary:
+		if cond, ok := literalValue(node.Children[0]).(bool); ok {
+			branch := node.Children[2]
+			if cond {
+				branch = node.Children[1]
+			}
+			*node = *branch
+		}
+		return
+	case parser.NodeUnaryOp, parser.NodeBinaryOp:
+	case parser.NodeCall:
+		if _, isConversion := conversions[node.Value.(string)]; !isConversion || len(node.Children) != 1 {
+			return
+		}
+	default:
+		return
+	}
+
+	operands := make([]interface{}, len(node.Children))
+	for i, child := range node.Children {
+		if operands[i] = literalValue(child); operands[i] == nil {
+			return
+		}
+	}
+
+	var result interface{}
+	switch node.Type {
+	case parser.NodeUnaryOp:
+		result = foldUnary(node.Value.(string), operands[0])
+	case parser.NodeBinaryOp:
+		result = foldBinary(node.Value.(string), operands[0], operands[1])
+	case parser.NodeCall:
+		result = foldConversion(node.Value.(string), operands[0])
+	}
+	if literal := newLiteral(result, node.DataType, node.Token.Line); literal != nil {
+		*node = *literal
+	}
+}
+
+// literalValue returns the value of a literal node of known type, nil otherwise
+func literalValue(node *parser.ASTNode) interface{} {
+	if node.Type != parser.NodeLiteral {
+		return nil
+	}
+	value := node.Value.(string)
+	switch node.Token.Type {
+	case lexer.ConstText:
+		return value
+	case lexer.True:
+		return true
+	case lexer.False:
+		return false
+	}
+
+	switch node.DataType {
+	case checker.TypeInt:
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return int(v)
+		}
+	case checker.TypeUint:
+		if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return v
+		}
+	case checker.TypeFloat:
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			return v
+		}
+	case checker.TypeBigInt:
+		if v, ok := new(big.Int).SetString(value, 10); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// newLiteral builds a literal node holding the value, nil if the value does not match the expression type
+func newLiteral(value interface{}, dataType string, line int) *parser.ASTNode {
+	node := &parser.ASTNode{Type: parser.NodeLiteral, DataType: dataType, Token: lexer.Token{Type: lexer.ConstNum, Line: line}}
+	switch v := value.(type) {
+	case int:
+		if dataType != checker.TypeInt {
+			return nil
+		}
+		node.Value = strconv.Itoa(v)
+	case uint64:
+		if dataType != checker.TypeUint {
+			return nil
+		}
+		node.Value = strconv.FormatUint(v, 10)
+	case float64:
+		if dataType != checker.TypeFloat {
+			return nil
+		}
+		node.Value = strconv.FormatFloat(v, 'g', -1, 64)
+	case *big.Int:
+		if dataType != checker.TypeBigInt {
+			return nil
+		}
+		node.Value = v.String()
+	case bool:
+		if dataType != checker.TypeBool {
+			return nil
+		}
+		node.Value = strconv.FormatBool(v)
+		node.Token.Type = lexer.False
+		if v {
+			node.Token.Type = lexer.True
+		}
+	default:
+		return nil
+	}
+	node.Token.Text = node.Value.(string)
+	return node
+}
+
+func foldUnary(op string, operand interface{}) interface{} {
+	switch op {
+	case "-":
+		switch v := operand.(type) {
+		case int:
+			if v != math.MinInt {
+				return -v
+			}
+		case uint64:
+			return -v
+		case float64:
+			return -v
+		case *big.Int:
+			return new(big.Int).Neg(v)
+		}
+	case "!":
+		if v, ok := operand.(bool); ok {
+			return !v
+		}
+	}
+	return nil
+}
+
+func foldBinary(op string, left, right interface{}) interface{} {
+	switch a := left.(type) {
+	case int:
+		if b, ok := right.(int); ok {
+			return foldInt(op, a, b)
+		}
+	case uint64:
+		if b, ok := right.(uint64); ok {
+			return foldUint(op, a, b)
+		}
+	case float64:
+		if b, ok := right.(float64); ok {
+			return foldFloat(op, a, b)
+		}
+	case *big.Int:
+		if b, ok := right.(*big.Int); ok {
+			return foldBigInt(op, a, b)
+		}
+	case string:
+		if b, ok := right.(string); ok {
+			switch op {
+			case "==":
+				return a == b
+			case "!=":
+				return a != b
+			}
+		}
+	case bool:
+		if b, ok := right.(bool); ok {
+			switch op {
+			case "==":
+				return a == b
+			case "!=":
+				return a != b
+			case "&&":
+				return a && b
+			case "||":
+				return a || b
+			}
+		}
+	}
+	return nil
+}
+
+// foldInt does not fold overflowing operations, they are checked by the VM in overflow checks mode
+func foldInt(op string, a, b int) interface{} {
+	switch op {
+	case "+":
+		if sum := a + b; (a >= 0) == (b >= 0) && (sum >= 0) != (a >= 0) {
+			return nil
+		}
+		return a + b
+	case "-":
+		if diff := a - b; (a >= 0) != (b >= 0) && (diff >= 0) != (a >= 0) {
+			return nil
+		}
+		return a - b
+	case "*":
+		product := a * b
+		if a != 0 && (product/a != b || (a == -1 && b == math.MinInt)) {
+			return nil
+		}
+		return product
+	case "/", "%":
+		if b == 0 || (a == math.MinInt && b == -1) {
+			return nil
+		}
+		if op == "/" {
+			return a / b
+		}
+		return a % b
+	}
+	return compare(op, a, b)
+}
+
+func foldUint(op string, a, b uint64) interface{} {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/", "%":
+		if b == 0 {
+			return nil
+		}
+		if op == "/" {
+			return a / b
+		}
+		return a % b
+	}
+	return compare(op, a, b)
+}
+
+func foldFloat(op string, a, b float64) interface{} {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		if b == 0 {
+			return nil
+		}
+		return a / b
+	}
+	return compare(op, a, b)
+}
+
+func foldBigInt(op string, a, b *big.Int) interface{} {
+	switch op {
+	case "+":
+		return new(big.Int).Add(a, b)
+	case "-":
+		return new(big.Int).Sub(a, b)
+	case "*":
+		return new(big.Int).Mul(a, b)
+	case "/", "%":
+		if b.Sign() == 0 {
+			return nil
+		}
+		if op == "/" {
+			return new(big.Int).Quo(a, b)
+		}
+		return new(big.Int).Rem(a, b)
+	}
+	return compare(op, a.Cmp(b), 0)
+}
+
+func compare[T int | uint64 | float64](op string, a, b T) interface{} {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return nil
+}
+
+// foldConversion mirrors numeric conversions of the VM
+func foldConversion(target string, operand interface{}) interface{} {
+	switch v := operand.(type) {
+	case int:
+		switch target {
+		case checker.TypeInt:
+			return v
+		case checker.TypeUint:
+			return uint64(v)
+		case checker.TypeFloat:
+			return float64(v)
+		case checker.TypeBigInt:
+			return big.NewInt(int64(v))
+		}
+	case uint64:
+		switch target {
+		case checker.TypeInt:
+			return int(v)
+		case checker.TypeUint:
+			return v
+		case checker.TypeFloat:
+			return float64(v)
+		case checker.TypeBigInt:
+			return new(big.Int).SetUint64(v)
+		}
+	case float64:
+		// NaN, infinities and floats out of the range of an integer type are not folded, the VM raises the error
+		switch {
+		case target == checker.TypeInt && v >= math.MinInt64 && v < -math.MinInt64:
+			return int(v)
+		case target == checker.TypeUint && v > -1 && v < math.MaxUint64+1:
+			return uint64(v)
+		case target == checker.TypeFloat:
+			return v
+		case target == checker.TypeBigInt && !math.IsInf(v, 0) && !math.IsNaN(v):
+			n, _ := big.NewFloat(v).Int(nil)
+			return n
+		}
+	case *big.Int:
+		switch target {
+		case checker.TypeInt:
+			return int(v.Int64())
+		case checker.TypeUint:
+			return v.Uint64()
+		case checker.TypeFloat:
+			f, _ := new(big.Float).SetInt(v).Float64()
+			return f
+		case checker.TypeBigInt:
+			return v
+		}
+	}
+	return nil
+}
@@ -5,77 +5,193 @@ import (
 	"twin-peaks-programming-language/internal/parser"
 )
 
+// declareFunctions collects signatures of all top-level functions before any body is compiled,
+// so functions may be called before their declaration (including mutual recursion)
+func (c *Compiler) declareFunctions(program *parser.ASTNode) error {
+	for _, node := range program.Children {
+		if node.Type != parser.NodeFuncDecl {
+			continue
+		}
+		funcName := node.Value.(string)
+		if _, exists := c.funcTable[funcName]; exists {
+			return fmt.Errorf("function %s is already declared", funcName)
+		}
+		paramCount := len(node.Children[0].Children)
+		c.funcTable[funcName] = &FunctionInfo{
+			Name:        funcName,
+			Address:     -1, // Not yet compiled
+			ParamCount:  paramCount,
+			LocalCount:  paramCount,
+			ReturnType:  node.Children[1].Value.(string),
+			ReturnCount: returnCount(node.Children[1]),
+		}
+		c.labels[funcLabel(funcName)] = -1
+	}
+	return nil
+}
+
+// returnCount is the number of values returned by a function with the given return type node
+func returnCount(returnTypeNode *parser.ASTNode) int {
+	if returnTypeNode.Value == "void" {
+		return 0
+	}
+	if len(returnTypeNode.Children) > 0 && returnTypeNode.Type == parser.NodeVarType {
+		return len(returnTypeNode.Children) // (type, type, ...)
+	}
+	return 1
+}
+
+// funcLabel is the label of the function's first instruction, calls are patched through it
+func funcLabel(funcName string) string {
+	return "fn_" + funcName
+}
+
 func (c *Compiler) compileFuncDecl(node *parser.ASTNode) error {
 	funcName := node.Value.(string)
 
-	funcStart := len(c.bytecode.Instructions)
+	info, declared := c.funcTable[funcName]
+	if !declared || info.Address != -1 {
+		return fmt.Errorf("function %s must be declared at top level", funcName)
+	}
+
+	info.Address = len(c.bytecode.Instructions)
+	c.placeLabel(funcLabel(funcName))
+
+	_, err := c.compileFunction(info, node, nil)
+	return err
+}
+
+// compileNestedFuncDecl compiles a function declared inside a block as a local variable holding a closure
+func (c *Compiler) compileNestedFuncDecl(node *parser.ASTNode) error {
+	funcName := node.Value.(string)
+
+	localIndex := c.allocateLocal(funcName)
+	if c.currentScope.captured[funcName] {
+		c.emit(OpMakeCell, localIndex) // cell must exist before the closure captures it (recursion)
+	}
+
+	if err := c.compileFuncLiteral(node); err != nil {
+		return err
+	}
+
+	return c.emitStoreVariable(funcName)
+}
+
+// compileFuncLiteral emits the function body in place (jumped over) and pushes a closure capturing
+// the variables it uses from enclosing functions
+func (c *Compiler) compileFuncLiteral(node *parser.ASTNode) error {
+	funcName := "anonymous"
+	if name, ok := node.Value.(string); ok {
+		funcName = name
+	}
 
+	skipLabel := c.newLabel("fn_literal_end")
+	c.emitJump(OpJmp, skipLabel)
+
+	paramCount := len(node.Children[0].Children)
+	info := &FunctionInfo{
+		Name:        funcName,
+		Address:     len(c.bytecode.Instructions),
+		ParamCount:  paramCount,
+		LocalCount:  paramCount,
+		ReturnType:  node.Children[1].Value.(string),
+		ReturnCount: returnCount(node.Children[1]),
+	}
+	c.bytecode.FuncAddresses[info.Address] = info
+
+	upvalues, err := c.compileFunction(info, node, c.currentScope)
+	if err != nil {
+		return err
+	}
+
+	c.placeLabel(skipLabel)
+
+	operands := []int{info.Address}
+	for _, uv := range upvalues {
+		isLocal := 0
+		if uv.isLocal {
+			isLocal = 1
+		}
+		operands = append(operands, isLocal, uv.index)
+	}
+	c.emit(OpClosure, operands...)
+
+	return nil
+}
+
+// compileFunction emits prologue and body of the function at the current address.
+// enclosing is nil for top-level functions, they cannot capture variables
+func (c *Compiler) compileFunction(info *FunctionInfo, node *parser.ASTNode, enclosing *Scope) ([]upvalue, error) {
 	prevScope := c.currentScope
 	prevFunc := c.currentFunc
 	prevLabels := c.labels
 	prevLabelCounter := c.labelCounter
 
-	c.currentScope = &Scope{
-		variables: make(map[string]int),
-	}
-
 	paramsNode := node.Children[0]
-	paramCount := len(paramsNode.Children)
+	bodyNode := node.Children[2]
+
+	c.currentScope = newScope(enclosing, bodyNode)
 
 	// Parameters as local variables
 	for i, param := range paramsNode.Children {
 		if param.Type != parser.NodeVarDecl || len(param.Children) < 1 {
-			return fmt.Errorf("invalid parameter declaration")
+			return nil, fmt.Errorf("invalid parameter declaration")
 		}
 
 		paramName := param.Children[0].Value.(string)
 		c.currentScope.variables[paramName] = i
 	}
-	for i := 0; i < paramCount; i++ {
+	for i := 0; i < info.ParamCount; i++ {
 		c.emit(OpStore, i)
 	}
+	for i, param := range paramsNode.Children {
+		if c.currentScope.captured[param.Children[0].Value.(string)] {
+			c.emit(OpMakeCell, i)
+		}
+	}
 
 	c.currentFunc = &FuncContext{
-		Name:       funcName,
-		Address:    funcStart,
-		ParamCount: paramCount,
-		HasReturn:  false,
+		Name:        info.Name,
+		Address:     info.Address,
+		ParamCount:  info.ParamCount,
+		HasReturn:   false,
+		ReturnCount: info.ReturnCount,
 	}
 
-	returnTypeNode := node.Children[1]
-	bodyNode := node.Children[2]
-
-	c.funcTable[funcName] = &FunctionInfo{
-		Name:       funcName,
-		Address:    funcStart,
-		ParamCount: paramCount,
-		LocalCount: len(c.currentScope.variables),
-		ReturnType: returnTypeNode.Value.(string),
+	// Nested functions share label namespace with the enclosing one, their labels may interleave
+	if enclosing == nil {
+		c.labels = make(map[string]int)
+		c.labelCounter = 0
 	}
-
-	c.labels = make(map[string]int)
-	c.labelCounter = 0
 	if err := c.compileNode(bodyNode); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Add missing return if needed
 	if !c.currentFunc.HasReturn {
-		if returnTypeNode.Value == "void" {
+		switch info.ReturnCount {
+		case 0:
 			c.emit(OpReturnVoid)
-		} else {
+		case 1:
 			c.emit(OpConst, c.addConstant(0))
 			c.emit(OpReturn)
+		default:
+			for i := 0; i < info.ReturnCount; i++ {
+				c.emit(OpConst, c.addConstant(0))
+			}
+			c.emit(OpReturn, info.ReturnCount)
 		}
 	}
 
+	upvalues := c.currentScope.upvalues
+	info.UpvalueCount = len(upvalues)
+
 	c.currentScope = prevScope
 	c.currentFunc = prevFunc
-	c.labels = prevLabels
-	c.labelCounter = prevLabelCounter
-
-	// Function are stored before the main program
-	c.bytecode.ProgramStart = len(c.bytecode.Instructions)
+	if enclosing == nil {
+		c.labels = prevLabels
+		c.labelCounter = prevLabelCounter
+	}
 
-	return nil
+	return upvalues, nil
 }
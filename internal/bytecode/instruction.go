@@ -8,40 +8,84 @@ type Instruction struct {
 	Line     int
 }
 
-func (i Instruction) String() string {
-	opcodeNames := map[byte]string{
-		OpConst:      "CONST",
-		OpLoad:       "LOAD",
-		OpStore:      "STORE",
-		OpPop:        "POP",
-		OpAdd:        "ADD",
-		OpSub:        "SUB",
-		OpMul:        "MUL",
-		OpDiv:        "DIV",
-		OpMod:        "MOD",
-		OpNeg:        "NEG",
-		OpEq:         "EQ",
-		OpNeq:        "NEQ",
-		OpLt:         "LT",
-		OpLe:         "LE",
-		OpGt:         "GT",
-		OpGe:         "GE",
-		OpAnd:        "AND",
-		OpOr:         "OR",
-		OpNot:        "NOT",
-		OpJmp:        "JMP",
-		OpJmpIfFalse: "JMP_IF_FALSE",
-		OpCall:       "CALL",
-		OpReturn:     "RETURN",
-		OpPrint:      "PRINT",
-		OpSqrt:       "SQRT",
-		OpHalt:       "HALT",
-		OpReturnVoid: "RETURN_VOID",
-		OpArrayAlloc: "ARRAY_ALLOC",
-		OpArrayLoad:  "ARRAY_LOAD",
-		OpArrayStore: "ARRAY_STORE",
-	}
+var opcodeNames = map[byte]string{
+	OpConst:      "CONST",
+	OpLoad:       "LOAD",
+	OpStore:      "STORE",
+	OpPop:        "POP",
+	OpAdd:        "ADD",
+	OpSub:        "SUB",
+	OpMul:        "MUL",
+	OpDiv:        "DIV",
+	OpMod:        "MOD",
+	OpNeg:        "NEG",
+	OpEq:         "EQ",
+	OpNeq:        "NEQ",
+	OpLt:         "LT",
+	OpLe:         "LE",
+	OpGt:         "GT",
+	OpGe:         "GE",
+	OpAnd:        "AND",
+	OpOr:         "OR",
+	OpNot:        "NOT",
+	OpJmp:        "JMP",
+	OpJmpIfFalse: "JMP_IF_FALSE",
+	OpCall:       "CALL",
+	OpReturn:     "RETURN",
+	OpPrint:      "PRINT",
+	OpSqrt:       "SQRT",
+	OpHalt:       "HALT",
+	OpReturnVoid: "RETURN_VOID",
+	OpArrayAlloc: "ARRAY_ALLOC",
+	OpArrayLoad:  "ARRAY_LOAD",
+	OpArrayStore: "ARRAY_STORE",
+
+	OpClosure:            "CLOSURE",
+	OpCallIndirect:       "CALL_INDIRECT",
+	OpMakeCell:           "MAKE_CELL",
+	OpLoadCell:           "LOAD_CELL",
+	OpStoreCell:          "STORE_CELL",
+	OpGetUpvalue:         "GET_UPVALUE",
+	OpSetUpvalue:         "SET_UPVALUE",
+	OpArrayLoadIndirect:  "ARRAY_LOAD_INDIRECT",
+	OpArrayStoreIndirect: "ARRAY_STORE_INDIRECT",
+
+	OpTry:    "TRY",
+	OpEndTry: "END_TRY",
+	OpThrow:  "THROW",
+
+	OpConvert: "CONVERT",
+
+	OpStoreKeep: "STORE_KEEP",
+	OpTailCall:  "TAIL_CALL",
+
+	OpIncLocal:     "INC_LOCAL",
+	OpLoadLoad:     "LOAD_LOAD",
+	OpLtJmpIfFalse: "LT_JMP_IF_FALSE",
+	OpAddInt:       "ADD_INT",
 
+	OpIntAdd:   "INT_ADD",
+	OpIntSub:   "INT_SUB",
+	OpIntMul:   "INT_MUL",
+	OpIntEq:    "INT_EQ",
+	OpIntNeq:   "INT_NEQ",
+	OpIntLt:    "INT_LT",
+	OpIntLe:    "INT_LE",
+	OpIntGt:    "INT_GT",
+	OpIntGe:    "INT_GE",
+	OpFloatAdd: "FLOAT_ADD",
+	OpFloatSub: "FLOAT_SUB",
+	OpFloatMul: "FLOAT_MUL",
+	OpFloatDiv: "FLOAT_DIV",
+	OpFloatEq:  "FLOAT_EQ",
+	OpFloatNeq: "FLOAT_NEQ",
+	OpFloatLt:  "FLOAT_LT",
+	OpFloatLe:  "FLOAT_LE",
+	OpFloatGt:  "FLOAT_GT",
+	OpFloatGe:  "FLOAT_GE",
+}
+
+func (i Instruction) String() string {
 	name := opcodeNames[i.Opcode]
 	if name == "" {
 		name = fmt.Sprintf("UNKNOWN(%d)", i.Opcode)
@@ -58,12 +102,42 @@ func (i Instruction) IsReturn() bool {
 }
 
 func (i Instruction) IsJump() bool {
-	return i.Opcode == OpJmp || i.Opcode == OpJmpIfFalse
+	return i.Opcode == OpJmp || i.IsConditionalJump()
+}
+
+// IsConditionalJump reports whether the instruction either jumps or continues to the next one
+func (i Instruction) IsConditionalJump() bool {
+	return i.Opcode == OpJmpIfFalse || i.Opcode == OpLtJmpIfFalse
+}
+
+// IsTerminator reports whether execution never continues to the next instruction
+func (i Instruction) IsTerminator() bool {
+	switch i.Opcode {
+	case OpJmp, OpReturn, OpReturnVoid, OpHalt, OpThrow, OpTailCall:
+		return true
+	default:
+		return false
+	}
+}
+
+// HasAddressOperand reports whether the first operand is an instruction address
+func (i Instruction) HasAddressOperand() bool {
+	switch i.Opcode {
+	case OpJmp, OpJmpIfFalse, OpLtJmpIfFalse, OpCall, OpTailCall, OpClosure, OpTry:
+		return true
+	default:
+		return false
+	}
 }
 
 func (i Instruction) HasSideEffects() bool {
 	switch i.Opcode {
-	case OpPrint, OpCall, OpArrayStore, OpArrayLoad, OpHalt:
+	case OpPrint, OpCall, OpTailCall, OpArrayStore, OpArrayLoad, OpHalt:
+		return true
+	case OpClosure, OpCallIndirect, OpMakeCell, OpLoadCell, OpStoreCell, OpGetUpvalue, OpSetUpvalue,
+		OpArrayLoadIndirect, OpArrayStoreIndirect:
+		return true
+	case OpTry, OpEndTry, OpThrow:
 		return true
 	default:
 		return false
@@ -84,13 +158,17 @@ type FuncContext struct {
 	ParamCount  int
 	HasReturn   bool
 	ReturnLabel int
+	ReturnCount int
+	TryDepth    int // number of enclosing try blocks, tail calls are not emitted inside them
 }
 
 // FunctionInfo runtime information about a function
 type FunctionInfo struct {
-	Name       string
-	Address    int
-	ParamCount int
-	LocalCount int
-	ReturnType string
+	Name         string
+	Address      int
+	ParamCount   int
+	LocalCount   int
+	ReturnType   string
+	ReturnCount  int // number of returned values, 0 for void functions
+	UpvalueCount int // number of variables captured from enclosing functions
 }
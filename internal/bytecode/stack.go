@@ -0,0 +1,89 @@
+package bytecode
+
+import "fmt"
+
+// StackEffect returns how many values the instruction pops from the operand stack and how many it pushes.
+// A call pops the arguments and pushes the values the callee leaves on the stack, returned gives their count
+// for the function at an entry address. It is shared by all tiers, a new opcode is described here once
+func (bc *Bytecode) StackEffect(instr Instruction, returned func(entry int) (int, error)) (pops, pushes int, err error) {
+	instr = instr.Generic()
+	switch instr.Opcode {
+	case OpConst, OpLoad, OpLoadCell, OpGetUpvalue, OpClosure:
+		return 0, 1, nil
+	case OpLoadLoad:
+		return 0, 2, nil
+	case OpStore, OpPop, OpJmpIfFalse, OpPrint, OpStoreCell, OpSetUpvalue, OpThrow:
+		return 1, 0, nil
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpEq, OpNeq, OpLt, OpLe, OpGt, OpGe, OpAnd, OpOr, OpArrayLoadIndirect:
+		return 2, 1, nil
+	case OpLtJmpIfFalse, OpArrayStore:
+		return 2, 0, nil
+	case OpArrayStoreIndirect:
+		return 3, 0, nil
+	case OpNeg, OpNot, OpSqrt, OpConvert, OpStoreKeep, OpAddInt, OpArrayAlloc, OpArrayLoad:
+		return 1, 1, nil
+	case OpJmp, OpIncLocal, OpMakeCell, OpTry, OpEndTry, OpReturnVoid, OpHalt:
+		return 0, 0, nil
+	case OpReturn:
+		return instr.ReturnedValues(), 0, nil
+	case OpCall, OpTailCall:
+		callee, ok := bc.FuncAddresses[instr.Operands[0]]
+		if !ok {
+			return 0, 0, fmt.Errorf("call of unknown function at %d", instr.Operands[0])
+		}
+		if instr.Opcode == OpTailCall {
+			return callee.ParamCount, 0, nil
+		}
+		count, err := returned(callee.Address)
+		return callee.ParamCount, count, err
+	case OpCallIndirect:
+		return 0, 0, fmt.Errorf("stack effect of %s depends on the called value", instr.String())
+	}
+	return 0, 0, fmt.Errorf("unknown instruction %s", instr.String())
+}
+
+// ReturnedValues returns how many values RETURN takes from the stack
+func (i Instruction) ReturnedValues() int {
+	if len(i.Operands) > 0 {
+		return i.Operands[0]
+	}
+	return 1
+}
+
+// ReturnCount finds how many values the function at the entry address leaves on the stack. It may differ from
+// the declared count: a function without a return type may still return a value
+func (bc *Bytecode) ReturnCount(entry int) (int, error) {
+	count := -1
+	visited := make(map[int]bool)
+	work := []int{entry}
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		if addr < 0 || addr >= len(bc.Instructions) || visited[addr] {
+			continue
+		}
+		visited[addr] = true
+
+		instr := bc.Instructions[addr].Generic()
+		returned := -1
+		switch {
+		case instr.Opcode == OpReturn:
+			returned = instr.ReturnedValues()
+		case instr.Opcode == OpReturnVoid:
+			returned = 0
+		case instr.Opcode == OpJmp:
+			work = append(work, instr.Operands[0])
+		case instr.IsConditionalJump() || instr.Opcode == OpTry:
+			work = append(work, instr.Operands[0], addr+1)
+		case !instr.IsTerminator():
+			work = append(work, addr+1)
+		}
+		if returned >= 0 {
+			if count >= 0 && count != returned {
+				return 0, fmt.Errorf("function %s returns %d and %d values", bc.FuncAddresses[entry].Name, count, returned)
+			}
+			count = returned
+		}
+	}
+	return max(count, 0), nil
+}
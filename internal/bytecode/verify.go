@@ -0,0 +1,99 @@
+package bytecode
+
+import "fmt"
+
+// variableOperands marks opcodes whose operand count is checked separately
+const variableOperands = -1
+
+// operandCounts is the number of operands of every opcode
+var operandCounts = map[byte]int{
+	OpConst: 1, OpLoad: 1, OpStore: 1, OpPop: 0,
+	OpAdd: 0, OpSub: 0, OpMul: 0, OpDiv: 0, OpMod: 0, OpNeg: 0,
+	OpEq: 0, OpNeq: 0, OpLt: 0, OpLe: 0, OpGt: 0, OpGe: 0, OpAnd: 0, OpOr: 0, OpNot: 0,
+	OpJmp: 1, OpJmpIfFalse: 1, OpCall: 1, OpReturn: variableOperands, OpReturnVoid: 0,
+	OpPrint: 0, OpSqrt: 0, OpHalt: 0,
+	OpArrayAlloc: 1, OpArrayLoad: 1, OpArrayStore: 1,
+	OpClosure: variableOperands, OpCallIndirect: 1, OpMakeCell: 1, OpLoadCell: 1, OpStoreCell: 1,
+	OpGetUpvalue: 1, OpSetUpvalue: 1, OpArrayLoadIndirect: 0, OpArrayStoreIndirect: 0,
+	OpTry: 1, OpEndTry: 0, OpThrow: 0,
+	OpConvert: 1, OpStoreKeep: 1, OpTailCall: 1,
+	OpIncLocal: 2, OpLoadLoad: 2, OpLtJmpIfFalse: 1, OpAddInt: 1,
+	OpIntAdd: 0, OpIntSub: 0, OpIntMul: 0, OpIntEq: 0, OpIntNeq: 0, OpIntLt: 0, OpIntLe: 0, OpIntGt: 0, OpIntGe: 0,
+	OpFloatAdd: 0, OpFloatSub: 0, OpFloatMul: 0, OpFloatDiv: 0,
+	OpFloatEq: 0, OpFloatNeq: 0, OpFloatLt: 0, OpFloatLe: 0, OpFloatGt: 0, OpFloatGe: 0,
+}
+
+// Verify checks that every instruction is well formed: the opcode is known, operands are in their ranges,
+// jumps stay inside the program, calls refer to functions and constant operands to existing constants.
+// The stack balance is not checked
+func (bc *Bytecode) Verify() error {
+	if bc.ProgramStart < 0 || bc.ProgramStart > len(bc.Instructions) {
+		return fmt.Errorf("program start %d is out of the program", bc.ProgramStart)
+	}
+	for addr, info := range bc.FuncAddresses {
+		if addr < 0 || addr >= len(bc.Instructions) || info.Address != addr {
+			return fmt.Errorf("function %s has invalid address %d", info.Name, addr)
+		}
+	}
+	for addr, instr := range bc.Instructions {
+		if err := bc.verifyInstruction(instr); err != nil {
+			return fmt.Errorf("invalid instruction %d: %s: %w", addr, instr.String(), err)
+		}
+	}
+	return nil
+}
+
+func (bc *Bytecode) verifyInstruction(instr Instruction) error {
+	count, known := operandCounts[instr.Opcode]
+	if !known {
+		return fmt.Errorf("unknown opcode %d", instr.Opcode)
+	}
+	switch {
+	case instr.Opcode == OpReturn:
+		if len(instr.Operands) > 1 || (len(instr.Operands) == 1 && instr.Operands[0] < 2) {
+			return fmt.Errorf("RETURN takes an optional count of at least 2 values")
+		}
+	case instr.Opcode == OpClosure:
+		if len(instr.Operands)%2 != 1 {
+			return fmt.Errorf("CLOSURE takes an address and isLocal/index pairs")
+		}
+	case len(instr.Operands) != count:
+		return fmt.Errorf("expected %d operands, got %d", count, len(instr.Operands))
+	}
+	for _, operand := range instr.Operands {
+		if operand < 0 {
+			return fmt.Errorf("negative operand %d", operand)
+		}
+	}
+
+	switch instr.Opcode {
+	case OpCall, OpTailCall, OpClosure:
+		if _, ok := bc.FuncAddresses[instr.Operands[0]]; !ok {
+			return fmt.Errorf("no function at address %d", instr.Operands[0])
+		}
+	case OpJmp, OpJmpIfFalse, OpLtJmpIfFalse, OpTry:
+		if instr.Operands[0] >= len(bc.Instructions) {
+			return fmt.Errorf("jump target %d is out of the program", instr.Operands[0])
+		}
+	case OpConst:
+		if instr.Operands[0] >= len(bc.Constants) {
+			return fmt.Errorf("constant index %d is out of bounds", instr.Operands[0])
+		}
+	case OpIncLocal:
+		if instr.Operands[1] >= len(bc.Constants) {
+			return fmt.Errorf("constant index %d is out of bounds", instr.Operands[1])
+		}
+	case OpAddInt:
+		if instr.Operands[0] >= len(bc.Constants) {
+			return fmt.Errorf("constant index %d is out of bounds", instr.Operands[0])
+		}
+		if _, ok := bc.Constants[instr.Operands[0]].(int); !ok {
+			return fmt.Errorf("ADD_INT constant %v is not an int", bc.Constants[instr.Operands[0]])
+		}
+	case OpConvert:
+		if instr.Operands[0] > ConvertBigInt {
+			return fmt.Errorf("unknown conversion %d", instr.Operands[0])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,695 @@
+package checker
+
+import (
+	"fmt"
+	"twin-peaks-programming-language/internal/parser"
+)
+
+// Checker infers static types of expressions and reports implicit mixing of incompatible numeric types.
+// Every expression node is annotated with its type (ASTNode.DataType), untyped constants get the type
+// of their context, so the compiler can emit constants of the right kind.
+//
+// Promotion rules: int operand mixed with float is converted to float, int value may be assigned
+// to float. Everything else (float to int, uint or bigint with other numbers) needs explicit conversion
+type Checker struct {
+	funcs   map[string]*signature // top-level functions
+	scope   *scope
+	results []string // result types of the function being checked
+	inFunc  bool
+}
+
+type signature struct {
+	params  []string
+	results []string
+}
+
+// scope holds variable types of a function, nested functions see variables of enclosing ones
+type scope struct {
+	variables map[string]string
+	constants map[string]bool
+	enclosing *scope
+}
+
+func newScope(enclosing *scope) *scope {
+	return &scope{variables: make(map[string]string), constants: make(map[string]bool), enclosing: enclosing}
+}
+
+// Check annotates the program with static types
+func Check(program *parser.ASTNode) error {
+	// Top-level constants are visible in top-level functions, other variables of the program are not
+	globals := newScope(nil)
+	c := &Checker{
+		funcs: make(map[string]*signature),
+		scope: globals,
+	}
+	for _, child := range program.Children {
+		if child.Type != parser.NodeConstDecl {
+			continue
+		}
+		if err := c.checkConstDecl(child); err != nil {
+			return err
+		}
+	}
+	c.scope = newScope(globals)
+
+	for _, child := range program.Children {
+		if child.Type != parser.NodeFuncDecl {
+			continue
+		}
+		sig := &signature{results: resultTypes(child.Children[1])}
+		for _, param := range child.Children[0].Children {
+			sig.params = append(sig.params, typeName(param.Children[1]))
+		}
+		c.funcs[child.Value.(string)] = sig
+	}
+
+	for _, child := range program.Children {
+		var err error
+		switch child.Type {
+		case parser.NodeFuncDecl:
+			err = c.checkFunction(child, globals)
+		case parser.NodeConstDecl:
+			// already checked
+		default:
+			err = c.checkStatement(child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Checker) declare(name string, t string) {
+	c.scope.variables[name] = t
+	delete(c.scope.constants, name)
+}
+
+// lookup returns type of a variable, found is false for unknown names
+func (c *Checker) lookup(name string) (string, bool) {
+	for s := c.scope; s != nil; s = s.enclosing {
+		if t, ok := s.variables[name]; ok {
+			return t, true
+		}
+	}
+	return TypeUnknown, false
+}
+
+// isConstant reports whether the name refers to a constant (not shadowed by a variable)
+func (c *Checker) isConstant(name string) bool {
+	for s := c.scope; s != nil; s = s.enclosing {
+		if _, ok := s.variables[name]; ok {
+			return s.constants[name]
+		}
+	}
+	return false
+}
+
+func (c *Checker) checkConstDecl(node *parser.ASTNode) error {
+	name := node.Children[0].Value.(string)
+	t := typeName(node.Children[1])
+	if !isNumeric(t) && t != TypeString && t != TypeBool {
+		return fmt.Errorf("invalid type %s of constant %s at line %d", node.Children[1].Value, name, lineOf(node))
+	}
+	if err := c.checkAssignable(t, node.Children[2]); err != nil {
+		return err
+	}
+	if !c.isConstantExpr(node.Children[2]) {
+		return fmt.Errorf("value of constant %s is not a constant expression at line %d", name, lineOf(node))
+	}
+	c.declare(name, t)
+	c.scope.constants[name] = true
+	return nil
+}
+
+// isConstantExpr reports whether the expression can be evaluated at compile time
+func (c *Checker) isConstantExpr(node *parser.ASTNode) bool {
+	switch node.Type {
+	case parser.NodeLiteral:
+		return true
+	case parser.NodeIdentifier:
+		return c.isConstant(node.Value.(string))
+	case parser.NodeUnaryOp, parser.NodeTernary:
+	case parser.NodeBinaryOp:
+		if node.Value == "=" {
+			return false
+		}
+	case parser.NodeCall:
+		switch node.Value {
+		case TypeInt, TypeUint, TypeFloat, TypeBigInt:
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+	for _, child := range node.Children {
+		if !c.isConstantExpr(child) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFunction checks the body of a function; enclosing is nil for top-level functions
+func (c *Checker) checkFunction(node *parser.ASTNode, enclosing *scope) error {
+	prevScope, prevResults, prevInFunc := c.scope, c.results, c.inFunc
+
+	c.scope = newScope(enclosing)
+	for _, param := range node.Children[0].Children {
+		c.declare(param.Children[0].Value.(string), typeName(param.Children[1]))
+	}
+	c.results = resultTypes(node.Children[1])
+	c.inFunc = true
+
+	err := c.checkStatement(node.Children[2])
+
+	c.scope, c.results, c.inFunc = prevScope, prevResults, prevInFunc
+	return err
+}
+
+func (c *Checker) checkStatement(node *parser.ASTNode) error {
+	switch node.Type {
+	case parser.NodeBlock:
+		for _, child := range node.Children {
+			if err := c.checkStatement(child); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case parser.NodeVarDecl:
+		t := typeName(node.Children[1])
+		c.declare(node.Children[0].Value.(string), t)
+		if len(node.Children) > 2 {
+			return c.checkAssignable(t, node.Children[2])
+		}
+		return nil
+
+	case parser.NodeArrayDecl:
+		c.declare(node.Children[0].Value.(string), typeName(node.Children[2]))
+		return c.checkAssignable(TypeInt, node.Children[1])
+
+	case parser.NodeConstDecl:
+		return c.checkConstDecl(node)
+
+	case parser.NodeFuncDecl:
+		c.declare(node.Value.(string), TypeFunc)
+		return c.checkFunction(node, c.scope)
+
+	case parser.NodeIf:
+		if err := c.checkValue(node.Children[0]); err != nil {
+			return err
+		}
+		for _, child := range node.Children[1:] {
+			if err := c.checkStatement(child); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case parser.NodeFor:
+		for _, child := range node.Children {
+			if err := c.checkStatement(child); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case parser.NodeReturn:
+		for i, child := range node.Children {
+			if c.inFunc && i < len(c.results) {
+				if err := c.checkAssignable(c.results[i], child); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := c.checkValue(child); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case parser.NodeTupleAssign:
+		return c.checkTupleAssign(node)
+
+	case parser.NodeTry:
+		if err := c.checkStatement(node.Children[0]); err != nil {
+			return err
+		}
+		c.declare(node.Children[1].Value.(string), TypeUnknown)
+		return c.checkStatement(node.Children[2])
+
+	case parser.NodeIdentifier:
+		return nil // break, continue or a lone variable
+
+	default:
+		return c.checkValue(node)
+	}
+}
+
+func (c *Checker) checkTupleAssign(node *parser.ASTNode) error {
+	targets := node.Children[:len(node.Children)-1]
+	value := node.Children[len(node.Children)-1]
+
+	for _, target := range targets {
+		if target.Type == parser.NodeIdentifier && c.isConstant(target.Value.(string)) {
+			return fmt.Errorf("cannot assign to constant %s at line %d", target.Value, lineOf(target))
+		}
+	}
+
+	if _, err := c.typeOf(value); err != nil {
+		return err
+	}
+	if value.Type != parser.NodeCall {
+		return nil
+	}
+	if _, isVariable := c.lookup(value.Value.(string)); isVariable {
+		return nil
+	}
+	sig, ok := c.funcs[value.Value.(string)]
+	if !ok {
+		return nil
+	}
+
+	for i, target := range targets {
+		if target.Type != parser.NodeIdentifier || i >= len(sig.results) {
+			continue
+		}
+		targetType, _ := c.lookup(target.Value.(string))
+		if targetType != sig.results[i] && (incompatible(targetType, sig.results[i]) || promotes(sig.results[i], targetType)) {
+			return fmt.Errorf("cannot assign %s value to %s variable %s at line %d",
+				sig.results[i], targetType, target.Value, lineOf(target))
+		}
+	}
+	return nil
+}
+
+// checkValue checks an expression used without a type context, untyped constants get default types
+func (c *Checker) checkValue(node *parser.ASTNode) error {
+	t, err := c.typeOf(node)
+	if err != nil {
+		return err
+	}
+	return c.annotate(node, defaultType(t))
+}
+
+// checkAssignable checks that the expression can be used as a value of the target type
+func (c *Checker) checkAssignable(target string, node *parser.ASTNode) error {
+	t, err := c.typeOf(node)
+	if err != nil {
+		return err
+	}
+	if isUntyped(t) {
+		if t == TypeUntypedFloat && isInteger(target) {
+			return fmt.Errorf("float constant used as %s at line %d", target, lineOf(node))
+		}
+		if isNumeric(target) {
+			return c.annotate(node, target)
+		}
+		return c.annotate(node, defaultType(t))
+	}
+	if promotes(t, target) {
+		promote(node, target)
+		return nil
+	}
+	if incompatible(target, t) || (t == TypeFloat && target == TypeInt) {
+		return fmt.Errorf("cannot use %s value as %s at line %d, use explicit conversion", t, target, lineOf(node))
+	}
+	return nil
+}
+
+// typeOf infers type of the expression and stores it in the node
+func (c *Checker) typeOf(node *parser.ASTNode) (string, error) {
+	t, err := c.inferType(node)
+	if err != nil {
+		return TypeUnknown, err
+	}
+	node.DataType = t
+	return t, nil
+}
+
+func (c *Checker) inferType(node *parser.ASTNode) (string, error) {
+	switch node.Type {
+	case parser.NodeLiteral:
+		return literalType(node), nil
+
+	case parser.NodeIdentifier:
+		name, _ := node.Value.(string)
+		if t, ok := c.lookup(name); ok {
+			return t, nil
+		}
+		if _, ok := c.funcs[name]; ok {
+			return TypeFunc, nil
+		}
+		return TypeUnknown, nil
+
+	case parser.NodeBinaryOp:
+		return c.inferBinaryOp(node)
+
+	case parser.NodeUnaryOp:
+		if node.Value == "!" {
+			return TypeBool, c.checkValue(node.Children[0])
+		}
+		return c.typeOf(node.Children[0])
+
+	case parser.NodeTernary:
+		return c.inferTernary(node)
+
+	case parser.NodeCall:
+		return c.inferCall(node)
+
+	case parser.NodeCallIndirect:
+		for _, child := range node.Children {
+			if err := c.checkValue(child); err != nil {
+				return TypeUnknown, err
+			}
+		}
+		return TypeUnknown, nil
+
+	case parser.NodeArrayAccess:
+		if err := c.checkAssignable(TypeInt, node.Children[1]); err != nil {
+			return TypeUnknown, err
+		}
+		t, _ := c.lookup(node.Children[0].Value.(string))
+		return t, nil
+
+	case parser.NodeFuncLiteral:
+		return TypeFunc, c.checkFunction(node, c.scope)
+
+	default:
+		for _, child := range node.Children {
+			if err := c.checkValue(child); err != nil {
+				return TypeUnknown, err
+			}
+		}
+		return TypeUnknown, nil
+	}
+}
+
+func (c *Checker) inferBinaryOp(node *parser.ASTNode) (string, error) {
+	left, right := node.Children[0], node.Children[1]
+
+	switch node.Value {
+	case "=":
+		if left.Type == parser.NodeIdentifier && c.isConstant(left.Value.(string)) {
+			return TypeUnknown, fmt.Errorf("cannot assign to constant %s at line %d", left.Value, lineOf(left))
+		}
+		target, err := c.typeOf(left)
+		if err != nil {
+			return TypeUnknown, err
+		}
+		return target, c.checkAssignable(target, right)
+
+	case "&&", "||":
+		if err := c.checkValue(left); err != nil {
+			return TypeUnknown, err
+		}
+		return TypeBool, c.checkValue(right)
+	}
+
+	leftType, err := c.typeOf(left)
+	if err != nil {
+		return TypeUnknown, err
+	}
+	rightType, err := c.typeOf(right)
+	if err != nil {
+		return TypeUnknown, err
+	}
+	t, err := c.unify(node, leftType, rightType)
+	if err != nil {
+		return TypeUnknown, err
+	}
+	promote(left, t)
+	promote(right, t)
+
+	switch node.Value {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if err := c.annotateOperands(node, defaultType(t)); err != nil {
+			return TypeUnknown, err
+		}
+		return TypeBool, nil
+	default:
+		if !isUntyped(t) {
+			if err := c.annotateOperands(node, t); err != nil {
+				return TypeUnknown, err
+			}
+		}
+		return t, nil
+	}
+}
+
+func (c *Checker) inferTernary(node *parser.ASTNode) (string, error) {
+	if err := c.checkValue(node.Children[0]); err != nil {
+		return TypeUnknown, err
+	}
+	thenType, err := c.typeOf(node.Children[1])
+	if err != nil {
+		return TypeUnknown, err
+	}
+	elseType, err := c.typeOf(node.Children[2])
+	if err != nil {
+		return TypeUnknown, err
+	}
+
+	t, err := c.unify(node, thenType, elseType)
+	if err != nil {
+		return TypeUnknown, err
+	}
+	promote(node.Children[1], t)
+	promote(node.Children[2], t)
+	if thenType != elseType && !isUntyped(thenType) && !isUntyped(elseType) &&
+		thenType != TypeUnknown && elseType != TypeUnknown && !promotes(thenType, t) && !promotes(elseType, t) {
+		return TypeUnknown, fmt.Errorf("mismatched branch types %s and %s in conditional expression at line %d",
+			thenType, elseType, lineOf(node))
+	}
+	if !isUntyped(t) {
+		if err := c.annotate(node.Children[1], t); err != nil {
+			return TypeUnknown, err
+		}
+		if err := c.annotate(node.Children[2], t); err != nil {
+			return TypeUnknown, err
+		}
+	}
+	return t, nil
+}
+
+func (c *Checker) inferCall(node *parser.ASTNode) (string, error) {
+	name := node.Value.(string)
+
+	switch name {
+	case "print":
+		for _, arg := range node.Children {
+			if err := c.checkValue(arg); err != nil {
+				return TypeUnknown, err
+			}
+		}
+		return TypeVoid, nil
+	case "sqrt":
+		for _, arg := range node.Children {
+			if err := c.checkValue(arg); err != nil {
+				return TypeUnknown, err
+			}
+		}
+		return TypeFloat, nil
+	case TypeInt, TypeUint, TypeFloat, TypeString, TypeBool, TypeBigInt:
+		return name, c.checkConversion(node, name)
+	}
+
+	if _, isVariable := c.lookup(name); isVariable {
+		for _, arg := range node.Children {
+			if err := c.checkValue(arg); err != nil {
+				return TypeUnknown, err
+			}
+		}
+		return TypeUnknown, nil
+	}
+
+	sig, ok := c.funcs[name]
+	if !ok {
+		for _, arg := range node.Children {
+			if err := c.checkValue(arg); err != nil {
+				return TypeUnknown, err
+			}
+		}
+		return TypeUnknown, nil // reported by the compiler
+	}
+
+	for i, arg := range node.Children {
+		var err error
+		if i < len(sig.params) {
+			err = c.checkAssignable(sig.params[i], arg)
+		} else {
+			err = c.checkValue(arg)
+		}
+		if err != nil {
+			return TypeUnknown, err
+		}
+	}
+
+	switch len(sig.results) {
+	case 0:
+		return TypeVoid, nil
+	case 1:
+		return sig.results[0], nil
+	default:
+		return TypeUnknown, nil // used only by tuple assignment
+	}
+}
+
+// checkConversion checks explicit conversion int(x), uint(x), float(x), string(x), bool(x), bigint(x)
+func (c *Checker) checkConversion(node *parser.ASTNode, target string) error {
+	if len(node.Children) != 1 {
+		return fmt.Errorf("conversion to %s expects 1 argument, got %d at line %d", target, len(node.Children), lineOf(node))
+	}
+	arg := node.Children[0]
+	t, err := c.typeOf(arg)
+	if err != nil {
+		return err
+	}
+	switch {
+	case t == TypeUntypedFloat && target == TypeBigInt:
+		return fmt.Errorf("float constant used as bigint at line %d", lineOf(node))
+	case t == TypeUntypedFloat:
+		return c.annotate(arg, TypeFloat)
+	case t == TypeUntypedInt && isNumeric(target):
+		return c.annotate(arg, target)
+	case isUntyped(t):
+		return c.annotate(arg, defaultType(t))
+	case t == TypeFunc || t == TypeVoid:
+		return fmt.Errorf("cannot convert %s value to %s at line %d", t, target, lineOf(node))
+	}
+	return nil
+}
+
+// unify returns the common type of operands, untyped constants take the type of the other operand
+func (c *Checker) unify(node *parser.ASTNode, left, right string) (string, error) {
+	switch {
+	case left == right:
+		return left, nil
+	case left == TypeUnknown || right == TypeUnknown:
+		return TypeUnknown, nil
+	case isUntyped(left) && isUntyped(right):
+		return TypeUntypedFloat, nil
+	case isUntyped(left):
+		return c.unifyUntyped(node, left, right)
+	case isUntyped(right):
+		return c.unifyUntyped(node, right, left)
+	case incompatible(left, right):
+		return TypeUnknown, fmt.Errorf("mismatched types %s and %s at line %d, use explicit conversion", left, right, lineOf(node))
+	case promotes(left, right):
+		return right, nil
+	default:
+		return left, nil
+	}
+}
+
+// unifyUntyped returns the type of an operation of a constant with a typed operand: the constant takes the type
+// of a numeric operand, except a float constant with an int operand, which is promoted to float
+func (c *Checker) unifyUntyped(node *parser.ASTNode, untyped, typed string) (string, error) {
+	if !isNumeric(typed) {
+		if node.Type == parser.NodeTernary {
+			return TypeUnknown, fmt.Errorf("mismatched branch types %s and %s in conditional expression at line %d",
+				untyped, typed, lineOf(node))
+		}
+		return TypeUnknown, fmt.Errorf("mismatched types %s and %s at line %d, use explicit conversion", untyped, typed, lineOf(node))
+	}
+	if untyped == TypeUntypedFloat && (typed == TypeUint || typed == TypeBigInt) {
+		return TypeUnknown, fmt.Errorf("float constant used as %s at line %d", typed, lineOf(node))
+	}
+	if untyped == TypeUntypedFloat && typed == TypeInt {
+		return TypeFloat, nil
+	}
+	return typed, nil
+}
+
+func (c *Checker) annotateOperands(node *parser.ASTNode, t string) error {
+	for _, child := range node.Children {
+		if err := c.annotate(child, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// annotate gives the type to an untyped constant expression and checks that literals fit it
+func (c *Checker) annotate(node *parser.ASTNode, t string) error {
+	if !isUntyped(node.DataType) || t == TypeUnknown || isUntyped(t) {
+		return nil
+	}
+	if !isNumeric(t) || (node.DataType == TypeUntypedFloat && t != TypeFloat) {
+		t = defaultType(node.DataType)
+	}
+	if node.DataType == TypeUntypedInt && t == TypeFloat && node.Type != parser.NodeLiteral {
+		// Integer constant arithmetic stays integer (7 / 2 is 3) like with int variables, the result is promoted
+		if err := c.annotate(node, TypeInt); err != nil {
+			return err
+		}
+		promote(node, TypeFloat)
+		return nil
+	}
+	node.DataType = t
+
+	switch node.Type {
+	case parser.NodeLiteral:
+		if !fitsType(node.Value.(string), t) {
+			return fmt.Errorf("constant %s overflows %s at line %d", node.Value, t, lineOf(node))
+		}
+	case parser.NodeUnaryOp:
+		operand := node.Children[0]
+		if t == TypeUint && operand.Type == parser.NodeLiteral {
+			return fmt.Errorf("constant -%s overflows uint at line %d", operand.Value, lineOf(node))
+		}
+	}
+
+	for _, child := range node.Children {
+		if err := c.annotate(child, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// incompatible reports implicit mixing of uint or bigint with other numeric types
+func incompatible(a, b string) bool {
+	if a == b || a == TypeUnknown || b == TypeUnknown || isUntyped(a) || isUntyped(b) {
+		return false
+	}
+	if a == TypeUint || a == TypeBigInt || b == TypeUint || b == TypeBigInt {
+		return isNumeric(a) && isNumeric(b)
+	}
+	return false
+}
+
+// promotes reports whether a value of type from is implicitly converted to type to
+func promotes(from, to string) bool {
+	return from == TypeInt && to == TypeFloat
+}
+
+// promote wraps an int expression into float conversion when the context is float
+func promote(node *parser.ASTNode, t string) {
+	if !promotes(node.DataType, t) {
+		return
+	}
+	operand := *node
+	*node = parser.ASTNode{
+		Type:     parser.NodeCall,
+		Value:    TypeFloat,
+		Children: []*parser.ASTNode{&operand},
+		Token:    operand.Token,
+		DataType: TypeFloat,
+	}
+}
+
+// lineOf returns source line of the node or of its first child that has one
+func lineOf(node *parser.ASTNode) int {
+	if node.Token.Line > 0 {
+		return node.Token.Line
+	}
+	for _, child := range node.Children {
+		if line := lineOf(child); line > 0 {
+			return line
+		}
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+package checker
+
+import (
+	"strconv"
+	"strings"
+	"twin-peaks-programming-language/internal/lexer"
+	"twin-peaks-programming-language/internal/parser"
+)
+
+// Static types are named as in the source code. Empty type means unknown (not checked)
+const (
+	TypeInt          = "int"
+	TypeUint         = "uint"
+	TypeFloat        = "float"
+	TypeString       = "string"
+	TypeBool         = "bool"
+	TypeBigInt       = "bigint" // arbitrary-precision integer
+	TypeFunc         = "fn"
+	TypeVoid         = "void"
+	TypeUntypedInt   = "untyped int"   // integer literal, gets the type of its context
+	TypeUntypedFloat = "untyped float" // float literal, gets the type of its context
+	TypeUnknown      = ""
+)
+
+func isUntyped(t string) bool {
+	return t == TypeUntypedInt || t == TypeUntypedFloat
+}
+
+func isNumeric(t string) bool {
+	return t == TypeInt || t == TypeUint || t == TypeFloat || t == TypeBigInt || isUntyped(t)
+}
+
+// isInteger reports whether untyped float constants cannot be used as the type
+func isInteger(t string) bool {
+	return t == TypeInt || t == TypeUint || t == TypeBigInt
+}
+
+// defaultType is the type of an untyped constant without context
+func defaultType(t string) string {
+	switch t {
+	case TypeUntypedInt:
+		return TypeInt
+	case TypeUntypedFloat:
+		return TypeFloat
+	default:
+		return t
+	}
+}
+
+// typeName returns the type declared by a type node, unknown for arrays and pointers given in the type itself
+func typeName(typeNode *parser.ASTNode) string {
+	if typeNode.Type != parser.NodeVarType {
+		return TypeUnknown
+	}
+	name, _ := typeNode.Value.(string)
+	return name
+}
+
+// resultTypes returns types of values returned by a function with the given return type node
+func resultTypes(returnTypeNode *parser.ASTNode) []string {
+	if returnTypeNode.Value == TypeVoid {
+		return nil
+	}
+	if returnTypeNode.Type == parser.NodeVarType && len(returnTypeNode.Children) > 0 {
+		var results []string
+		for _, child := range returnTypeNode.Children {
+			results = append(results, typeName(child))
+		}
+		return results
+	}
+	return []string{typeName(returnTypeNode)}
+}
+
+func literalType(node *parser.ASTNode) string {
+	switch node.Token.Type {
+	case lexer.ConstNum:
+		if strings.ContainsAny(node.Value.(string), ".eE") {
+			return TypeUntypedFloat
+		}
+		return TypeUntypedInt
+	case lexer.ConstText:
+		return TypeString
+	default:
+		return TypeBool
+	}
+}
+
+// fitsType reports whether the integer literal can be represented by the type
+func fitsType(literal string, t string) bool {
+	switch t {
+	case TypeInt:
+		_, err := strconv.ParseInt(literal, 10, 64)
+		return err == nil
+	case TypeUint:
+		_, err := strconv.ParseUint(literal, 10, 64)
+		return err == nil
+	default:
+		return true
+	}
+}
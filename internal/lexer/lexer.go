@@ -217,6 +217,12 @@ func (l *Lexer) NextToken() (Token, error) {
 	case ';':
 		tok.Type = Semicolon
 		tok.Text = string(l.ch)
+	case '?':
+		tok.Type = Question
+		tok.Text = string(l.ch)
+	case ':':
+		tok.Type = Colon
+		tok.Text = string(l.ch)
 	case '"':
 		tok.Type = ConstText
 		tok.Text = l.readString()
@@ -276,6 +282,7 @@ var keywords = map[string]TokenType{
 	"float":    Float,
 	"string":   String,
 	"bool":     Bool,
+	"bigint":   BigInt,
 	"fn":       Func,
 	"if":       If,
 	"else":     Else,
@@ -283,6 +290,10 @@ var keywords = map[string]TokenType{
 	"return":   Return,
 	"break":    Break,
 	"continue": Continue,
+	"try":      Try,
+	"catch":    Catch,
+	"throw":    Throw,
+	"const":    Const,
 	"true":     True,
 	"false":    False,
 }
@@ -295,5 +306,6 @@ func lookupIdent(ident string) TokenType {
 }
 
 func IsTypeToken(tok Token) bool {
-	return tok.Type == Int || tok.Type == Uint || tok.Type == Float || tok.Type == String || tok.Type == Bool
+	return tok.Type == Int || tok.Type == Uint || tok.Type == Float || tok.Type == String || tok.Type == Bool ||
+		tok.Type == BigInt || tok.Type == Func
 }
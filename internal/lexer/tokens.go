@@ -16,6 +16,7 @@ const (
 	Float
 	String
 	Bool
+	BigInt
 
 	Func
 	If
@@ -24,6 +25,10 @@ const (
 	Return
 	Break
 	Continue
+	Try
+	Catch
+	Throw
+	Const
 	True
 	False
 	Identifier
@@ -54,6 +59,8 @@ const (
 	RBracket
 	Semicolon
 	Comma
+	Question
+	Colon
 )
 
 var TokenNames = map[TokenType]string{
@@ -65,6 +72,7 @@ var TokenNames = map[TokenType]string{
 	Float:      "Float",
 	String:     "String",
 	Bool:       "Bool",
+	BigInt:     "BigInt",
 	Func:       "Func",
 	If:         "If",
 	Else:       "Else",
@@ -72,6 +80,10 @@ var TokenNames = map[TokenType]string{
 	Return:     "Return",
 	Break:      "Break",
 	Continue:   "Continue",
+	Try:        "Try",
+	Catch:      "Catch",
+	Throw:      "Throw",
+	Const:      "Const",
 	True:       "True",
 	False:      "False",
 	Identifier: "Identifier",
@@ -99,6 +111,8 @@ var TokenNames = map[TokenType]string{
 	Semicolon:  "Semicolon",
 	Comma:      "Comma",
 	AddressOf:  "AddressOf",
+	Question:   "Question",
+	Colon:      "Colon",
 }
 
 type Token struct {
@@ -0,0 +1,77 @@
+package optimizer
+
+import (
+	"twin-peaks-programming-language/internal/analysis"
+	"twin-peaks-programming-language/internal/bytecode"
+)
+
+const (
+	noOwner        = -1
+	ambiguousOwner = -2
+)
+
+// owners maps every instruction to the entry of the function executing it (ProgramStart for the main program).
+// Nested function bodies are jumped over by the enclosing function, so they get their own owner
+func owners(bc *bytecode.Bytecode) []int {
+	owner := make([]int, len(bc.Instructions))
+	for i := range owner {
+		owner[i] = noOwner
+	}
+
+	entries := []int{bc.ProgramStart}
+	for addr := range bc.FuncAddresses {
+		entries = append(entries, addr)
+	}
+	for _, entry := range entries {
+		reachable := make([]bool, len(bc.Instructions))
+		analysis.Reachable(bc.Instructions, entry, reachable)
+		for addr, ok := range reachable {
+			switch {
+			case !ok:
+			case owner[addr] == noOwner:
+				owner[addr] = entry
+			case owner[addr] != entry:
+				owner[addr] = ambiguousOwner
+			}
+		}
+	}
+	return owner
+}
+
+// localSlots returns local variable indices used by the instruction
+func localSlots(instr bytecode.Instruction) []int {
+	switch instr.Opcode {
+	case bytecode.OpLoad, bytecode.OpStore, bytecode.OpStoreKeep, bytecode.OpMakeCell, bytecode.OpLoadCell,
+		bytecode.OpStoreCell, bytecode.OpArrayAlloc, bytecode.OpArrayLoad, bytecode.OpArrayStore, bytecode.OpIncLocal:
+		return instr.Operands[:1]
+	case bytecode.OpLoadLoad:
+		return instr.Operands[:2]
+	case bytecode.OpClosure:
+		var slots []int
+		for i := 1; i+1 < len(instr.Operands); i += 2 {
+			if instr.Operands[i] == 1 { // captured local of the enclosing function
+				slots = append(slots, instr.Operands[i+1])
+			}
+		}
+		return slots
+	default:
+		return nil
+	}
+}
+
+// localCounts returns the number of local slots used by every function (keyed by entry address)
+func localCounts(bc *bytecode.Bytecode, owner []int) map[int]int {
+	counts := make(map[int]int)
+	for addr, info := range bc.FuncAddresses {
+		counts[addr] = info.ParamCount
+	}
+	for addr, instr := range bc.Instructions {
+		if owner[addr] < 0 {
+			continue
+		}
+		for _, slot := range localSlots(instr) {
+			counts[owner[addr]] = max(counts[owner[addr]], slot+1)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,45 @@
+package optimizer
+
+import "twin-peaks-programming-language/internal/bytecode"
+
+// constantOperand returns the position of the constant index among the instruction's operands, -1 if there is none
+func constantOperand(instr bytecode.Instruction) int {
+	switch instr.Opcode {
+	case bytecode.OpConst, bytecode.OpAddInt:
+		return 0
+	case bytecode.OpIncLocal:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// pruneConstants drops constants no instruction refers to and renumbers the rest
+func pruneConstants(bc *bytecode.Bytecode) bool {
+	used := make([]bool, len(bc.Constants))
+	for _, instr := range bc.Instructions {
+		if i := constantOperand(instr); i >= 0 {
+			used[instr.Operands[i]] = true
+		}
+	}
+
+	newIndex := make([]int, len(bc.Constants))
+	constants := make([]interface{}, 0, len(bc.Constants))
+	for i, constant := range bc.Constants {
+		if used[i] {
+			newIndex[i] = len(constants)
+			constants = append(constants, constant)
+		}
+	}
+	if len(constants) == len(bc.Constants) {
+		return false
+	}
+
+	for i, instr := range bc.Instructions {
+		if operand := constantOperand(instr); operand >= 0 {
+			setOperandAt(&bc.Instructions[i], operand, newIndex[instr.Operands[operand]])
+		}
+	}
+	bc.Constants = constants
+	return true
+}
@@ -0,0 +1,22 @@
+package optimizer
+
+import (
+	"twin-peaks-programming-language/internal/analysis"
+	"twin-peaks-programming-language/internal/bytecode"
+)
+
+// removeDeadCode removes instructions unreachable from the program start and function entries,
+// e.g. a JMP over the else branch emitted after a then-block ending in return
+func removeDeadCode(bc *bytecode.Bytecode) bool {
+	reachable := make([]bool, len(bc.Instructions))
+	analysis.Reachable(bc.Instructions, bc.ProgramStart, reachable)
+	for addr := range bc.FuncAddresses {
+		analysis.Reachable(bc.Instructions, addr, reachable)
+	}
+
+	removed := make([]bool, len(bc.Instructions))
+	for i := range bc.Instructions {
+		removed[i] = !reachable[i]
+	}
+	return removeInstructions(bc, removed)
+}
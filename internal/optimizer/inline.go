@@ -0,0 +1,118 @@
+package optimizer
+
+import (
+	"twin-peaks-programming-language/internal/analysis"
+	"twin-peaks-programming-language/internal/bytecode"
+)
+
+// inlineBudget is the largest body (without the parameter prologue) of a function that is inlined
+const inlineBudget = 16
+
+// inlineCalls replaces calls to small leaf functions without side effects with a copy of their body.
+// Callee's locals are moved past the caller's ones, returns become jumps past the copy,
+// copied instructions keep the callee's source lines
+func inlineCalls(bc *bytecode.Bytecode) bool {
+	owner := owners(bc)
+	localCount := localCounts(bc, owner)
+	effects := analysis.Analyze(bc)
+	bodies := make(map[int][]bytecode.Instruction)
+	replacements := make(map[int][]bytecode.Instruction)
+
+	for addr, instr := range bc.Instructions {
+		if instr.Opcode != bytecode.OpCall || owner[addr] < 0 {
+			continue
+		}
+		callee := instr.Operands[0]
+		body, checked := bodies[callee]
+		if !checked {
+			body = inlinableBody(bc, effects, callee)
+			bodies[callee] = body
+		}
+		if body == nil {
+			continue
+		}
+		replacements[addr] = relocate(body, localCount[owner[addr]])
+	}
+	return splice(bc, replacements)
+}
+
+// inlinableBody returns instructions of the function prepared for inlining, nil if it cannot be inlined
+func inlinableBody(bc *bytecode.Bytecode, effects *analysis.Effects, entry int) []bytecode.Instruction {
+	info, ok := bc.FuncAddresses[entry]
+	if !ok || info.UpvalueCount > 0 {
+		return nil
+	}
+	function, _ := effects.Function(entry)
+	if !function.Own.Pure() || len(function.Graph.Calls) > 0 {
+		return nil // calls (including recursive ones), heap and I/O
+	}
+
+	blocks := function.Graph.Blocks
+	if blocks[0].Start < entry {
+		return nil
+	}
+	end := blocks[len(blocks)-1].End
+	body := bc.Instructions[entry:end]
+	if len(body)-info.ParamCount > inlineBudget {
+		return nil
+	}
+
+	hasJumps := false
+	initialized := make(map[int]bool)
+	for i := 0; i < info.ParamCount; i++ {
+		initialized[i] = true
+	}
+	for offset, instr := range body {
+		if instr.IsJump() {
+			target := instr.Operands[0] - entry
+			if target <= offset || target > len(body) {
+				return nil // loops and jumps out of the function
+			}
+			hasJumps = true
+		}
+		// Inlined locals are not reset between calls, so every local must be stored before it is read
+		switch instr.Opcode {
+		case bytecode.OpStore, bytecode.OpStoreKeep:
+			if offset >= info.ParamCount {
+				initialized[instr.Operands[0]] = true
+			}
+		case bytecode.OpLoad, bytecode.OpLoadLoad, bytecode.OpIncLocal:
+			for _, slot := range localSlots(instr) {
+				if !initialized[slot] {
+					return nil
+				}
+			}
+		}
+	}
+	if hasJumps && len(initialized) > info.ParamCount {
+		return nil // a store in one branch does not initialize the local for another one
+	}
+
+	// Jump targets become offsets from the body start, returns jump past the body
+	inlined := make([]bytecode.Instruction, len(body))
+	for offset, instr := range body {
+		inlined[offset] = instr
+		switch {
+		case instr.IsJump():
+			setOperand(&inlined[offset], instr.Operands[0]-entry)
+		case instr.IsReturn():
+			inlined[offset] = bytecode.Instruction{Opcode: bytecode.OpJmp, Operands: []int{len(body)}, Line: instr.Line}
+		}
+	}
+	return inlined
+}
+
+// relocate copies the inlinable body moving its locals to start at base
+func relocate(body []bytecode.Instruction, base int) []bytecode.Instruction {
+	relocated := make([]bytecode.Instruction, len(body))
+	copy(relocated, body)
+	for i, instr := range relocated {
+		switch instr.Opcode {
+		case bytecode.OpLoad, bytecode.OpStore, bytecode.OpStoreKeep, bytecode.OpIncLocal, bytecode.OpLoadLoad:
+			for operand := range localSlots(instr) {
+				setOperandAt(&relocated[i], operand, base+instr.Operands[operand])
+			}
+		}
+	}
+	return relocated
+}
@@ -0,0 +1,47 @@
+package optimizer
+
+import "twin-peaks-programming-language/internal/bytecode"
+
+// threadJumps retargets jumps that land on an unconditional jump to its final destination,
+// and replaces a jump to RETURN, RETURN_VOID or HALT with a copy of that instruction
+func threadJumps(bc *bytecode.Bytecode) bool {
+	instructions := bc.Instructions
+	changed := false
+
+	for i := range instructions {
+		instr := &instructions[i]
+		if !instr.IsJump() {
+			continue
+		}
+
+		target := finalTarget(instructions, instr.Operands[0])
+		if target != instr.Operands[0] {
+			setOperand(instr, target)
+			changed = true
+		}
+
+		if instr.Opcode == bytecode.OpJmp && target < len(instructions) {
+			switch dest := instructions[target]; dest.Opcode {
+			case bytecode.OpReturn, bytecode.OpReturnVoid, bytecode.OpHalt:
+				*instr = bytecode.Instruction{Opcode: dest.Opcode, Operands: dest.Operands, Line: dest.Line}
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// finalTarget follows a chain of unconditional jumps, stopping on cycles
+func finalTarget(instructions []bytecode.Instruction, target int) int {
+	for hops := 0; hops < len(instructions); hops++ {
+		if target >= len(instructions) || instructions[target].Opcode != bytecode.OpJmp {
+			return target
+		}
+		next := instructions[target].Operands[0]
+		if next == target {
+			return target
+		}
+		target = next
+	}
+	return target
+}
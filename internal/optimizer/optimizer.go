@@ -0,0 +1,58 @@
+package optimizer
+
+import "twin-peaks-programming-language/internal/bytecode"
+
+// Pass transforms bytecode in place and reports whether anything was changed
+type Pass struct {
+	Name string
+	Run  func(bc *bytecode.Bytecode) bool
+}
+
+var (
+	Peephole        = Pass{Name: "peephole", Run: peephole}
+	JumpThreading   = Pass{Name: "jump-threading", Run: threadJumps}
+	DeadCode        = Pass{Name: "dead-code", Run: removeDeadCode}
+	UnusedConstants = Pass{Name: "unused-constants", Run: pruneConstants}
+	Inline          = Pass{Name: "inline", Run: inlineCalls}
+	// Superinstructions hides sequences from other passes, so it goes last
+	Superinstructions = Pass{Name: "superinstructions", Run: fuseInstructions}
+)
+
+// maxIterationCount bounds the number of rounds over all passes
+const maxIterationCount = 16
+
+// Optimizer runs its passes in order until none of them changes the bytecode
+type Optimizer struct {
+	passes []Pass
+}
+
+func New(passes ...Pass) *Optimizer {
+	return &Optimizer{passes: passes}
+}
+
+// ForLevel returns the optimizer for -O<level>: 0 disables optimization, 1 runs local rewrites
+// and fuses superinstructions, 2 also inlines small functions, removes unreachable code and unused constants
+func ForLevel(level int) *Optimizer {
+	switch {
+	case level <= 0:
+		return New()
+	case level == 1:
+		return New(Peephole, JumpThreading, Superinstructions)
+	default:
+		return New(Inline, Peephole, JumpThreading, DeadCode, UnusedConstants, Superinstructions)
+	}
+}
+
+func (o *Optimizer) Optimize(bc *bytecode.Bytecode) {
+	for i := 0; i < maxIterationCount; i++ {
+		changed := false
+		for _, pass := range o.passes {
+			if pass.Run(bc) {
+				changed = true
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+}
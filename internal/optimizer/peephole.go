@@ -0,0 +1,78 @@
+package optimizer
+
+import "twin-peaks-programming-language/internal/bytecode"
+
+// peephole rewrites short instruction sequences within a basic block:
+//
+//	STORE x; LOAD x            -> STORE_KEEP x
+//	CONST c; POP, LOAD x; POP  -> (removed)
+//	JMP next                   -> (removed)
+//	JMP_IF_FALSE next          -> POP
+//	CONST c; JMP_IF_FALSE L    -> JMP L or nothing, depending on c
+func peephole(bc *bytecode.Bytecode) bool {
+	targets := jumpTargets(bc)
+	instructions := bc.Instructions
+	removed := make([]bool, len(instructions))
+	changed := false
+
+	for i := 0; i < len(instructions); i++ {
+		instr := &instructions[i]
+
+		switch instr.Opcode {
+		case bytecode.OpJmp:
+			if instr.Operands[0] == i+1 {
+				removed[i] = true
+				continue
+			}
+		case bytecode.OpJmpIfFalse:
+			if instr.Operands[0] == i+1 {
+				*instr = bytecode.Instruction{Opcode: bytecode.OpPop, Line: instr.Line}
+				changed = true
+				continue
+			}
+		}
+
+		if i+1 >= len(instructions) || targets[i+1] {
+			continue
+		}
+		next := &instructions[i+1]
+
+		switch {
+		case instr.Opcode == bytecode.OpStore && next.Opcode == bytecode.OpLoad && instr.Operands[0] == next.Operands[0]:
+			instr.Opcode = bytecode.OpStoreKeep
+			removed[i+1] = true
+			i++
+
+		case (instr.Opcode == bytecode.OpConst || instr.Opcode == bytecode.OpLoad) && next.Opcode == bytecode.OpPop:
+			removed[i], removed[i+1] = true, true
+			i++
+
+		case instr.Opcode == bytecode.OpConst && next.Opcode == bytecode.OpJmpIfFalse:
+			truthy, known := constantTruth(bc.Constants[instr.Operands[0]])
+			if !known {
+				continue
+			}
+			removed[i] = true
+			if truthy {
+				removed[i+1] = true
+			} else {
+				next.Opcode = bytecode.OpJmp
+			}
+			i++
+		}
+	}
+
+	return removeInstructions(bc, removed) || changed
+}
+
+// constantTruth mirrors the VM's truthiness for constants that may be a condition
+func constantTruth(constant interface{}) (truthy bool, known bool) {
+	switch v := constant.(type) {
+	case bool:
+		return v, true
+	case int:
+		return v != 0, true
+	default:
+		return false, false
+	}
+}
@@ -0,0 +1,91 @@
+package optimizer
+
+import "twin-peaks-programming-language/internal/bytecode"
+
+// jumpTargets returns addresses control may arrive to other than from the previous instruction:
+// jump and try handler targets, function entries and the program start
+func jumpTargets(bc *bytecode.Bytecode) map[int]bool {
+	targets := map[int]bool{bc.ProgramStart: true}
+	for addr := range bc.FuncAddresses {
+		targets[addr] = true
+	}
+	for _, instr := range bc.Instructions {
+		if instr.HasAddressOperand() {
+			targets[instr.Operands[0]] = true
+		}
+	}
+	return targets
+}
+
+// removeInstructions deletes marked instructions, an address of a removed instruction moves to the next kept one
+func removeInstructions(bc *bytecode.Bytecode, removed []bool) bool {
+	replacements := make(map[int][]bytecode.Instruction)
+	for i, remove := range removed {
+		if remove {
+			replacements[i] = nil
+		}
+	}
+	return splice(bc, replacements)
+}
+
+// splice replaces instructions at the given addresses with sequences and rewrites addresses in operands,
+// FuncAddresses and ProgramStart. Address operands inside a sequence are offsets from its start,
+// an address of a replaced instruction becomes the address of the sequence start
+func splice(bc *bytecode.Bytecode, replacements map[int][]bytecode.Instruction) bool {
+	if len(replacements) == 0 {
+		return false
+	}
+
+	newAddress := make([]int, len(bc.Instructions)+1)
+	spliced := make([]bytecode.Instruction, 0, len(bc.Instructions))
+	inserted := make([]int, 0) // start of the inserted sequence for every spliced instruction, -1 for original ones
+	for i, instr := range bc.Instructions {
+		newAddress[i] = len(spliced)
+		sequence, replaced := replacements[i]
+		if !replaced {
+			spliced = append(spliced, instr)
+			inserted = append(inserted, -1)
+			continue
+		}
+		for _, seqInstr := range sequence {
+			spliced = append(spliced, seqInstr)
+			inserted = append(inserted, newAddress[i])
+		}
+	}
+	newAddress[len(bc.Instructions)] = len(spliced)
+
+	for i, instr := range spliced {
+		if !instr.HasAddressOperand() {
+			continue
+		}
+		if start := inserted[i]; start >= 0 && instr.Opcode != bytecode.OpCall && instr.Opcode != bytecode.OpTailCall &&
+			instr.Opcode != bytecode.OpClosure {
+			setOperand(&spliced[i], start+instr.Operands[0])
+		} else {
+			setOperand(&spliced[i], newAddress[instr.Operands[0]])
+		}
+	}
+
+	funcAddresses := make(map[int]*bytecode.FunctionInfo, len(bc.FuncAddresses))
+	for addr, info := range bc.FuncAddresses {
+		info.Address = newAddress[addr]
+		funcAddresses[info.Address] = info
+	}
+
+	bc.Instructions = spliced
+	bc.FuncAddresses = funcAddresses
+	bc.ProgramStart = newAddress[bc.ProgramStart]
+	return true
+}
+
+// setOperand replaces the first operand without modifying the slice shared with other instructions
+func setOperand(instr *bytecode.Instruction, value int) {
+	setOperandAt(instr, 0, value)
+}
+
+// setOperandAt replaces the operand at the index without modifying the slice shared with other instructions
+func setOperandAt(instr *bytecode.Instruction, index, value int) {
+	operands := append([]int(nil), instr.Operands...)
+	operands[index] = value
+	instr.Operands = operands
+}
@@ -0,0 +1,26 @@
+package optimizer
+
+import "twin-peaks-programming-language/internal/bytecode"
+
+// Specialize rewrites instructions that the feedback of a previous run saw with operands of one kind to
+// specialized instructions and returns their number. A site is applied only if the instruction at its address
+// has the same opcode and line, so feedback of a changed program is ignored where it no longer matches.
+// Specialized instructions still check their operands, stale feedback costs a deoptimization, not a wrong result.
+// It runs after Optimize, the passes match generic opcodes
+func Specialize(bc *bytecode.Bytecode, feedback *bytecode.TypeFeedback) int {
+	specialized := 0
+	for _, site := range feedback.Sites {
+		if site.Addr < 0 || site.Addr >= len(bc.Instructions) || !site.Kinds.Monomorphic() {
+			continue
+		}
+		instr := &bc.Instructions[site.Addr]
+		if instr.String() != site.Opcode || instr.Line != site.Line {
+			continue
+		}
+		if opcode, ok := bytecode.Specialize(instr.Opcode, site.Kinds); ok {
+			instr.Opcode = opcode
+			specialized++
+		}
+	}
+	return specialized
+}
@@ -0,0 +1,73 @@
+package optimizer
+
+import "twin-peaks-programming-language/internal/bytecode"
+
+// fuseInstructions replaces frequent sequences with superinstructions:
+//
+//	LOAD x; CONST k; ADD; STORE x  ->  INC_LOCAL x k
+//	LT; JMP_IF_FALSE L             ->  LT_JMP_IF_FALSE L
+//	LOAD x; LOAD y                 ->  LOAD_LOAD x y
+//	CONST k; ADD (k is an int)     ->  ADD_INT k
+//
+// The last instruction of a sequence is rewritten in place and the others are removed, so an address
+// of the sequence becomes the address of the superinstruction. Sequences with a jump target inside are kept
+func fuseInstructions(bc *bytecode.Bytecode) bool {
+	targets := jumpTargets(bc)
+	instructions := bc.Instructions
+	removed := make([]bool, len(instructions))
+	changed := false
+
+	// fusable reports whether instructions from addr on match the opcodes and no jump lands inside them
+	fusable := func(addr int, opcodes ...byte) bool {
+		if addr+len(opcodes) > len(instructions) {
+			return false
+		}
+		for i, opcode := range opcodes {
+			if instructions[addr+i].Opcode != opcode || removed[addr+i] || (i > 0 && targets[addr+i]) {
+				return false
+			}
+		}
+		return true
+	}
+	fuse := func(addr, length int, opcode byte, operands ...int) {
+		for i := addr; i < addr+length-1; i++ {
+			removed[i] = true
+		}
+		last := &instructions[addr+length-1]
+		*last = bytecode.Instruction{Opcode: opcode, Operands: operands, Line: last.Line}
+		changed = true
+	}
+
+	for addr := 0; addr < len(instructions); addr++ {
+		instr := instructions[addr]
+		switch {
+		case fusable(addr, bytecode.OpLoad, bytecode.OpConst, bytecode.OpAdd, bytecode.OpStore) &&
+			instructions[addr+3].Operands[0] == instr.Operands[0]:
+			// The line of ADD is kept for errors of the addition
+			line := instructions[addr+2].Line
+			fuse(addr, 4, bytecode.OpIncLocal, instr.Operands[0], instructions[addr+1].Operands[0])
+			instructions[addr+3].Line = line
+			addr += 3
+		case fusable(addr, bytecode.OpLt, bytecode.OpJmpIfFalse):
+			fuse(addr, 2, bytecode.OpLtJmpIfFalse, instructions[addr+1].Operands[0])
+			instructions[addr+1].Line = instr.Line
+			addr++
+		case fusable(addr, bytecode.OpLoad, bytecode.OpLoad):
+			fuse(addr, 2, bytecode.OpLoadLoad, instr.Operands[0], instructions[addr+1].Operands[0])
+			addr++
+		case fusable(addr, bytecode.OpConst, bytecode.OpAdd) && isIntConstant(bc, instr.Operands[0]):
+			fuse(addr, 2, bytecode.OpAddInt, instr.Operands[0])
+			addr++
+		}
+	}
+	if !changed {
+		return false
+	}
+	removeInstructions(bc, removed)
+	return true
+}
+
+func isIntConstant(bc *bytecode.Bytecode, index int) bool {
+	_, ok := bc.Constants[index].(int)
+	return ok
+}
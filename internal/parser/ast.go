@@ -28,6 +28,13 @@ const (
 	NodeDereference
 	NodeAddressOf
 	NodeFuncDecl
+	NodeTernary
+	NodeFuncLiteral
+	NodeCallIndirect
+	NodeTupleAssign
+	NodeTry
+	NodeThrow
+	NodeConstDecl
 )
 
 type ASTNode struct {
@@ -35,6 +42,7 @@ type ASTNode struct {
 	Children []*ASTNode
 	Value    interface{}
 	Token    lexer.Token
+	DataType string // static type of an expression, set by the checker
 }
 
 func (n *ASTNode) String() string {
@@ -93,6 +101,20 @@ func (n *ASTNode) writeName(sb *strings.Builder) {
 		sb.WriteString("AddressOf:\n")
 	case NodeFuncDecl:
 		sb.WriteString(fmt.Sprintf("FuncDecl(%s):\n", n.Value))
+	case NodeTernary:
+		sb.WriteString("Ternary:\n")
+	case NodeFuncLiteral:
+		sb.WriteString("FuncLiteral:\n")
+	case NodeCallIndirect:
+		sb.WriteString("CallIndirect:\n")
+	case NodeTupleAssign:
+		sb.WriteString("TupleAssign:\n")
+	case NodeTry:
+		sb.WriteString("Try:\n")
+	case NodeThrow:
+		sb.WriteString("Throw:\n")
+	case NodeConstDecl:
+		sb.WriteString("ConstDecl:\n")
 	default:
 		sb.WriteString(fmt.Sprintf("Unknown(%d):\n", n.Type))
 	}
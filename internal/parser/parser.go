@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"strings"
 	"twin-peaks-programming-language/internal/lexer"
 )
 
@@ -57,8 +58,7 @@ func (p *Parser) nextIsType() bool {
 	if p.position+1 >= len(p.tokens) {
 		return false
 	}
-	return p.peek().Type == lexer.Int || p.peek().Type == lexer.Float ||
-		p.peek().Type == lexer.String || p.peek().Type == lexer.Bool || p.peek().Type == lexer.Uint
+	return lexer.IsTypeToken(p.peek())
 }
 
 func (p *Parser) consume(tokenType lexer.TokenType) error {
@@ -87,7 +87,7 @@ func (p *Parser) ParseProgram() (*ASTNode, error) {
 	return program, nil
 }
 
-// ParseStatement -> ParseVarDecl | ParseAssignment | ParseIf | ParseFor | ParseReturn | ParseBlock | ParseExpressionStmt
+// ParseStatement -> ParseVarDecl | ParseAssignment | ParseIf | ParseFor | ParseReturn | ParseTry | ParseThrow | ParseBlock | ParseExpressionStmt
 func (p *Parser) ParseStatement() (*ASTNode, error) {
 	switch {
 	case p.check(lexer.LBrace):
@@ -109,6 +109,9 @@ func (p *Parser) ParseStatement() (*ASTNode, error) {
 	case p.check(lexer.Func):
 		return p.ParseFuncDecl()
 
+	case p.check(lexer.Const):
+		return p.ParseConstDecl()
+
 	case p.check(lexer.If):
 		return p.ParseIf()
 
@@ -118,6 +121,12 @@ func (p *Parser) ParseStatement() (*ASTNode, error) {
 	case p.check(lexer.Return):
 		return p.ParseReturn()
 
+	case p.check(lexer.Try):
+		return p.ParseTry()
+
+	case p.check(lexer.Throw):
+		return p.ParseThrow()
+
 	case p.check(lexer.Break) || p.check(lexer.Continue):
 		token := p.currToken
 		p.advance()
@@ -136,6 +145,10 @@ func (p *Parser) ParseStatement() (*ASTNode, error) {
 			return nil, err
 		}
 
+		if p.check(lexer.Comma) {
+			return p.parseTupleAssign(expr)
+		}
+
 		if expr.Type == NodeBinaryOp && expr.Value == "=" {
 			if err := p.consume(lexer.Semicolon); err != nil {
 				return nil, err
@@ -150,6 +163,41 @@ func (p *Parser) ParseStatement() (*ASTNode, error) {
 	}
 }
 
+// parseTupleAssign -> expression {',' parseTernary} '=' expression ';'
+// The first target is already parsed, e.g. q, r = divmod(7, 2);
+func (p *Parser) parseTupleAssign(first *ASTNode) (*ASTNode, error) {
+	targets := []*ASTNode{first}
+	for p.check(lexer.Comma) {
+		p.advance() // skip comma
+		target, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	assignToken := p.currToken
+	if err := p.consume(lexer.Assign); err != nil {
+		return nil, err
+	}
+
+	value, err := p.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.consume(lexer.Semicolon); err != nil {
+		return nil, err
+	}
+
+	return &ASTNode{
+		Type:     NodeTupleAssign,
+		Value:    assignToken.Text,
+		Token:    assignToken,
+		Children: append(targets, value),
+	}, nil
+}
+
 // ParseVarDecl -> identifier type ['=' expression] ';'
 func (p *Parser) ParseVarDecl() (*ASTNode, error) {
 	identToken := p.currToken
@@ -188,6 +236,49 @@ func (p *Parser) ParseVarDecl() (*ASTNode, error) {
 	return node, nil
 }
 
+// ParseConstDecl -> 'const' identifier type '=' expression ';'
+func (p *Parser) ParseConstDecl() (*ASTNode, error) {
+	constToken := p.currToken
+	p.advance() // skip 'const'
+
+	if err := p.expect(lexer.Identifier); err != nil {
+		return nil, err
+	}
+	identToken := p.currToken
+	p.advance()
+
+	typeNode, err := p.ParseType()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.consume(lexer.Assign); err != nil {
+		return nil, err
+	}
+	value, err := p.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.consume(lexer.Semicolon); err != nil {
+		return nil, err
+	}
+
+	return &ASTNode{
+		Type:  NodeConstDecl,
+		Token: constToken,
+		Children: []*ASTNode{
+			{
+				Type:  NodeIdentifier,
+				Value: identToken.Text,
+				Token: identToken,
+			},
+			typeNode,
+			value,
+		},
+	}, nil
+}
+
 // ParseType ->  [*] (Int | Float | String | Bool | Identifier) ['[' expression ']']
 func (p *Parser) ParseType() (*ASTNode, error) {
 	// Базовый тип
@@ -244,9 +335,9 @@ func (p *Parser) ParseExpression() (*ASTNode, error) {
 	return p.parseAssignment()
 }
 
-// parseAssignment -> ParseLogicalOr ['=' parseAssignment]
+// parseAssignment -> parseTernary ['=' parseAssignment]
 func (p *Parser) parseAssignment() (*ASTNode, error) {
-	left, err := p.parseLogicalOr()
+	left, err := p.parseTernary()
 	if err != nil {
 		return nil, err
 	}
@@ -269,6 +360,41 @@ func (p *Parser) parseAssignment() (*ASTNode, error) {
 	return left, nil
 }
 
+// parseTernary -> parseLogicalOr ['?' ParseExpression ':' parseTernary]
+func (p *Parser) parseTernary() (*ASTNode, error) {
+	condition, err := p.parseLogicalOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.check(lexer.Question) {
+		return condition, nil
+	}
+
+	token := p.currToken
+	p.advance() // skip '?'
+
+	thenExpr, err := p.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.consume(lexer.Colon); err != nil {
+		return nil, err
+	}
+
+	elseExpr, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ASTNode{
+		Type:     NodeTernary,
+		Token:    token,
+		Children: []*ASTNode{condition, thenExpr, elseExpr},
+	}, nil
+}
+
 // parseLogicalOr -> parseLogicalAnd {'||' parseLogicalAnd}
 func (p *Parser) parseLogicalOr() (*ASTNode, error) {
 	left, err := p.parseLogicalAnd()
@@ -449,13 +575,17 @@ func (p *Parser) parseUnary() (*ASTNode, error) {
 	return p.parsePrimary()
 }
 
-// parsePrimary -> identifier | literal | '(' expression ')' | parseCall | parseArrayAccess
+// parsePrimary -> identifier | literal | '(' expression ')' | parseCall | parseArrayAccess | parseFuncLiteral | conversion
 func (p *Parser) parsePrimary() (*ASTNode, error) {
 	switch p.currToken.Type {
 	case lexer.Identifier:
 		// Array Access or Function Call
 		if p.peek().Type == lexer.LParen {
-			return p.parseCall()
+			call, err := p.parseCall()
+			if err != nil {
+				return nil, err
+			}
+			return p.parseCallSuffix(call)
 		} else if p.peek().Type == lexer.LBracket {
 			return p.parseArrayAccess()
 		}
@@ -487,37 +617,59 @@ func (p *Parser) parsePrimary() (*ASTNode, error) {
 		if err := p.consume(lexer.RParen); err != nil {
 			return nil, err
 		}
-		return expr, nil
+		return p.parseCallSuffix(expr)
+
+	case lexer.Int, lexer.Uint, lexer.Float, lexer.String, lexer.Bool, lexer.BigInt:
+		// Conversion: int(x), uint(x), float(x), string(x), bool(x), bigint(x)
+		if p.peek().Type != lexer.LParen {
+			return nil, fmt.Errorf("unexpected token %v at line %d", p.currToken.String(), p.currToken.Line)
+		}
+		return p.parseCall()
+
+	case lexer.Func:
+		literal, err := p.parseFuncLiteral()
+		if err != nil {
+			return nil, err
+		}
+		return p.parseCallSuffix(literal)
 
 	default:
 		return nil, fmt.Errorf("unexpected token %v at line %d", p.currToken.String(), p.currToken.Line)
 	}
 }
 
-// ParseCall -> identifier '(' [ParseExpression {',' ParseExpression}] ')'
-func (p *Parser) parseCall() (*ASTNode, error) {
-	identToken := p.currToken
-	p.advance() // skip идентификатор
+// parseCallSuffix -> {'(' [ParseExpression {',' ParseExpression}] ')'}
+// Calls a function value produced by an expression, e.g. makeAdder(1)(2)
+func (p *Parser) parseCallSuffix(callee *ASTNode) (*ASTNode, error) {
+	for p.check(lexer.LParen) {
+		token := p.currToken
+		args, err := p.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		callee = &ASTNode{
+			Type:     NodeCallIndirect,
+			Token:    token,
+			Children: append([]*ASTNode{callee}, args...),
+		}
+	}
+	return callee, nil
+}
 
+// parseArguments -> '(' [ParseExpression {',' ParseExpression}] ')'
+func (p *Parser) parseArguments() ([]*ASTNode, error) {
 	if err := p.consume(lexer.LParen); err != nil {
 		return nil, err
 	}
 
-	node := &ASTNode{
-		Type:     NodeCall,
-		Value:    identToken.Text,
-		Token:    identToken,
-		Children: []*ASTNode{},
-	}
-
-	// Arguments
+	args := []*ASTNode{}
 	if !p.check(lexer.RParen) {
 		for {
 			arg, err := p.ParseExpression()
 			if err != nil {
 				return nil, err
 			}
-			node.Children = append(node.Children, arg)
+			args = append(args, arg)
 
 			if !p.check(lexer.Comma) {
 				break
@@ -530,7 +682,26 @@ func (p *Parser) parseCall() (*ASTNode, error) {
 		return nil, err
 	}
 
-	return node, nil
+	return args, nil
+}
+
+// ParseCall -> identifier '(' [ParseExpression {',' ParseExpression}] ')'
+func (p *Parser) parseCall() (*ASTNode, error) {
+	identToken := p.currToken
+	p.advance() // skip идентификатор
+
+	// Arguments
+	args, err := p.parseArguments()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ASTNode{
+		Type:     NodeCall,
+		Value:    identToken.Text,
+		Token:    identToken,
+		Children: args,
+	}, nil
 }
 
 // ParseArrayAccess -> identifier '[' expression ']'
@@ -564,7 +735,7 @@ func (p *Parser) parseArrayAccess() (*ASTNode, error) {
 	}, nil
 }
 
-// ParseReturn -> 'return' [expression] ';'
+// ParseReturn -> 'return' [expression {',' expression}] ';'
 func (p *Parser) ParseReturn() (*ASTNode, error) {
 	returnToken := p.currToken
 	p.advance() // skip 'return'
@@ -574,12 +745,17 @@ func (p *Parser) ParseReturn() (*ASTNode, error) {
 		Token: returnToken,
 	}
 
-	if !p.check(lexer.Semicolon) {
+	for !p.check(lexer.Semicolon) {
 		expr, err := p.ParseExpression()
 		if err != nil {
 			return nil, err
 		}
-		node.Children = []*ASTNode{expr}
+		node.Children = append(node.Children, expr)
+
+		if !p.check(lexer.Comma) {
+			break
+		}
+		p.advance() // skip comma
 	}
 
 	if err := p.consume(lexer.Semicolon); err != nil {
@@ -589,6 +765,72 @@ func (p *Parser) ParseReturn() (*ASTNode, error) {
 	return node, nil
 }
 
+// ParseTry -> 'try' ParseBlock 'catch' '(' identifier ')' ParseBlock
+func (p *Parser) ParseTry() (*ASTNode, error) {
+	tryToken := p.currToken
+	p.advance() // skip 'try'
+
+	tryBlock, err := p.ParseBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.consume(lexer.Catch); err != nil {
+		return nil, err
+	}
+	if err := p.consume(lexer.LParen); err != nil {
+		return nil, err
+	}
+	if err := p.expect(lexer.Identifier); err != nil {
+		return nil, err
+	}
+	errToken := p.currToken
+	p.advance()
+	if err := p.consume(lexer.RParen); err != nil {
+		return nil, err
+	}
+
+	catchBlock, err := p.ParseBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ASTNode{
+		Type:  NodeTry,
+		Token: tryToken,
+		Children: []*ASTNode{
+			tryBlock,
+			{
+				Type:  NodeIdentifier,
+				Value: errToken.Text,
+				Token: errToken,
+			},
+			catchBlock,
+		},
+	}, nil
+}
+
+// ParseThrow -> 'throw' expression ';'
+func (p *Parser) ParseThrow() (*ASTNode, error) {
+	throwToken := p.currToken
+	p.advance() // skip 'throw'
+
+	value, err := p.ParseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.consume(lexer.Semicolon); err != nil {
+		return nil, err
+	}
+
+	return &ASTNode{
+		Type:     NodeThrow,
+		Token:    throwToken,
+		Children: []*ASTNode{value},
+	}, nil
+}
+
 // ParseAssignment -> ParseExpression '=' ParseExpression
 func (p *Parser) ParseAssignment(left *ASTNode) (*ASTNode, error) {
 	assignToken := p.currToken
@@ -829,7 +1071,7 @@ func (p *Parser) ParseArrayDecl() (*ASTNode, error) {
 	return node, nil
 }
 
-// ParseFuncDecl -> 'fn' identifier '(' [ParseParamList] ')' [ParseType] ParseBlock
+// ParseFuncDecl -> 'fn' identifier parseFuncSignatureAndBody
 func (p *Parser) ParseFuncDecl() (*ASTNode, error) {
 	fnToken := p.currToken
 	p.advance() // skip 'fn'
@@ -841,6 +1083,39 @@ func (p *Parser) ParseFuncDecl() (*ASTNode, error) {
 	nameToken := p.currToken
 	p.advance()
 
+	children, err := p.parseFuncSignatureAndBody()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ASTNode{
+		Type:     NodeFuncDecl,
+		Value:    nameToken.Text,
+		Token:    fnToken,
+		Children: children,
+	}, nil
+}
+
+// parseFuncLiteral -> 'fn' parseFuncSignatureAndBody
+func (p *Parser) parseFuncLiteral() (*ASTNode, error) {
+	fnToken := p.currToken
+	p.advance() // skip 'fn'
+
+	children, err := p.parseFuncSignatureAndBody()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ASTNode{
+		Type:     NodeFuncLiteral,
+		Token:    fnToken,
+		Children: children,
+	}, nil
+}
+
+// parseFuncSignatureAndBody -> '(' [ParseParamList] ')' [ParseType | parseReturnTypeList] ParseBlock
+// Returns children of a function node: params block, return type and body
+func (p *Parser) parseFuncSignatureAndBody() ([]*ASTNode, error) {
 	if err := p.consume(lexer.LParen); err != nil {
 		return nil, err
 	}
@@ -859,6 +1134,12 @@ func (p *Parser) ParseFuncDecl() (*ASTNode, error) {
 			Type:  NodeIdentifier,
 			Value: "void",
 		}
+	} else if p.check(lexer.LParen) {
+		var err error
+		returnType, err = p.parseReturnTypeList()
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		var err error
 		returnType, err = p.ParseType()
@@ -872,21 +1153,47 @@ func (p *Parser) ParseFuncDecl() (*ASTNode, error) {
 		return nil, err
 	}
 
-	funcNode := &ASTNode{
-		Type:  NodeFuncDecl,
-		Value: nameToken.Text,
-		Token: fnToken,
-		Children: []*ASTNode{
-			{ // params
-				Type:     NodeBlock,
-				Children: params,
-			},
-			returnType,
-			body,
+	return []*ASTNode{
+		{ // params
+			Type:     NodeBlock,
+			Children: params,
 		},
+		returnType,
+		body,
+	}, nil
+}
+
+// parseReturnTypeList -> '(' ParseType {',' ParseType} ')'
+// Types of multiple return values are children of the resulting VarType node
+func (p *Parser) parseReturnTypeList() (*ASTNode, error) {
+	listToken := p.currToken
+	p.advance() // skip '('
+
+	node := &ASTNode{
+		Type:  NodeVarType,
+		Token: listToken,
+	}
+	var names []string
+	for {
+		names = append(names, p.currToken.Text)
+		typeNode, err := p.ParseType()
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, typeNode)
+
+		if !p.check(lexer.Comma) {
+			break
+		}
+		p.advance() // skip comma
 	}
 
-	return funcNode, nil
+	if err := p.consume(lexer.RParen); err != nil {
+		return nil, err
+	}
+
+	node.Value = "(" + strings.Join(names, ", ") + ")"
+	return node, nil
 }
 
 // ParseParamList -> (ParseParamDecl (',' ParseParamDecl)*)?
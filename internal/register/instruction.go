@@ -0,0 +1,181 @@
+package register
+
+import (
+	"fmt"
+	"twin-peaks-programming-language/internal/bytecode"
+)
+
+// Register code is three-address: A is the destination (or the jump target), B and C are sources.
+// A source operand is a register of the current frame if it is not negative, otherwise it is
+// a constant (see Constant and IsConstant). Registers of a frame are the function's locals
+// followed by temporaries that hold values of the stack bytecode's operand stack
+const (
+	OpInvalid    byte = iota // Недействительная операция
+	OpMove                   // A = B
+	OpAdd                    // A = B + C
+	OpSub                    // A = B - C
+	OpMul                    // A = B * C
+	OpDiv                    // A = B / C
+	OpMod                    // A = B % C
+	OpEq                     // A = B == C
+	OpNeq                    // A = B != C
+	OpLt                     // A = B < C
+	OpLe                     // A = B <= C
+	OpGt                     // A = B > C
+	OpGe                     // A = B >= C
+	OpAnd                    // A = B && C
+	OpOr                     // A = B || C
+	OpNeg                    // A = -B
+	OpNot                    // A = !B
+	OpSqrt                   // A = sqrt(B)
+	OpConvert                // A = преобразование B к типу C (один из bytecode.Convert*)
+	OpJmp                    // Переход на A
+	OpJmpIfFalse             // Переход на A, если B ложно
+	OpCall                   // Вызов функции B, аргументы в регистрах начиная с A, результаты туда же
+	OpTailCall               // Хвостовой вызов функции B с аргументами начиная с A, переиспользует фрейм
+	OpReturn                 // Возврат C значений, начиная с B (при C == 1 B может быть константой)
+	OpPrint                  // Вывод B
+	OpArrayAlloc             // A = новый массив размера B
+	OpArrayLoad              // A = B[C]
+	OpArrayStore             // A[B] = C
+	OpHalt                   // Остановка
+)
+
+var opcodeNames = map[byte]string{
+	OpMove:       "MOVE",
+	OpAdd:        "ADD",
+	OpSub:        "SUB",
+	OpMul:        "MUL",
+	OpDiv:        "DIV",
+	OpMod:        "MOD",
+	OpEq:         "EQ",
+	OpNeq:        "NEQ",
+	OpLt:         "LT",
+	OpLe:         "LE",
+	OpGt:         "GT",
+	OpGe:         "GE",
+	OpAnd:        "AND",
+	OpOr:         "OR",
+	OpNeg:        "NEG",
+	OpNot:        "NOT",
+	OpSqrt:       "SQRT",
+	OpConvert:    "CONVERT",
+	OpJmp:        "JMP",
+	OpJmpIfFalse: "JMP_IF_FALSE",
+	OpCall:       "CALL",
+	OpTailCall:   "TAIL_CALL",
+	OpReturn:     "RETURN",
+	OpPrint:      "PRINT",
+	OpArrayAlloc: "ARRAY_ALLOC",
+	OpArrayLoad:  "ARRAY_LOAD",
+	OpArrayStore: "ARRAY_STORE",
+	OpHalt:       "HALT",
+}
+
+// stackOpcodes maps operators of the register code to the stack bytecode opcodes with the same semantics
+var stackOpcodes = map[byte]byte{
+	OpAdd:  bytecode.OpAdd,
+	OpSub:  bytecode.OpSub,
+	OpMul:  bytecode.OpMul,
+	OpDiv:  bytecode.OpDiv,
+	OpMod:  bytecode.OpMod,
+	OpEq:   bytecode.OpEq,
+	OpNeq:  bytecode.OpNeq,
+	OpLt:   bytecode.OpLt,
+	OpLe:   bytecode.OpLe,
+	OpGt:   bytecode.OpGt,
+	OpGe:   bytecode.OpGe,
+	OpAnd:  bytecode.OpAnd,
+	OpOr:   bytecode.OpOr,
+	OpNeg:  bytecode.OpNeg,
+	OpNot:  bytecode.OpNot,
+	OpSqrt: bytecode.OpSqrt,
+}
+
+// StackOpcode returns the stack bytecode opcode of an operator, the VM evaluates both with the same code
+func StackOpcode(opcode byte) byte {
+	return stackOpcodes[opcode]
+}
+
+type Instruction struct {
+	Opcode  byte
+	A, B, C int
+	Line    int
+}
+
+// Constant returns the source operand referring to the constant with the given index
+func Constant(index int) int {
+	return -index - 1
+}
+
+// IsConstant reports whether the source operand refers to a constant
+func IsConstant(operand int) bool {
+	return operand < 0
+}
+
+// ConstantIndex returns the constant index of a constant operand
+func ConstantIndex(operand int) int {
+	return -operand - 1
+}
+
+func operandString(operand int) string {
+	if IsConstant(operand) {
+		return fmt.Sprintf("k%d", ConstantIndex(operand))
+	}
+	return fmt.Sprintf("r%d", operand)
+}
+
+func (i Instruction) String() string {
+	name := opcodeNames[i.Opcode]
+	if name == "" {
+		name = fmt.Sprintf("UNKNOWN(%d)", i.Opcode)
+	}
+
+	switch i.Opcode {
+	case OpMove, OpNeg, OpNot, OpSqrt, OpArrayAlloc:
+		return fmt.Sprintf("%s r%d, %s", name, i.A, operandString(i.B))
+	case OpConvert:
+		return fmt.Sprintf("%s r%d, %s, %d", name, i.A, operandString(i.B), i.C)
+	case OpJmp:
+		return fmt.Sprintf("%s %d", name, i.A)
+	case OpJmpIfFalse:
+		return fmt.Sprintf("%s %d, %s", name, i.A, operandString(i.B))
+	case OpCall, OpTailCall:
+		return fmt.Sprintf("%s r%d, fn%d", name, i.A, i.B)
+	case OpReturn:
+		switch i.C {
+		case 0:
+			return name
+		case 1:
+			return fmt.Sprintf("%s %s", name, operandString(i.B))
+		default:
+			return fmt.Sprintf("%s r%d..r%d", name, i.B, i.B+i.C-1)
+		}
+	case OpPrint:
+		return fmt.Sprintf("%s %s", name, operandString(i.B))
+	case OpArrayLoad:
+		return fmt.Sprintf("%s r%d, r%d, %s", name, i.A, i.B, operandString(i.C))
+	case OpArrayStore:
+		return fmt.Sprintf("%s r%d, %s, %s", name, i.A, operandString(i.B), operandString(i.C))
+	case OpHalt:
+		return name
+	default:
+		return fmt.Sprintf("%s r%d, %s, %s", name, i.A, operandString(i.B), operandString(i.C))
+	}
+}
+
+// Function is a function of the register code
+type Function struct {
+	Info      *bytecode.FunctionInfo // nil for the main program
+	Entry     int                    // address of the first instruction
+	Locals    int                    // number of local variable registers, temporaries follow them
+	FrameSize int                    // locals and temporaries
+}
+
+// Program is the register code of the whole program
+type Program struct {
+	Code      []Instruction
+	Constants []interface{}
+	Functions []*Function // operand B of CALL and TAIL_CALL indexes this slice
+	Main      *Function
+}
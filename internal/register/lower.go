@@ -0,0 +1,404 @@
+package register
+
+import (
+	"fmt"
+	"sort"
+	"twin-peaks-programming-language/internal/bytecode"
+)
+
+// binaryOps and unaryOps map stack bytecode operators to register ones
+var binaryOps = map[byte]byte{
+	bytecode.OpAdd: OpAdd,
+	bytecode.OpSub: OpSub,
+	bytecode.OpMul: OpMul,
+	bytecode.OpDiv: OpDiv,
+	bytecode.OpMod: OpMod,
+	bytecode.OpEq:  OpEq,
+	bytecode.OpNeq: OpNeq,
+	bytecode.OpLt:  OpLt,
+	bytecode.OpLe:  OpLe,
+	bytecode.OpGt:  OpGt,
+	bytecode.OpGe:  OpGe,
+	bytecode.OpAnd: OpAnd,
+	bytecode.OpOr:  OpOr,
+}
+
+var unaryOps = map[byte]byte{
+	bytecode.OpNeg:  OpNeg,
+	bytecode.OpNot:  OpNot,
+	bytecode.OpSqrt: OpSqrt,
+}
+
+const unreachable = -1
+
+// lowering translates the stack bytecode function by function. The stack depth before every instruction is
+// known statically, so the value at depth d lives in the temporary register Locals+d. Loads and constants
+// are not copied to temporaries: the simulated stack keeps their operands until a consumer takes them or
+// a control flow merge requires every value to be in its temporary
+type lowering struct {
+	bc      *bytecode.Bytecode
+	program *Program
+
+	depth     []int             // stack depth before every instruction, unreachable if never executed
+	owner     []int             // entry address of the function executing every instruction
+	functions map[int]int       // stack entry address -> index in program.Functions
+	targets   map[int]bool      // addresses where control flow merges
+	address   []int             // register code address of every stack instruction
+	maxDepth  map[*Function]int // deepest stack of every function
+	returns   map[int]int       // number of values returned by every function, keyed by stack entry address
+
+	current *Function // function being lowered
+	stack   []int     // operands of the simulated stack
+	line    int       // source line of the instruction being lowered
+	label   int       // register address of the last merge point, its instruction must not be rewritten
+}
+
+// Lower translates the stack bytecode to register code. Closures, function values, cells and exceptions
+// are not supported: an error names the first unsupported instruction
+func Lower(bc *bytecode.Bytecode) (*Program, error) {
+	l := &lowering{
+		bc:        bc,
+		program:   &Program{Constants: bc.Constants},
+		depth:     make([]int, len(bc.Instructions)),
+		owner:     make([]int, len(bc.Instructions)),
+		functions: make(map[int]int),
+		targets:   map[int]bool{bc.ProgramStart: true},
+		address:   make([]int, len(bc.Instructions)+1),
+		maxDepth:  make(map[*Function]int),
+		returns:   make(map[int]int),
+	}
+	for i := range l.depth {
+		l.depth[i] = unreachable
+	}
+
+	entries := make([]int, 0, len(bc.FuncAddresses))
+	for addr := range bc.FuncAddresses {
+		entries = append(entries, addr)
+	}
+	sort.Ints(entries)
+	for _, addr := range entries {
+		l.functions[addr] = len(l.program.Functions)
+		l.program.Functions = append(l.program.Functions, &Function{Info: bc.FuncAddresses[addr]})
+		l.targets[addr] = true
+	}
+	l.program.Main = &Function{}
+	for _, addr := range entries {
+		count, err := bc.ReturnCount(addr)
+		if err != nil {
+			return nil, fmt.Errorf("register backend: %w", err)
+		}
+		l.returns[addr] = count
+	}
+
+	if err := l.analyze(bc.ProgramStart, l.program.Main); err != nil {
+		return nil, err
+	}
+	for _, addr := range entries {
+		if err := l.analyze(addr, l.program.Functions[l.functions[addr]]); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.emitAll(); err != nil {
+		return nil, err
+	}
+
+	for _, addr := range entries {
+		l.program.Functions[l.functions[addr]].Entry = l.address[addr]
+	}
+	l.program.Main.Entry = l.address[bc.ProgramStart]
+	for i, instr := range l.program.Code {
+		if instr.Opcode == OpJmp || instr.Opcode == OpJmpIfFalse {
+			l.program.Code[i].A = l.address[instr.A]
+		}
+	}
+	return l.program, nil
+}
+
+// analyze computes stack depths of the function's instructions and the size of its frame
+func (l *lowering) analyze(entry int, fn *Function) error {
+	startDepth := 0
+	if fn.Info != nil {
+		startDepth = fn.Info.ParamCount
+		fn.Locals = fn.Info.ParamCount
+	}
+
+	type state struct{ addr, depth int }
+	work := []state{{entry, startDepth}}
+	for len(work) > 0 {
+		s := work[len(work)-1]
+		work = work[:len(work)-1]
+		if s.addr < 0 || s.addr >= len(l.bc.Instructions) {
+			return fmt.Errorf("register backend: jump out of the program at %d", s.addr)
+		}
+		if l.depth[s.addr] != unreachable {
+			if l.owner[s.addr] != entry {
+				return fmt.Errorf("register backend: instruction %d is shared by two functions", s.addr)
+			}
+			if l.depth[s.addr] != s.depth {
+				return fmt.Errorf("register backend: inconsistent stack depth at %d", s.addr)
+			}
+			continue
+		}
+		l.depth[s.addr] = s.depth
+		l.owner[s.addr] = entry
+
+		instr := l.bc.Instructions[s.addr].Generic()
+		effect, err := l.stackEffect(instr)
+		if err != nil {
+			return err
+		}
+		after := s.depth + effect
+		if after < 0 {
+			return fmt.Errorf("register backend: stack underflow at %d", s.addr)
+		}
+		l.maxDepth[fn] = max(l.maxDepth[fn], s.depth, after)
+		switch instr.Opcode {
+		case bytecode.OpLoad, bytecode.OpStore, bytecode.OpStoreKeep, bytecode.OpIncLocal,
+			bytecode.OpArrayAlloc, bytecode.OpArrayLoad, bytecode.OpArrayStore:
+			fn.Locals = max(fn.Locals, instr.Operands[0]+1)
+		case bytecode.OpLoadLoad:
+			fn.Locals = max(fn.Locals, instr.Operands[0]+1, instr.Operands[1]+1)
+		}
+
+		switch {
+		case instr.Opcode == bytecode.OpJmp:
+			l.targets[instr.Operands[0]] = true
+			work = append(work, state{instr.Operands[0], after})
+		case instr.IsConditionalJump():
+			l.targets[instr.Operands[0]] = true
+			work = append(work, state{instr.Operands[0], after}, state{s.addr + 1, after})
+		case !instr.IsTerminator():
+			work = append(work, state{s.addr + 1, after})
+		}
+	}
+	fn.FrameSize = fn.Locals + l.maxDepth[fn]
+	return nil
+}
+
+// stackEffect returns the change of the stack depth made by the instruction, unsupported ones are rejected
+// when they are emitted
+func (l *lowering) stackEffect(instr bytecode.Instruction) (int, error) {
+	pops, pushes, err := l.bc.StackEffect(instr, func(entry int) (int, error) { return l.returns[entry], nil })
+	if err != nil {
+		return 0, fmt.Errorf("register backend: %w", err)
+	}
+	return pushes - pops, nil
+}
+
+// emitAll lowers reachable instructions in their order, so the register code keeps the layout of the bytecode
+func (l *lowering) emitAll() error {
+	fallsThrough := false
+	for addr, instr := range l.bc.Instructions {
+		instr = instr.Generic()
+		l.address[addr] = len(l.program.Code)
+		if l.depth[addr] == unreachable {
+			fallsThrough = false
+			continue
+		}
+
+		fn := l.program.Main
+		if l.owner[addr] != l.bc.ProgramStart {
+			fn = l.program.Functions[l.functions[l.owner[addr]]]
+		}
+		l.line = instr.Line
+		switch {
+		case !fallsThrough || fn != l.current:
+			l.current = fn
+			l.resetStack(l.depth[addr])
+			l.label = len(l.program.Code)
+		case l.targets[addr]:
+			l.materializeAll()
+			l.label = len(l.program.Code)
+		}
+		l.address[addr] = len(l.program.Code)
+
+		if err := l.lower(instr); err != nil {
+			return err
+		}
+		fallsThrough = !instr.IsTerminator()
+	}
+	l.address[len(l.bc.Instructions)] = len(l.program.Code)
+	return nil
+}
+
+// lower emits register code of one stack instruction
+func (l *lowering) lower(instr bytecode.Instruction) error {
+	if op, ok := binaryOps[instr.Opcode]; ok {
+		b := l.pop()
+		a := l.pop()
+		l.push(l.emit(op, l.temp(len(l.stack)), a, b))
+		return nil
+	}
+	if op, ok := unaryOps[instr.Opcode]; ok {
+		l.push(l.emit(op, l.temp(len(l.stack)-1), l.pop(), 0))
+		return nil
+	}
+
+	switch instr.Opcode {
+	case bytecode.OpConst:
+		l.push(Constant(instr.Operands[0]))
+	case bytecode.OpLoad:
+		l.push(instr.Operands[0])
+	case bytecode.OpLoadLoad:
+		l.push(instr.Operands[0])
+		l.push(instr.Operands[1])
+	case bytecode.OpIncLocal:
+		local := instr.Operands[0]
+		l.invalidate(local, len(l.stack))
+		l.emit(OpAdd, local, local, Constant(instr.Operands[1]))
+	case bytecode.OpAddInt:
+		l.push(l.emit(OpAdd, l.temp(len(l.stack)-1), l.pop(), Constant(instr.Operands[0])))
+	case bytecode.OpPop:
+		l.pop()
+	case bytecode.OpStore:
+		l.store(instr.Operands[0], l.pop())
+	case bytecode.OpStoreKeep:
+		local := instr.Operands[0]
+		top := len(l.stack) - 1
+		if l.stack[top] != local {
+			l.store(local, l.stack[top])
+			l.stack[top] = local
+		}
+	case bytecode.OpConvert:
+		l.push(l.emit(OpConvert, l.temp(len(l.stack)-1), l.pop(), instr.Operands[0]))
+	case bytecode.OpJmp:
+		l.materializeAll()
+		l.emit(OpJmp, instr.Operands[0], 0, 0)
+	case bytecode.OpJmpIfFalse:
+		condition := l.pop()
+		l.materializeAll()
+		l.emit(OpJmpIfFalse, instr.Operands[0], condition, 0)
+	case bytecode.OpLtJmpIfFalse:
+		b := l.pop()
+		a := l.pop()
+		condition := l.emit(OpLt, l.temp(len(l.stack)), a, b)
+		l.materializeAll()
+		l.emit(OpJmpIfFalse, instr.Operands[0], condition, 0)
+	case bytecode.OpCall, bytecode.OpTailCall:
+		info := l.bc.FuncAddresses[instr.Operands[0]]
+		first := len(l.stack) - info.ParamCount
+		for i := first; i < len(l.stack); i++ {
+			l.materialize(i)
+		}
+		l.stack = l.stack[:first]
+		if instr.Opcode == bytecode.OpTailCall {
+			l.emit(OpTailCall, l.temp(first), l.functions[info.Address], 0)
+			break
+		}
+		l.emit(OpCall, l.temp(first), l.functions[info.Address], 0)
+		for i := 0; i < l.returns[info.Address]; i++ {
+			l.push(l.temp(first + i))
+		}
+	case bytecode.OpReturn:
+		count := instr.ReturnedValues()
+		if count == 1 {
+			l.emit(OpReturn, 0, l.pop(), 1)
+			break
+		}
+		first := len(l.stack) - count
+		for i := first; i < len(l.stack); i++ {
+			l.materialize(i)
+		}
+		l.emit(OpReturn, 0, l.temp(first), count)
+	case bytecode.OpReturnVoid:
+		l.emit(OpReturn, 0, 0, 0)
+	case bytecode.OpPrint:
+		l.emit(OpPrint, 0, l.pop(), 0)
+	case bytecode.OpHalt:
+		l.emit(OpHalt, 0, 0, 0)
+	case bytecode.OpArrayAlloc:
+		local := instr.Operands[0]
+		size := l.pop()
+		l.invalidate(local, len(l.stack))
+		l.emit(OpArrayAlloc, local, size, 0)
+		l.push(local)
+	case bytecode.OpArrayLoad:
+		index := l.pop()
+		l.push(l.emit(OpArrayLoad, l.temp(len(l.stack)), instr.Operands[0], index))
+	case bytecode.OpArrayStore:
+		value := l.pop()
+		index := l.pop()
+		l.emit(OpArrayStore, instr.Operands[0], index, value)
+	default:
+		return fmt.Errorf("register backend: unsupported instruction %s", instr.String())
+	}
+	return nil
+}
+
+// store assigns the operand to a local. A value computed by the previous instruction into a temporary
+// is computed directly into the local instead
+func (l *lowering) store(local, value int) {
+	l.invalidate(local, len(l.stack))
+	if value == local {
+		return
+	}
+	code := l.program.Code
+	last := len(code) - 1
+	if value >= l.current.Locals && last >= 0 && last >= l.label && code[last].A == value && writesA(code[last].Opcode) {
+		code[last].A = local
+		return
+	}
+	l.emit(OpMove, local, value, 0)
+}
+
+// writesA reports whether the instruction only writes its result to register A
+func writesA(opcode byte) bool {
+	switch opcode {
+	case OpMove, OpConvert, OpArrayLoad:
+		return true
+	}
+	_, ok := stackOpcodes[opcode]
+	return ok
+}
+
+// invalidate copies stack values that refer to the local to their temporaries before the local is changed.
+// Values from the given depth up are left alone
+func (l *lowering) invalidate(local, depth int) {
+	for i := 0; i < depth && i < len(l.stack); i++ {
+		if l.stack[i] == local {
+			l.materialize(i)
+		}
+	}
+}
+
+// materialize moves the value at the given depth to its temporary
+func (l *lowering) materialize(depth int) {
+	if temp := l.temp(depth); l.stack[depth] != temp {
+		l.emit(OpMove, temp, l.stack[depth], 0)
+		l.stack[depth] = temp
+	}
+}
+
+func (l *lowering) materializeAll() {
+	for i := range l.stack {
+		l.materialize(i)
+	}
+}
+
+// resetStack starts lowering at a merge point where every value is in its temporary
+func (l *lowering) resetStack(depth int) {
+	l.stack = l.stack[:0]
+	for i := 0; i < depth; i++ {
+		l.stack = append(l.stack, l.temp(i))
+	}
+}
+
+func (l *lowering) temp(depth int) int {
+	return l.current.Locals + depth
+}
+
+func (l *lowering) push(operand int) {
+	l.stack = append(l.stack, operand)
+}
+
+func (l *lowering) pop() int {
+	operand := l.stack[len(l.stack)-1]
+	l.stack = l.stack[:len(l.stack)-1]
+	return operand
+}
+
+// emit appends an instruction and returns its destination register
+func (l *lowering) emit(opcode byte, a, b, c int) int {
+	l.program.Code = append(l.program.Code, Instruction{Opcode: opcode, A: a, B: b, C: c, Line: l.line})
+	return a
+}
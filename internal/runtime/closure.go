@@ -0,0 +1,44 @@
+package runtime
+
+import (
+	"fmt"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+)
+
+// Closure is a function value together with the variables it captured
+type Closure struct {
+	funcInfo *bytecode2.FunctionInfo
+	upvalues []*Value
+}
+
+func (c *Closure) String() string {
+	return fmt.Sprintf("fn %s", c.funcInfo.Name)
+}
+
+// newClosure captures cells of the current frame (isLocal == 1) or upvalues of the current closure.
+// captures is a list of isLocal/index pairs following function address in CLOSURE operands
+func (vm *VM) newClosure(funcAddr int, captures []int) (*Closure, error) {
+	funcInfo, ok := vm.bytecode.FuncAddresses[funcAddr]
+	if !ok {
+		return nil, fmt.Errorf("no function at address %d", funcAddr)
+	}
+	closure := &Closure{
+		funcInfo: funcInfo,
+		upvalues: make([]*Value, 0, len(captures)/2),
+	}
+
+	currentFrame := &vm.frames[vm.fp]
+	for i := 0; i+1 < len(captures); i += 2 {
+		index := captures[i+1]
+		if captures[i] == 0 {
+			closure.upvalues = append(closure.upvalues, currentFrame.closure.upvalues[index])
+			continue
+		}
+		currentFrame.ensureLocalsSize(index + 1)
+		if currentFrame.locals[index].Kind != ValCell {
+			return nil, fmt.Errorf("captured variable %d is not a cell", index)
+		}
+		closure.upvalues = append(closure.upvalues, currentFrame.locals[index].Cell())
+	}
+	return closure, nil
+}
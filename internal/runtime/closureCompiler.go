@@ -0,0 +1,697 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+)
+
+// DefaultCompileThreshold is the number of calls after which a function is compiled to closures
+const DefaultCompileThreshold = 1000
+
+// maxCompiledDepth limits nested calls of compiled functions, each of them takes the Go stack.
+// Deeper calls are interpreted, the interpreter keeps frames in the heap
+const maxCompiledDepth = 10000
+
+// closureTier counts calls of functions and compiles hot ones to trees of Go closures
+type closureTier struct {
+	threshold int         // calls before compilation, 0 disables the tier
+	functions []tierEntry // indexed by function address
+	depth     int         // number of running compiled functions
+}
+
+type tierEntry struct {
+	calls    int
+	compiled *compiledFunction // nil until the function becomes hot or if it cannot be compiled
+}
+
+// SetCompileThreshold sets how many calls make a function hot enough to be compiled to Go closures,
+// 0 disables the compilation
+func (vm *VM) SetCompileThreshold(calls int) {
+	vm.tier.threshold = calls
+}
+
+// compiledFor counts the call of the function and returns its compiled form, nil if it is interpreted
+func (vm *VM) compiledFor(funcAddr int) *compiledFunction {
+	tier := &vm.tier
+	if tier.threshold <= 0 || tier.depth >= maxCompiledDepth {
+		return nil
+	}
+	if tier.functions == nil {
+		tier.functions = make([]tierEntry, len(vm.bytecode.Instructions))
+	}
+	if funcAddr >= len(tier.functions) {
+		return nil
+	}
+	entry := &tier.functions[funcAddr]
+	if entry.calls < tier.threshold {
+		entry.calls++
+		if entry.calls == tier.threshold {
+			info := vm.bytecode.FuncAddresses[funcAddr]
+			compiled, err := compileFunction(vm.bytecode, info)
+			if vm.jit.printInfo {
+				if err != nil {
+					fmt.Printf("INFO: Function %s is interpreted: %v\n", info.Name, err)
+				} else {
+					fmt.Printf("INFO: Compiled function %s to closures\n", info.Name)
+				}
+			}
+			entry.compiled = compiled
+		}
+	}
+	return entry.compiled
+}
+
+// compiledFunction is a function translated to closures: every basic block is a list of statements
+// evaluating expression trees and an exit choosing the next block
+type compiledFunction struct {
+	info   *bytecode2.FunctionInfo
+	locals int
+	entry  *compiledBlock
+}
+
+type compiledBlock struct {
+	body []func(*activation)
+	exit func(*activation) *compiledBlock // nil when the function returns
+}
+
+type expr func(*activation) Value
+
+// activation is the state of one call of a compiled function. Operands that outlive a statement are kept
+// in the VM stack starting at base, so calls and the GC see them as they see the interpreter's stack
+type activation struct {
+	vm          *VM
+	locals      []Value
+	base        int // stack index of the first argument
+	frame       int // index of the call's frame
+	returnCount int // number of returned values, -1 for RETURN_VOID
+}
+
+// compiledError carries an error of a compiled function out of the closures
+type compiledError struct {
+	err error
+}
+
+// fail aborts the compiled function with the error of the instruction at the line
+func fail(err error, line int) {
+	var rtErr *RuntimeError
+	if errors.As(err, &rtErr) && rtErr.Line == 0 {
+		rtErr.Line = line
+	}
+	panic(compiledError{err})
+}
+
+// runCompiled executes the compiled function in the frame just pushed for it, arguments are on top of the stack.
+// Returned values are left on the stack as by RETURN
+func (vm *VM) runCompiled(fn *compiledFunction) (err error) {
+	frameIndex := len(vm.frames) - 1
+	locals := make([]Value, fn.locals)
+	vm.frames[frameIndex].locals = locals
+	act := &activation{vm: vm, locals: locals, base: vm.sp - fn.info.ParamCount + 1, frame: frameIndex}
+
+	vm.tier.depth++
+	defer func() {
+		vm.tier.depth--
+		if r := recover(); r != nil {
+			failure, ok := r.(compiledError)
+			if !ok {
+				panic(r)
+			}
+			err = failure.err
+		}
+	}()
+	for block := fn.entry; block != nil; {
+		for _, statement := range block.body {
+			statement(act)
+		}
+		block = block.exit(act)
+	}
+	vm.leaveFrame(act.returnCount)
+	return nil
+}
+
+// callFromCompiled calls a function from compiled code and returns when it has returned. An interpreted callee
+// runs in a nested interpreter loop, errors it does not catch itself are left to the caller's handlers
+func (vm *VM) callFromCompiled(funcAddr, callIndex int) error {
+	depth := len(vm.frames)
+	if err := vm.call(funcAddr, callIndex); err != nil {
+		return err
+	}
+	for len(vm.frames) > depth && vm.ip < len(vm.bytecode.Instructions) {
+		instr := vm.bytecode.Instructions[vm.ip]
+		vm.ip++
+		err := vm.execute(instr)
+		if err == nil {
+			continue
+		}
+		var rtErr *RuntimeError
+		if !errors.As(err, &rtErr) {
+			return err
+		}
+		if rtErr.Line == 0 {
+			rtErr.Line = instr.Line
+		}
+		if len(vm.handlers) == 0 || vm.handlers[len(vm.handlers)-1].frameIndex < depth {
+			return rtErr // the handler is outside of the callee
+		}
+		if err := vm.raise(rtErr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// operand is a value of the operand stack while a block is compiled. Pure operands (constants, loads of
+// locals and values in their stack slots) may be evaluated later, others are evaluated before any statement
+type operand struct {
+	eval    expr
+	local   int  // local read by the operand, -1 if it is not a load
+	pure    bool // evaluation cannot fail and does not read memory other than locals
+	spilled bool // the value is in its stack slot
+}
+
+type closureCompiler struct {
+	bc      *bytecode2.Bytecode
+	info    *bytecode2.FunctionInfo
+	depth   map[int]int // stack depth before every reachable instruction
+	blocks  map[int]*compiledBlock
+	returns map[int]int // number of values returned by called functions
+	locals  int
+
+	block *compiledBlock // block being compiled
+	stack []operand
+	line  int
+}
+
+// compileFunction translates the function to closures. Functions using closures, cells, exceptions or tail calls
+// of other functions are not compiled and stay with the interpreter
+func compileFunction(bc *bytecode2.Bytecode, info *bytecode2.FunctionInfo) (*compiledFunction, error) {
+	c := &closureCompiler{
+		bc:      bc,
+		info:    info,
+		depth:   make(map[int]int),
+		blocks:  make(map[int]*compiledBlock),
+		returns: make(map[int]int),
+		locals:  info.ParamCount,
+	}
+	if err := c.analyze(); err != nil {
+		return nil, err
+	}
+	for start := range c.blocks {
+		if err := c.compileBlock(start); err != nil {
+			return nil, err
+		}
+	}
+	return &compiledFunction{info: info, locals: c.locals, entry: c.blocks[info.Address]}, nil
+}
+
+// analyze finds stack depths of reachable instructions and starts of basic blocks
+func (c *closureCompiler) analyze() error {
+	type state struct{ addr, depth int }
+	c.blocks[c.info.Address] = &compiledBlock{}
+	work := []state{{c.info.Address, c.info.ParamCount}}
+	for len(work) > 0 {
+		s := work[len(work)-1]
+		work = work[:len(work)-1]
+		if s.addr < 0 || s.addr >= len(c.bc.Instructions) {
+			return fmt.Errorf("jump out of the program at %d", s.addr)
+		}
+		if depth, ok := c.depth[s.addr]; ok {
+			if depth != s.depth {
+				return fmt.Errorf("inconsistent stack depth at %d", s.addr)
+			}
+			continue
+		}
+		c.depth[s.addr] = s.depth
+
+		instr := c.bc.Instructions[s.addr].Generic()
+		effect, err := c.stackEffect(instr, s.depth)
+		if err != nil {
+			return err
+		}
+		after := s.depth + effect
+		if after < 0 {
+			return fmt.Errorf("stack underflow at %d", s.addr)
+		}
+		switch instr.Opcode {
+		case bytecode2.OpLoad, bytecode2.OpStore, bytecode2.OpStoreKeep, bytecode2.OpIncLocal,
+			bytecode2.OpArrayAlloc, bytecode2.OpArrayLoad, bytecode2.OpArrayStore:
+			c.locals = max(c.locals, instr.Operands[0]+1)
+		case bytecode2.OpLoadLoad:
+			c.locals = max(c.locals, instr.Operands[0]+1, instr.Operands[1]+1)
+		}
+
+		switch {
+		case instr.Opcode == bytecode2.OpJmp:
+			c.blocks[instr.Operands[0]] = &compiledBlock{}
+			work = append(work, state{instr.Operands[0], after})
+		case instr.IsConditionalJump():
+			c.blocks[instr.Operands[0]] = &compiledBlock{}
+			c.blocks[s.addr+1] = &compiledBlock{}
+			work = append(work, state{instr.Operands[0], after}, state{s.addr + 1, after})
+		case !instr.IsTerminator():
+			work = append(work, state{s.addr + 1, after})
+		}
+	}
+	return nil
+}
+
+// stackEffect returns the change of the stack depth made by the instruction, unsupported ones are rejected
+// when their block is compiled. A tail call must call the function itself with only its arguments on the stack
+func (c *closureCompiler) stackEffect(instr bytecode2.Instruction, depth int) (int, error) {
+	if instr.Opcode == bytecode2.OpTailCall && (instr.Operands[0] != c.info.Address || depth != c.info.ParamCount) {
+		return 0, fmt.Errorf("unsupported tail call at %d", instr.Operands[0])
+	}
+	pops, pushes, err := c.bc.StackEffect(instr, c.returnCount)
+	return pushes - pops, err
+}
+
+// returnCount finds how many values the called function leaves on the stack
+func (c *closureCompiler) returnCount(entry int) (int, error) {
+	if count, ok := c.returns[entry]; ok {
+		return count, nil
+	}
+	count, err := c.bc.ReturnCount(entry)
+	if err != nil {
+		return 0, err
+	}
+	c.returns[entry] = count
+	return count, nil
+}
+
+// compileBlock translates instructions from the start to the end of the basic block
+func (c *closureCompiler) compileBlock(start int) error {
+	c.block = c.blocks[start]
+	c.stack = c.stack[:0]
+	for i := 0; i < c.depth[start]; i++ {
+		c.stack = append(c.stack, slotOperand(i))
+	}
+
+	for addr := start; ; addr++ {
+		instr := c.bc.Instructions[addr].Generic()
+		c.line = instr.Line
+		if err := c.compile(addr, instr); err != nil {
+			return err
+		}
+		if instr.IsTerminator() || instr.IsConditionalJump() {
+			return nil
+		}
+		if next, ok := c.blocks[addr+1]; ok {
+			c.materializeAll()
+			c.block.exit = func(*activation) *compiledBlock { return next }
+			return nil
+		}
+	}
+}
+
+// compile translates one instruction to operands, statements or the exit of the block
+func (c *closureCompiler) compile(addr int, instr bytecode2.Instruction) error {
+	line := c.line
+	switch instr.Opcode {
+	case bytecode2.OpConst:
+		value := constantValue(c.bc.Constants[instr.Operands[0]])
+		c.push(operand{eval: func(*activation) Value { return value }, local: -1, pure: true})
+	case bytecode2.OpLoad:
+		c.push(loadOperand(instr.Operands[0]))
+	case bytecode2.OpLoadLoad:
+		c.push(loadOperand(instr.Operands[0]))
+		c.push(loadOperand(instr.Operands[1]))
+	case bytecode2.OpStore:
+		local, value := instr.Operands[0], c.pop().eval
+		c.write(local)
+		c.statement(func(a *activation) { a.locals[local] = value(a) })
+	case bytecode2.OpStoreKeep:
+		local, value := instr.Operands[0], c.pop().eval
+		c.write(local)
+		c.statement(func(a *activation) { a.locals[local] = value(a) })
+		c.push(loadOperand(local))
+	case bytecode2.OpIncLocal:
+		local, step := instr.Operands[0], constantValue(c.bc.Constants[instr.Operands[1]])
+		c.write(local)
+		c.statement(func(a *activation) {
+			value := a.locals[local]
+			if value.Kind == ValInt && step.Kind == ValInt && !a.vm.overflowChecks {
+				a.locals[local] = IntValue(value.Int() + step.Int())
+				return
+			}
+			a.locals[local] = a.binary(bytecode2.OpAdd, value, step, line)
+		})
+	case bytecode2.OpPop:
+		if popped := c.pop(); !popped.pure {
+			c.statement(func(a *activation) { popped.eval(a) })
+		}
+	case bytecode2.OpPrint:
+		value := c.pop().eval
+		c.statement(func(a *activation) { fmt.Fprintln(a.vm.out, value(a).Interface()) })
+
+	case bytecode2.OpAdd, bytecode2.OpSub, bytecode2.OpMul, bytecode2.OpDiv, bytecode2.OpMod,
+		bytecode2.OpEq, bytecode2.OpNeq, bytecode2.OpLt, bytecode2.OpLe, bytecode2.OpGt, bytecode2.OpGe,
+		bytecode2.OpAnd, bytecode2.OpOr:
+		right := c.pop().eval
+		left := c.pop().eval
+		c.push(operand{eval: binaryExpr(instr.Opcode, left, right, line), local: -1})
+	case bytecode2.OpAddInt:
+		left := c.pop().eval
+		right := constantValue(c.bc.Constants[instr.Operands[0]])
+		c.push(operand{eval: func(a *activation) Value {
+			x := left(a)
+			if x.Kind == ValInt && !a.vm.overflowChecks {
+				return IntValue(x.Int() + right.Int())
+			}
+			return a.binary(bytecode2.OpAdd, x, right, line)
+		}, local: -1})
+	case bytecode2.OpNeg, bytecode2.OpNot, bytecode2.OpSqrt:
+		c.push(operand{eval: unaryExpr(instr.Opcode, c.pop().eval, line), local: -1})
+	case bytecode2.OpConvert:
+		value, target := c.pop().eval, instr.Operands[0]
+		c.push(operand{eval: func(a *activation) Value {
+			converted, err := convert(value(a), target)
+			if err != nil {
+				fail(err, line)
+			}
+			return converted
+		}, local: -1})
+
+	case bytecode2.OpArrayAlloc:
+		local, size := instr.Operands[0], c.pop().eval
+		c.write(local)
+		c.statement(func(a *activation) {
+			length := size(a)
+			if length.Kind != ValInt {
+				fail(runtimeErrorf(ErrType, "ARRAY_ALLOC expected int size"), line)
+			}
+			a.locals[local] = heapPtrValue(a.vm.allocArray(length.Int()))
+		})
+		c.push(loadOperand(local))
+	case bytecode2.OpArrayLoad:
+		local, index := instr.Operands[0], c.pop().eval
+		c.push(operand{eval: func(a *activation) Value {
+			i := index(a)
+			array, err := a.vm.localArray(a.locals[local], i, "ARRAY_LOAD")
+			if err != nil {
+				fail(err, line)
+			}
+			return array.Array[i.Int()]
+		}, local: -1})
+	case bytecode2.OpArrayStore:
+		local := instr.Operands[0]
+		value := c.pop().eval
+		index := c.pop().eval
+		c.statement(func(a *activation) {
+			i := index(a)
+			data := value(a)
+			array, err := a.vm.localArray(a.locals[local], i, "ARRAY_STORE")
+			if err != nil {
+				fail(err, line)
+			}
+			array.store(i.Int(), data)
+		})
+	case bytecode2.OpArrayLoadIndirect:
+		index := c.pop().eval
+		pointer := c.pop().eval
+		c.push(operand{eval: func(a *activation) Value {
+			p, i := pointer(a), index(a)
+			if i.Kind != ValInt {
+				fail(runtimeErrorf(ErrType, "ARRAY_LOAD_INDIRECT expected int index"), line)
+			}
+			array, err := a.vm.arrayAt(p, i.Int())
+			if err != nil {
+				fail(err, line)
+			}
+			return array.Array[i.Int()]
+		}, local: -1})
+	case bytecode2.OpArrayStoreIndirect:
+		value := c.pop().eval
+		index := c.pop().eval
+		pointer := c.pop().eval
+		c.statement(func(a *activation) {
+			p, i, data := pointer(a), index(a), value(a)
+			if i.Kind != ValInt {
+				fail(runtimeErrorf(ErrType, "ARRAY_STORE_INDIRECT expected int index"), line)
+			}
+			array, err := a.vm.arrayAt(p, i.Int())
+			if err != nil {
+				fail(err, line)
+			}
+			array.store(i.Int(), data)
+		})
+
+	case bytecode2.OpCall:
+		funcAddr := instr.Operands[0]
+		callee := c.bc.FuncAddresses[funcAddr]
+		c.materializeAll()
+		first := len(c.stack) - callee.ParamCount
+		top, returned := len(c.stack)-1, c.returns[funcAddr]
+		c.statement(func(a *activation) {
+			a.vm.sp = a.base + top
+			if err := a.vm.callFromCompiled(funcAddr, addr); err != nil {
+				fail(err, line)
+			}
+			if a.vm.sp != a.base+top-callee.ParamCount+returned {
+				fail(fmt.Errorf("function %s left %d values on the stack instead of %d",
+					callee.Name, a.vm.sp-(a.base+top-callee.ParamCount), returned), line)
+			}
+		})
+		c.stack = c.stack[:first]
+		for i := 0; i < returned; i++ {
+			c.push(slotOperand(len(c.stack)))
+		}
+
+	case bytecode2.OpJmp:
+		c.materializeAll()
+		target := c.blocks[instr.Operands[0]]
+		c.block.exit = func(*activation) *compiledBlock { return target }
+	case bytecode2.OpJmpIfFalse:
+		condition := c.pop().eval
+		c.materializeAll()
+		target, next := c.blocks[instr.Operands[0]], c.blocks[addr+1]
+		c.block.exit = func(a *activation) *compiledBlock {
+			if isTruthy(condition(a)) {
+				return next
+			}
+			return target
+		}
+	case bytecode2.OpLtJmpIfFalse:
+		right := c.pop().eval
+		left := c.pop().eval
+		c.materializeAll()
+		target, next := c.blocks[instr.Operands[0]], c.blocks[addr+1]
+		c.block.exit = func(a *activation) *compiledBlock {
+			x, y := left(a), right(a)
+			if x.Kind == ValInt && y.Kind == ValInt {
+				if x.Int() < y.Int() {
+					return next
+				}
+				return target
+			}
+			if a.binary(bytecode2.OpLt, x, y, line).Bool() {
+				return next
+			}
+			return target
+		}
+	case bytecode2.OpReturn, bytecode2.OpReturnVoid:
+		count := -1
+		if instr.Opcode == bytecode2.OpReturn {
+			count = instr.ReturnedValues()
+		}
+		c.materializeAll()
+		top := len(c.stack) - 1
+		c.block.exit = func(a *activation) *compiledBlock {
+			a.vm.sp = a.base + top
+			a.returnCount = count
+			return nil
+		}
+	case bytecode2.OpTailCall:
+		c.materializeAll()
+		entry, paramCount := c.blocks[c.info.Address], c.info.ParamCount
+		c.block.exit = func(a *activation) *compiledBlock {
+			vm := a.vm
+			vm.sp = a.base + paramCount - 1
+			// The frame is left as on return, arguments of the next call are on the stack
+			vm.gc.Collect(vm.heap, vm.frames, vm.stack[:vm.sp+1], a.frame)
+			vm.dropHandlers(a.frame)
+			frame := &vm.frames[a.frame]
+			frame.elided++
+			clear(a.locals)
+			return entry
+		}
+	default:
+		return fmt.Errorf("unsupported instruction %s", instr.String())
+	}
+	return nil
+}
+
+func (c *closureCompiler) push(op operand) {
+	c.stack = append(c.stack, op)
+}
+
+func (c *closureCompiler) pop() operand {
+	op := c.stack[len(c.stack)-1]
+	c.stack = c.stack[:len(c.stack)-1]
+	return op
+}
+
+// statement appends a statement to the block. Impure operands below are evaluated first, so errors
+// and reads of arrays happen in the order of the bytecode
+func (c *closureCompiler) statement(s func(*activation)) {
+	for i, op := range c.stack {
+		if !op.pure {
+			c.materialize(i)
+		}
+	}
+	c.block.body = append(c.block.body, s)
+}
+
+// write evaluates loads of the local before a statement changes it
+func (c *closureCompiler) write(local int) {
+	for i, op := range c.stack {
+		if op.local == local {
+			c.materialize(i)
+		}
+	}
+}
+
+// materialize evaluates the operand at the depth to its stack slot
+func (c *closureCompiler) materialize(depth int) {
+	op := c.stack[depth]
+	if op.spilled {
+		return
+	}
+	c.block.body = append(c.block.body, func(a *activation) { a.vm.stack[a.base+depth] = op.eval(a) })
+	c.stack[depth] = slotOperand(depth)
+}
+
+// materializeAll moves every operand to its slot before a call or the end of the block
+func (c *closureCompiler) materializeAll() {
+	for i := range c.stack {
+		c.materialize(i)
+	}
+}
+
+func loadOperand(local int) operand {
+	return operand{eval: func(a *activation) Value { return a.locals[local] }, local: local, pure: true}
+}
+
+// slotOperand reads the operand at the depth from its stack slot
+func slotOperand(depth int) operand {
+	return operand{eval: func(a *activation) Value { return a.vm.stack[a.base+depth] }, local: -1, pure: true, spilled: true}
+}
+
+// binary evaluates an operator with the checks of the interpreter, errors abort the function
+func (a *activation) binary(opcode byte, x, y Value, line int) Value {
+	result, err := a.vm.binary(opcode, x, y)
+	if err != nil {
+		fail(err, line)
+	}
+	return result
+}
+
+// binaryExpr returns the expression of the operator, int and float operands of the frequent ones
+// are computed without calling VM.binary
+func binaryExpr(opcode byte, left, right expr, line int) expr {
+	switch opcode {
+	case bytecode2.OpAdd:
+		return func(a *activation) Value {
+			x, y := left(a), right(a)
+			if x.Kind == ValInt && y.Kind == ValInt && !a.vm.overflowChecks {
+				return IntValue(x.Int() + y.Int())
+			}
+			if x.Kind == ValFloat && y.Kind == ValFloat {
+				return FloatValue(x.Float() + y.Float())
+			}
+			return a.binary(opcode, x, y, line)
+		}
+	case bytecode2.OpSub:
+		return func(a *activation) Value {
+			x, y := left(a), right(a)
+			if x.Kind == ValInt && y.Kind == ValInt && !a.vm.overflowChecks {
+				return IntValue(x.Int() - y.Int())
+			}
+			if x.Kind == ValFloat && y.Kind == ValFloat {
+				return FloatValue(x.Float() - y.Float())
+			}
+			return a.binary(opcode, x, y, line)
+		}
+	case bytecode2.OpMul:
+		return func(a *activation) Value {
+			x, y := left(a), right(a)
+			if x.Kind == ValInt && y.Kind == ValInt && !a.vm.overflowChecks {
+				return IntValue(x.Int() * y.Int())
+			}
+			if x.Kind == ValFloat && y.Kind == ValFloat {
+				return FloatValue(x.Float() * y.Float())
+			}
+			return a.binary(opcode, x, y, line)
+		}
+	case bytecode2.OpDiv:
+		return func(a *activation) Value {
+			x, y := left(a), right(a)
+			if x.Kind == ValFloat && y.Kind == ValFloat && y.Float() != 0 {
+				return FloatValue(x.Float() / y.Float())
+			}
+			return a.binary(opcode, x, y, line)
+		}
+	case bytecode2.OpLt:
+		return func(a *activation) Value {
+			x, y := left(a), right(a)
+			if x.Kind == ValInt && y.Kind == ValInt {
+				return BoolValue(x.Int() < y.Int())
+			}
+			return a.binary(opcode, x, y, line)
+		}
+	case bytecode2.OpLe:
+		return func(a *activation) Value {
+			x, y := left(a), right(a)
+			if x.Kind == ValInt && y.Kind == ValInt {
+				return BoolValue(x.Int() <= y.Int())
+			}
+			return a.binary(opcode, x, y, line)
+		}
+	case bytecode2.OpGt:
+		return func(a *activation) Value {
+			x, y := left(a), right(a)
+			if x.Kind == ValInt && y.Kind == ValInt {
+				return BoolValue(x.Int() > y.Int())
+			}
+			return a.binary(opcode, x, y, line)
+		}
+	case bytecode2.OpGe:
+		return func(a *activation) Value {
+			x, y := left(a), right(a)
+			if x.Kind == ValInt && y.Kind == ValInt {
+				return BoolValue(x.Int() >= y.Int())
+			}
+			return a.binary(opcode, x, y, line)
+		}
+	default:
+		return func(a *activation) Value {
+			x, y := left(a), right(a)
+			return a.binary(opcode, x, y, line)
+		}
+	}
+}
+
+// unaryExpr returns the expression of unary minus, logical NOT or square root
+func unaryExpr(opcode byte, value expr, line int) expr {
+	if opcode == bytecode2.OpSqrt {
+		return func(a *activation) Value {
+			v := value(a)
+			if v.Kind == ValFloat {
+				return FloatValue(math.Sqrt(v.Float()))
+			}
+			result, err := a.vm.unary(opcode, v)
+			if err != nil {
+				fail(err, line)
+			}
+			return result
+		}
+	}
+	return func(a *activation) Value {
+		result, err := a.vm.unary(opcode, value(a))
+		if err != nil {
+			fail(err, line)
+		}
+		return result
+	}
+}
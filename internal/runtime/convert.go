@@ -0,0 +1,172 @@
+package runtime
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+)
+
+// convert performs explicit type conversion, integers wrap around (bigint keeps low 64 bits) and floats are truncated,
+// NaN, infinities and floats out of the range of the integer type cannot be converted. Strings are parsed as numbers
+// and bools, bools convert to 0 and 1
+func convert(value Value, target int) (Value, error) {
+	switch target {
+	case bytecode2.ConvertInt:
+		switch value.Kind {
+		case ValInt:
+			return value, nil
+		case ValUint:
+			return IntValue(int(value.Uint())), nil
+		case ValFloat:
+			// NaN, infinities and floats out of range have no int value, Go leaves the cast to the platform
+			if v := value.Float(); v >= math.MinInt64 && v < -math.MinInt64 {
+				return IntValue(int(v)), nil
+			}
+		case ValBigInt:
+			return IntValue(int(value.BigInt().Int64())), nil
+		case ValBool:
+			return IntValue(boolToInt(value.Bool())), nil
+		case ValString:
+			if n, err := strconv.ParseInt(value.Str(), 10, 64); err == nil {
+				return IntValue(int(n)), nil
+			}
+		}
+	case bytecode2.ConvertUint:
+		switch value.Kind {
+		case ValInt:
+			return UintValue(uint64(value.Int())), nil
+		case ValUint:
+			return value, nil
+		case ValFloat:
+			if v := value.Float(); v > -1 && v < math.MaxUint64+1 {
+				return UintValue(uint64(v)), nil
+			}
+		case ValBigInt:
+			return UintValue(value.BigInt().Uint64()), nil
+		case ValBool:
+			return UintValue(uint64(boolToInt(value.Bool()))), nil
+		case ValString:
+			if n, err := strconv.ParseUint(value.Str(), 10, 64); err == nil {
+				return UintValue(n), nil
+			}
+		}
+	case bytecode2.ConvertFloat:
+		switch value.Kind {
+		case ValInt:
+			return FloatValue(float64(value.Int())), nil
+		case ValUint:
+			return FloatValue(float64(value.Uint())), nil
+		case ValFloat:
+			return value, nil
+		case ValBigInt:
+			f, _ := new(big.Float).SetInt(value.BigInt()).Float64()
+			return FloatValue(f), nil
+		case ValBool:
+			return FloatValue(float64(boolToInt(value.Bool()))), nil
+		case ValString:
+			if f, err := strconv.ParseFloat(value.Str(), 64); err == nil {
+				return FloatValue(f), nil
+			}
+		}
+	case bytecode2.ConvertString:
+		switch value.Kind {
+		case ValInt, ValUint, ValFloat, ValBool, ValString, ValBigInt:
+			return StringValue(fmt.Sprint(value.Interface())), nil
+		}
+	case bytecode2.ConvertBool:
+		switch value.Kind {
+		case ValInt, ValUint, ValFloat, ValBool, ValBigInt:
+			return BoolValue(isTruthy(value)), nil
+		case ValString:
+			if b, err := strconv.ParseBool(value.Str()); err == nil {
+				return BoolValue(b), nil
+			}
+		}
+	case bytecode2.ConvertBigInt:
+		switch value.Kind {
+		case ValInt:
+			return BigIntValue(big.NewInt(int64(value.Int()))), nil
+		case ValUint:
+			return BigIntValue(new(big.Int).SetUint64(value.Uint())), nil
+		case ValFloat:
+			if v := value.Float(); !math.IsInf(v, 0) && !math.IsNaN(v) {
+				n, _ := big.NewFloat(v).Int(nil)
+				return BigIntValue(n), nil
+			}
+		case ValBigInt:
+			return value, nil
+		case ValBool:
+			return BigIntValue(big.NewInt(int64(boolToInt(value.Bool())))), nil
+		case ValString:
+			if n, ok := new(big.Int).SetString(value.Str(), 10); ok {
+				return BigIntValue(n), nil
+			}
+		}
+	}
+	return Value{}, runtimeErrorf(ErrType, "cannot convert %v to %s", value.Interface(), conversionNames[target])
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var conversionNames = map[int]string{
+	bytecode2.ConvertInt:    "int",
+	bytecode2.ConvertUint:   "uint",
+	bytecode2.ConvertFloat:  "float",
+	bytecode2.ConvertString: "string",
+	bytecode2.ConvertBool:   "bool",
+	bytecode2.ConvertBigInt: "bigint",
+}
+
+// kindName names the dynamic type of a value in runtime errors
+func kindName(value Value) string {
+	switch value.Kind {
+	case ValInt:
+		return "int"
+	case ValUint:
+		return "uint"
+	case ValFloat:
+		return "float"
+	case ValString:
+		return "string"
+	case ValBool:
+		return "bool"
+	case ValBigInt:
+		return "bigint"
+	case ValNil:
+		return "nil"
+	case ValHeapPtr:
+		return "array"
+	case ValClosure:
+		return "function"
+	case ValError:
+		return "error"
+	default:
+		return "value"
+	}
+}
+
+// checkOperands returns a type error unless both operands are numbers of the same kind
+func checkOperands(a, b Value, op string) error {
+	if !a.IsNumber() {
+		return runtimeErrorf(ErrType, "invalid operand %s for %s", kindName(a), op)
+	}
+	if a.Kind != b.Kind {
+		return runtimeErrorf(ErrType, "mismatched operand types %s and %s for %s", kindName(a), kindName(b), op)
+	}
+	return nil
+}
+
+// checkComparable returns a type error if operands have different kinds
+func checkComparable(a, b Value, op string) error {
+	if kindName(a) != kindName(b) {
+		return runtimeErrorf(ErrType, "mismatched operand types %s and %s for %s", kindName(a), kindName(b), op)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errHalt stops the execution loop on HALT
+var errHalt = errors.New("halt")
+
+type ErrorKind int
+
+const (
+	ErrThrown         ErrorKind = iota // value thrown by `throw`
+	ErrBounds                          // array index out of range
+	ErrDivisionByZero                  // integer division or modulo by zero
+	ErrType                            // operation applied to a value of a wrong type
+	ErrOverflow                        // int overflow when overflow checks are enabled
+)
+
+var errorKindNames = map[ErrorKind]string{
+	ErrThrown:         "exception",
+	ErrBounds:         "bounds error",
+	ErrDivisionByZero: "division by zero",
+	ErrType:           "type error",
+	ErrOverflow:       "integer overflow",
+}
+
+func (k ErrorKind) String() string {
+	return errorKindNames[k]
+}
+
+// RuntimeError is a catchable error: it is raised by `throw` or by a failed built-in operation.
+// The `catch` variable gets the thrown value or the error itself
+type RuntimeError struct {
+	Kind    ErrorKind
+	Message string
+	Line    int   // source line of the failed instruction, 0 if unknown
+	Value   Value // thrown value (only for ErrThrown)
+
+	trace []traceFrame // call stack when the error was left uncaught, innermost first
+}
+
+// traceFrame is a function of the call stack and the line it was executing
+type traceFrame struct {
+	name   string
+	line   int
+	elided int // tail calls that reused the frame
+}
+
+// StackTrace formats the call stack of an uncaught error, empty if the error was caught
+func (e *RuntimeError) StackTrace() string {
+	var sb strings.Builder
+	for _, frame := range e.trace {
+		sb.WriteString(fmt.Sprintf("  in %s", frame.name))
+		if frame.line > 0 {
+			sb.WriteString(fmt.Sprintf(" at line %d", frame.line))
+		}
+		if frame.elided > 0 {
+			sb.WriteString(fmt.Sprintf(" (%d tail calls elided)", frame.elided))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func runtimeErrorf(kind ErrorKind, format string, args ...interface{}) *RuntimeError {
+	return &RuntimeError{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+	}
+	return fmt.Sprintf("%s: %s at line %d", e.Kind, e.Message, e.Line)
+}
+
+// handler is an active try block
+type handler struct {
+	target     int // address of the catch block
+	frameIndex int // frame that executes the try block
+	sp         int // stack pointer on entering the try block
+}
+
+// raise passes the error to the innermost active handler: frames above the handler's one are
+// unwound (their arrays are collected) and the value for the catch block is pushed: the value given to
+// `throw` or the error of a failed operation
+func (vm *VM) raise(rtErr *RuntimeError) error {
+	if len(vm.handlers) == 0 {
+		rtErr.trace = vm.stackTrace(rtErr.Line)
+		return rtErr
+	}
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+	vm.sp = h.sp
+	if rtErr.Kind == ErrThrown {
+		vm.push(rtErr.Value)
+	} else {
+		vm.push(errorValue(rtErr))
+	}
+
+	for len(vm.frames)-1 > h.frameIndex {
+		frameIndex := len(vm.frames) - 1
+		if frame := vm.frames[frameIndex]; vm.jitEnabled && frame.entryArgs != nil {
+			vm.jit.NotifyUnwind(frame.funcInfo.Address, frame.entryArgs, vm.heap)
+		}
+		vm.gc.Collect(vm.heap, vm.frames, vm.stack[:vm.sp+1], frameIndex)
+		vm.frames = vm.frames[:frameIndex]
+	}
+	vm.fp = h.frameIndex
+	vm.ip = h.target
+	return nil
+}
+
+// stackTrace lists active frames, a caller's line is taken from its call instruction
+func (vm *VM) stackTrace(line int) []traceFrame {
+	trace := make([]traceFrame, 0, len(vm.frames))
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		name := "main"
+		if frame.funcInfo != nil {
+			name = frame.funcInfo.Name
+		}
+		trace = append(trace, traceFrame{name: name, line: line, elided: frame.elided})
+		line = vm.callLine(frame.returnIP)
+	}
+	return trace
+}
+
+// callLine returns the source line of the call instruction preceding the return address
+func (vm *VM) callLine(returnIP int) int {
+	if vm.registers != nil {
+		if returnIP > 0 && returnIP <= len(vm.registers.Code) {
+			return vm.registers.Code[returnIP-1].Line
+		}
+		return 0
+	}
+	if returnIP > 0 && returnIP <= len(vm.bytecode.Instructions) {
+		return vm.bytecode.Instructions[returnIP-1].Line
+	}
+	return 0
+}
+
+// dropHandlers removes handlers of try blocks left by returning from the frame
+func (vm *VM) dropHandlers(frameIndex int) {
+	for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].frameIndex >= frameIndex {
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	}
+}
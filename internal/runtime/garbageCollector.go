@@ -1,29 +1,105 @@
 package runtime
 
 type GarbageCollector struct {
+	freed func(*Array) // called for every freed array
 }
 
-func (gc *GarbageCollector) Collect(heap []*Array, frames []Frame, removedFrameIndex int) {
+// Collect frees arrays reachable from the removed frame that are not reachable from other frames or the stack.
+// Reachability is traced through arrays' elements, cells and variables captured by closures
+func (gc *GarbageCollector) Collect(heap []*Array, frames []Frame, stack []Value, removedFrameIndex int) {
+	if !holdsReferences(frames[removedFrameIndex].locals) {
+		return
+	}
+
+	removedPtrs := make(map[int]struct{})
+	removedVisited := make(map[*Value]struct{})
+	for _, valueToDelete := range frames[removedFrameIndex].locals {
+		gc.mark(heap, valueToDelete, removedPtrs, removedVisited)
+	}
+	if len(removedPtrs) == 0 {
+		return
+	}
+
+	// The callers usually hold the arrays of the removed frame, frames are traced from the nearest caller
+	// and tracing stops as soon as every array of the removed frame is reachable
 	markActivePtrs := make(map[int]struct{})
-	for i, frame := range frames {
+	visited := make(map[*Value]struct{})
+	for _, value := range stack {
+		gc.mark(heap, value, markActivePtrs, visited)
+	}
+	for i := len(frames) - 1; i >= 0 && !reachable(removedPtrs, markActivePtrs); i-- {
 		if i == removedFrameIndex {
 			continue
 		}
-		for _, local := range frame.locals {
-			if local.Type != ValHeapPtr {
-				continue
-			}
-			markActivePtrs[local.Data.(int)] = struct{}{}
+		for _, local := range frames[i].locals {
+			gc.mark(heap, local, markActivePtrs, visited)
+		}
+		if frames[i].closure != nil {
+			gc.mark(heap, closureValue(frames[i].closure), markActivePtrs, visited)
 		}
 	}
 
-	for _, valueToDelete := range frames[removedFrameIndex].locals {
-		if valueToDelete.Type != ValHeapPtr {
-			continue
-		}
-		ptr := valueToDelete.Data.(int)
+	for ptr := range removedPtrs {
 		if _, ok := markActivePtrs[ptr]; !ok {
+			if heap[ptr] != nil && gc.freed != nil {
+				gc.freed(heap[ptr])
+			}
 			heap[ptr] = nil
 		}
 	}
 }
+
+// reachable reports whether all pointers are among the marked ones
+func reachable(ptrs, marked map[int]struct{}) bool {
+	if len(marked) < len(ptrs) {
+		return false
+	}
+	for ptr := range ptrs {
+		if _, ok := marked[ptr]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// mark adds heap pointers reachable from the value to ptrs
+func (gc *GarbageCollector) mark(heap []*Array, value Value, ptrs map[int]struct{}, visited map[*Value]struct{}) {
+	switch value.Kind {
+	case ValHeapPtr:
+		ptr := value.HeapPtr()
+		if _, ok := ptrs[ptr]; ok {
+			return
+		}
+		ptrs[ptr] = struct{}{}
+		if ptr < len(heap) && heap[ptr] != nil && heap[ptr].refs {
+			for _, element := range heap[ptr].Array {
+				gc.mark(heap, element, ptrs, visited)
+			}
+		}
+	case ValCell:
+		gc.markCell(heap, value.Cell(), ptrs, visited)
+	case ValClosure:
+		for _, cell := range value.Closure().upvalues {
+			gc.markCell(heap, cell, ptrs, visited)
+		}
+	case ValError:
+		gc.mark(heap, value.Err().Value, ptrs, visited)
+	}
+}
+
+func (gc *GarbageCollector) markCell(heap []*Array, cell *Value, ptrs map[int]struct{}, visited map[*Value]struct{}) {
+	if _, ok := visited[cell]; ok {
+		return // cycle: closure captured the cell it is stored in
+	}
+	visited[cell] = struct{}{}
+	gc.mark(heap, *cell, ptrs, visited)
+}
+
+func holdsReferences(locals []Value) bool {
+	for _, local := range locals {
+		if local.holdsReference() {
+			return true
+		}
+	}
+	return false
+}
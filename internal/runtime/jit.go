@@ -1,232 +1,347 @@
 package runtime
 
 import (
+	"container/list"
+	"encoding/binary"
 	"fmt"
+	"slices"
+	"time"
+	"twin-peaks-programming-language/internal/analysis"
 	"twin-peaks-programming-language/internal/bytecode"
 )
 
+// Default limits of the JIT's cache of call results
+const (
+	DefaultMemoFunctionLimit = 4096  // cached calls of one function
+	DefaultMemoLimit         = 65536 // cached calls of all functions
+)
+
 type FuncKind int
 
 const (
-	FuncJITCompiled           FuncKind = iota
-	FuncPendingCompiledReturn          // waiting for return value to cache
-	FuncCallingDynamic                 // may be compiled if all child functions become compiled
+	FuncJITCompiled           FuncKind = iota // some calls are cached
+	FuncPendingCompiledReturn                 // waiting for return value to cache
 	FuncDynamic
 )
 
+var funcKindNames = map[FuncKind]string{
+	FuncJITCompiled:           "compiled",
+	FuncPendingCompiledReturn: "pending",
+	FuncDynamic:               "dynamic",
+}
+
+func (k FuncKind) String() string {
+	return funcKindNames[k]
+}
+
+func (k FuncKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
 type funcJITInfo struct {
-	Kind        FuncKind
-	CachedCalls []*callInfo
+	Kind    FuncKind
+	calls   map[string]*callInfo // cached calls by argumentsKey
+	recent  *list.List           // cached calls, the most recently used first
+	pending map[string]time.Time // keys of running calls and their start, results are cached on return
+	// keys of cached calls re-executed by the interpreter and their cached results, compared on return
+	verifying map[string][]Value
+
+	hits        int
+	misses      int           // calls executed to cache their results
+	uncacheable int           // calls with arguments that cannot be cached
+	evicted     int           // calls removed from the cache
+	loaded      int           // calls preloaded from a memo cache file
+	saved       time.Duration // execution time of cached calls returned by hits
+	verified    int           // cached calls compared with the interpreter
+	demoted     bool          // cached results differed from the interpreter, the function is not cached anymore
 }
 
 type callInfo struct {
-	compiledAddress int
-	args            []Value
-	result          Value
+	function *funcJITInfo
+	key      string
+	args     []Value
+	results  []Value       // empty for void functions
+	cost     time.Duration // execution time of the call
+	arrays   []uint64      // ids of arrays among the arguments
+	global   *list.Element // position in JITCompiler.recent
+	local    *list.Element // position in funcJITInfo.recent
 }
 
-func (ci *callInfo) Equal(other callInfo) bool {
-	if len(ci.args) != len(other.args) {
-		return false
-	}
-	for i := range ci.args {
-		if ci.args[i] != other.args[i] {
-			return false
-		}
+func resultsData(results []Value) []interface{} {
+	data := make([]interface{}, len(results))
+	for i, result := range results {
+		data[i] = result.Interface()
 	}
-	return true
+	return data
 }
 
-func findCallInfo(callInfos []*callInfo, target callInfo) (*callInfo, int) {
-	for i, ci := range callInfos {
-		if ci.Equal(target) {
-			return ci, i
+// argumentsKey encodes arguments as a cache key, ok is false if the call cannot be cached: closures, cells
+// and errors are compared by identity. An array is encoded by its identity and version, so the key changes
+// when the array is modified, arrays referring to other arrays cannot be cached as their elements may change
+func argumentsKey(args []Value, heap []*Array) (key string, ok bool) {
+	encoded := make([]byte, 0, 9*len(args))
+	for _, arg := range args {
+		encoded = append(encoded, byte(arg.Kind))
+		switch arg.Kind {
+		case ValNil, ValInt, ValUint, ValFloat, ValBool:
+			encoded = binary.LittleEndian.AppendUint64(encoded, arg.bits)
+		case ValString:
+			encoded = binary.AppendUvarint(encoded, uint64(len(arg.Str())))
+			encoded = append(encoded, arg.Str()...)
+		case ValBigInt:
+			text := arg.BigInt().Append(nil, 16)
+			encoded = binary.AppendUvarint(encoded, uint64(len(text)))
+			encoded = append(encoded, text...)
+		case ValHeapPtr:
+			if arg.HeapPtr() >= len(heap) || heap[arg.HeapPtr()] == nil || heap[arg.HeapPtr()].refs {
+				return "", false
+			}
+			array := heap[arg.HeapPtr()]
+			encoded = binary.AppendUvarint(encoded, array.id)
+			encoded = binary.AppendUvarint(encoded, array.version)
+		default:
+			return "", false
 		}
 	}
-	return nil, 0
+	return string(encoded), true
+}
+
+// persistent reports whether the values do not refer to the heap, so they can be saved to a memo cache file
+func persistent(values []Value) bool {
+	return !slices.ContainsFunc(values, func(value Value) bool { return value.Kind == ValHeapPtr })
 }
 
 type FuncAddress int
 
+// JITCompiler caches results of calls of pure functions and functions that only read arrays. The cache is bounded per function and in total,
+// the least recently used calls are evicted first
 type JITCompiler struct {
 	bytecode      *bytecode.Bytecode
 	seenFunctions map[FuncAddress]*funcJITInfo
-	pendingReturn map[FuncAddress][]*callInfo
+	recent        *list.List        // cached calls of all functions, the most recently used first
+	stubs         map[int]int       // address of the stub returning the given number of cached values
+	effects       *analysis.Effects // only pure and read-only functions are cached
+	functionLimit int               // 0 is unlimited
+	limit         int               // 0 is unlimited
+	verifyEvery   int               // every n-th hit is verified by the interpreter, 0 disables verification
+	sampledHits   int
+	discrepancies []JITDiscrepancy
 	printInfo     bool
+
+	// cached calls by ids of arrays among their arguments, they are removed when the GC frees the array
+	arrayCalls map[uint64]map[*callInfo]struct{}
 }
 
 func NewJITCompiler(bytecode *bytecode.Bytecode, printInfo bool) *JITCompiler {
 	return &JITCompiler{
 		bytecode:      bytecode,
 		seenFunctions: make(map[FuncAddress]*funcJITInfo),
-		pendingReturn: make(map[FuncAddress][]*callInfo),
+		recent:        list.New(),
+		stubs:         make(map[int]int),
+		arrayCalls:    make(map[uint64]map[*callInfo]struct{}),
+		effects:       analysis.Analyze(bytecode),
+		functionLimit: DefaultMemoFunctionLimit,
+		limit:         DefaultMemoLimit,
 		printInfo:     printInfo,
 	}
 }
 
-// GetCompiledAddress tries to compile the function at the given call instruction index and returns address of next instruction
-// Returned address is either the compiled function address or the original function address if it cannot be compiled
-func (jit *JITCompiler) GetCompiledAddress(callInstructionIndex int, args []Value) (FuncKind, int) {
-	funcAddr := FuncAddress(getCallAddress(jit.bytecode.Instructions[callInstructionIndex]))
-	currentCallInfo := callInfo{args: args}
-	if funcAddr == -1 {
-		return FuncDynamic, int(funcAddr) // error
-	}
-
-	if info, ok := jit.seenFunctions[funcAddr]; ok {
-		switch info.Kind {
-		case FuncDynamic:
-			return FuncDynamic, int(funcAddr) // already known to be dynamic
-		case FuncCallingDynamic:
-			// worth checking again (maybe child functions are compiled now)
-		case FuncPendingCompiledReturn:
-			if inf, _ := findCallInfo(info.CachedCalls, currentCallInfo); inf != nil {
-				return FuncPendingCompiledReturn, int(funcAddr) // Already has pending compilation for these arguments
-			}
-			jit.pendingReturn[funcAddr] = append(jit.pendingReturn[funcAddr], &currentCallInfo)
-			return FuncDynamic, int(funcAddr)
-		case FuncJITCompiled:
-			for _, call := range info.CachedCalls {
-				if call.Equal(currentCallInfo) {
-					if jit.printInfo {
-						fmt.Printf("INFO: Using cached compiled function %s(%v) -> %v at address %d\n", jit.bytecode.FuncAddresses[int(funcAddr)].Name, call.args, call.result.Data, call.compiledAddress)
-					}
-					return FuncJITCompiled, call.compiledAddress
-				}
-			}
-			jit.pendingReturn[funcAddr] = append(jit.pendingReturn[funcAddr], &currentCallInfo)
-			// is compiled but with different arguments
-			return FuncDynamic, int(funcAddr)
+// SetMemoLimits bounds the number of cached calls of one function and of all functions, 0 removes a limit.
+// Calls over the limits are evicted
+func (vm *VM) SetMemoLimits(perFunction, total int) {
+	jit := vm.jit
+	jit.functionLimit = max(perFunction, 0)
+	jit.limit = max(total, 0)
+	for _, info := range jit.seenFunctions {
+		for jit.functionLimit > 0 && info.recent.Len() > jit.functionLimit {
+			jit.evict(info.recent.Back().Value.(*callInfo))
 		}
 	}
-	for _, arg := range args {
-		if arg.Type == ValHeapPtr {
-			jit.seenFunctions[funcAddr] = &funcJITInfo{Kind: FuncDynamic}
-			return FuncDynamic, int(funcAddr) // cannot JIT compile functions with heap arguments
-		}
+	for jit.limit > 0 && jit.recent.Len() > jit.limit {
+		jit.evict(jit.recent.Back().Value.(*callInfo))
 	}
+}
 
-	var farthestJump int
-	// Check if function's instructions can be JIT compiled
-	for i := int(funcAddr); i < len(jit.bytecode.Instructions); i++ {
-		inst := jit.bytecode.Instructions[i]
-		if inst.IsJump() {
-			farthestJump = max(farthestJump, inst.Operands[0])
-		}
-		if inst.IsReturn() && i >= farthestJump {
-			jit.pendingReturn[funcAddr] = append(jit.pendingReturn[funcAddr], &currentCallInfo)
-			jit.seenFunctions[funcAddr] = &funcJITInfo{
-				Kind: FuncPendingCompiledReturn,
-			}
-			jit.seenFunctions[funcAddr].CachedCalls = append(jit.seenFunctions[funcAddr].CachedCalls, &currentCallInfo)
-			return FuncPendingCompiledReturn, int(funcAddr) // will compile after return value is known
-		}
-
-		if inst.Opcode == bytecode.OpCall {
-			compilable, kind := jit.checkCallCompilable(FuncAddress(inst.Operands[0]), funcAddr)
-			if !compilable {
-				return kind, int(funcAddr)
-			}
-			continue
-		}
+// Lookup returns results cached for the call of the function with the arguments and the address of the stub
+// returning them, ok is false if the call has to be executed. Results of executed calls of pure and read-only
+// functions are cached on return, arrays in arguments are looked up in the heap. A cached call sampled by
+// the JIT verify mode is executed as well, verify is true and the call has to run in the interpreter
+func (jit *JITCompiler) Lookup(funcAddrInt int, args []Value, heap []*Array) (results []Value, stub int, ok, verify bool) {
+	info := jit.function(funcAddrInt)
+	if info.Kind == FuncDynamic {
+		return nil, 0, false, false // has effects, a cached result could differ from a real call
+	}
+	key, cacheable := argumentsKey(args, heap)
+	if !cacheable {
+		info.uncacheable++
+		return nil, 0, false, false
+	}
 
-		if inst.HasSideEffects() {
-			jit.seenFunctions[funcAddr] = &funcJITInfo{Kind: FuncDynamic}
-			return FuncDynamic, int(funcAddr) // has side effects, cannot JIT compile
+	call, cached := info.calls[key]
+	if !cached {
+		info.misses++
+		if _, running := info.pending[key]; !running {
+			info.pending[key] = time.Now()
 		}
+		return nil, 0, false, false
 	}
-
-	return FuncDynamic, int(funcAddr) // error (reached end of instructions without return)
+	if jit.sampled(info, call) {
+		return nil, 0, false, true
+	}
+	info.hits++
+	info.saved += call.cost
+	jit.recent.MoveToFront(call.global)
+	info.recent.MoveToFront(call.local)
+	stub = jit.stub(len(call.results))
+	if jit.printInfo {
+		fmt.Printf("INFO: Using cached compiled function %s(%v) -> %v at address %d\n", jit.bytecode.FuncAddresses[funcAddrInt].Name, call.args, resultsData(call.results), stub)
+	}
+	return call.results, stub, true, false
 }
 
-func (jit *JITCompiler) NotifyReturn(funcAddrInt int, inputValues []Value, returnValue Value) {
+// function returns the JIT's information about the function, it is classified on the first use
+func (jit *JITCompiler) function(funcAddrInt int) *funcJITInfo {
 	funcAddr := FuncAddress(funcAddrInt)
-	if callInfos, ok := jit.pendingReturn[funcAddr]; ok {
-		callInfo, idx := findCallInfo(callInfos, callInfo{args: inputValues})
-		if callInfo == nil {
-			return
-		}
-		callInfo.result = returnValue
-		funcInfo := jit.seenFunctions[funcAddr]
-		if funcInfo.Kind == FuncPendingCompiledReturn {
-			callInfo.compiledAddress = jit.compile(len(callInfo.args), returnValue)
-		}
-		funcInfo.CachedCalls = append(funcInfo.CachedCalls, callInfo)
-		if jit.printInfo {
-			fmt.Printf("INFO: Compiling function %s(%v) -> %v at address %d\n", jit.bytecode.FuncAddresses[funcAddrInt].Name, callInfo.args, callInfo.result.Data, funcAddr)
-		}
-		callInfos = append(callInfos[:idx], callInfos[idx+1:]...)
-
-		jit.pendingReturn[funcAddr] = callInfos
-		if len(callInfos) == 0 {
-			funcInfo.Kind = FuncJITCompiled
-			delete(jit.pendingReturn, funcAddr)
+	info, seen := jit.seenFunctions[funcAddr]
+	if !seen {
+		info = &funcJITInfo{Kind: FuncDynamic}
+		if jit.effects.ReadOnly(funcAddrInt) {
+			info = &funcJITInfo{
+				Kind:      FuncPendingCompiledReturn,
+				calls:     make(map[string]*callInfo),
+				recent:    list.New(),
+				pending:   make(map[string]time.Time),
+				verifying: make(map[string][]Value),
+			}
 		}
+		jit.seenFunctions[funcAddr] = info
 	}
+	return info
 }
 
-func (jit *JITCompiler) checkCallCompilable(calledFuncAddr, funcAddr FuncAddress) (bool, FuncKind) {
-
-	calledFuncInfo, ok := jit.seenFunctions[calledFuncAddr]
-	if !ok {
-		jit.seenFunctions[funcAddr] = &funcJITInfo{Kind: FuncCallingDynamic}
-		return false, FuncCallingDynamic
+// NotifyReturn caches all values returned by the call or compares them with the cached ones if the call was
+// re-executed for verification, returnValues is empty for void functions
+func (jit *JITCompiler) NotifyReturn(funcAddrInt int, inputValues []Value, returnValues []Value, heap []*Array) {
+	info, ok := jit.seenFunctions[FuncAddress(funcAddrInt)]
+	if !ok || len(info.pending) == 0 && len(info.verifying) == 0 {
+		return
 	}
-	if calledFuncAddr == funcAddr {
-		return true, 0 // recursive call, ignore
+	key, _ := argumentsKey(inputValues, heap)
+	if _, verifying := info.verifying[key]; verifying {
+		jit.verify(funcAddrInt, info, key, inputValues, returnValues)
+		return
 	}
-
-	// called function is not compiled
-	if calledFuncInfo.Kind != FuncJITCompiled {
-		jit.seenFunctions[funcAddr] = &funcJITInfo{Kind: FuncCallingDynamic}
-		return false, FuncCallingDynamic
+	start, running := info.pending[key]
+	if !running {
+		return
+	}
+	delete(info.pending, key)
+	call := jit.insert(info, key, slices.Clone(inputValues), returnValues, time.Since(start))
+	jit.indexArrays(call, heap)
+	if jit.printInfo {
+		fmt.Printf("INFO: Compiling function %s(%v) -> %v\n", jit.bytecode.FuncAddresses[funcAddrInt].Name, call.args, resultsData(call.results))
 	}
+}
 
-	return true, 0 // might still be compilable (child function is compiled)
+// NotifyUnwind forgets the call left by an exception, its results are neither cached nor verified
+func (jit *JITCompiler) NotifyUnwind(funcAddrInt int, inputValues []Value, heap []*Array) {
+	info, ok := jit.seenFunctions[FuncAddress(funcAddrInt)]
+	if !ok || len(info.pending) == 0 && len(info.verifying) == 0 {
+		return
+	}
+	key, _ := argumentsKey(inputValues, heap)
+	delete(info.pending, key)
+	delete(info.verifying, key)
 }
 
-func (jit *JITCompiler) compile(numArgs int, returnValue Value) int {
-	compiledAddr := len(jit.bytecode.Instructions)
-	for i := range numArgs {
-		jit.emit(bytecode.OpStore, i)
+// insert caches the call as the most recently used one, evicting calls over the limits
+func (jit *JITCompiler) insert(info *funcJITInfo, key string, args, results []Value, cost time.Duration) *callInfo {
+	if jit.functionLimit > 0 && info.recent.Len() >= jit.functionLimit {
+		jit.evict(info.recent.Back().Value.(*callInfo))
 	}
-	if returnValue.Type != ValNil {
-		jit.emit(bytecode.OpConst, jit.addConstant(returnValue.Data))
-		jit.emit(bytecode.OpReturn)
-		return compiledAddr
+	if jit.limit > 0 && jit.recent.Len() >= jit.limit {
+		jit.evict(jit.recent.Back().Value.(*callInfo))
 	}
+	call := &callInfo{function: info, key: key, args: args, results: results, cost: cost}
+	call.global = jit.recent.PushFront(call)
+	call.local = info.recent.PushFront(call)
+	info.calls[key] = call
+	info.Kind = FuncJITCompiled
+	return call
+}
 
-	jit.emit(bytecode.OpReturnVoid)
-	return compiledAddr
+// evict removes the call from the cache to make room for another one
+func (jit *JITCompiler) evict(call *callInfo) {
+	info := call.function
+	jit.remove(call)
+	info.evicted++
+	if len(info.calls) == 0 {
+		info.Kind = FuncPendingCompiledReturn
+	}
 }
 
-func (jit *JITCompiler) emit(opcode byte, operands ...int) {
-	jit.bytecode.Instructions = append(jit.bytecode.Instructions, bytecode.Instruction{
-		Opcode:   opcode,
-		Operands: operands,
-	})
+func (jit *JITCompiler) remove(call *callInfo) {
+	info := call.function
+	jit.recent.Remove(call.global)
+	info.recent.Remove(call.local)
+	delete(info.calls, call.key)
+	for _, id := range call.arrays {
+		delete(jit.arrayCalls[id], call)
+		if len(jit.arrayCalls[id]) == 0 {
+			delete(jit.arrayCalls, id)
+		}
+	}
 }
 
-func (jit *JITCompiler) replace(index int, opcode byte, operands ...int) {
-	jit.bytecode.Instructions[index] = bytecode.Instruction{
-		Opcode:   opcode,
-		Operands: operands,
+// indexArrays remembers the arrays among the arguments of the cached call, it is removed when one of them is freed
+func (jit *JITCompiler) indexArrays(call *callInfo, heap []*Array) {
+	for _, arg := range call.args {
+		if arg.Kind != ValHeapPtr {
+			continue
+		}
+		id := heap[arg.HeapPtr()].id
+		if jit.arrayCalls[id] == nil {
+			jit.arrayCalls[id] = make(map[*callInfo]struct{})
+		}
+		jit.arrayCalls[id][call] = struct{}{}
+		call.arrays = append(call.arrays, id)
 	}
 }
 
-func (jit *JITCompiler) addConstant(value interface{}) int {
-	for i, v := range jit.bytecode.Constants {
-		if v == value {
-			return i
+// forgetArray removes the cached calls with the array freed by the garbage collector, their keys cannot match
+// any later call as array ids are not reused
+func (jit *JITCompiler) forgetArray(array *Array) {
+	for call := range jit.arrayCalls[array.id] {
+		info := call.function
+		jit.remove(call)
+		if len(info.calls) == 0 && info.Kind == FuncJITCompiled {
+			info.Kind = FuncPendingCompiledReturn
 		}
 	}
-	jit.bytecode.Constants = append(jit.bytecode.Constants, value)
-	return len(jit.bytecode.Constants) - 1
 }
 
-func getCallAddress(inst bytecode.Instruction) int {
-	if inst.Opcode != bytecode.OpCall {
-		return -1
+// stub returns the address of the instruction returning count values, the VM pushes cached results
+// before it jumps there. Stubs are shared by all cached calls
+func (jit *JITCompiler) stub(count int) int {
+	if addr, ok := jit.stubs[count]; ok {
+		return addr
 	}
-	return inst.Operands[0]
+	addr := len(jit.bytecode.Instructions)
+	switch count {
+	case 0:
+		jit.emit(bytecode.OpReturnVoid)
+	case 1:
+		jit.emit(bytecode.OpReturn)
+	default:
+		jit.emit(bytecode.OpReturn, count)
+	}
+	jit.stubs[count] = addr
+	return addr
+}
+
+func (jit *JITCompiler) emit(opcode byte, operands ...int) {
+	jit.bytecode.Instructions = append(jit.bytecode.Instructions, bytecode.Instruction{
+		Opcode:   opcode,
+		Operands: operands,
+	})
 }
@@ -0,0 +1,196 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+)
+
+// JITFunctionReport is the JIT's decision about a function and statistics of its cached calls
+type JITFunctionReport struct {
+	Name        string        `json:"name"`
+	Address     int           `json:"address"`
+	Kind        FuncKind      `json:"kind"`
+	Reason      string        `json:"reason"`
+	Hits        int           `json:"hits"`
+	Misses      int           `json:"misses"`
+	Uncacheable int           `json:"uncacheable"` // calls with closure arguments or arrays of arrays
+	Cached      int           `json:"cached"`
+	Evicted     int           `json:"evicted"`
+	Loaded      int           `json:"loaded"`        // calls preloaded from a memo cache file
+	Verified    int           `json:"verified"`      // cached calls re-executed by the interpreter in the verify mode
+	TimeSaved   time.Duration `json:"time_saved_ns"` // execution time of the calls answered from the cache
+}
+
+// JITLoopReport describes a hot loop and its trace
+type JITLoopReport struct {
+	Function   string `json:"function"`
+	Line       int    `json:"line"`
+	Header     int    `json:"header"`
+	Traced     bool   `json:"traced"`
+	Reason     string `json:"reason,omitempty"` // why the last recording was aborted
+	Length     int    `json:"length"`           // recorded instructions
+	Guards     int    `json:"guards"`
+	Entered    int    `json:"entered"`
+	Iterations int    `json:"iterations"`
+	SideExits  int    `json:"side_exits"`
+}
+
+// JITReport describes the memoization of all functions of the program, in address order, and loops that were
+// traced or tried to be traced
+type JITReport struct {
+	Enabled   bool                `json:"enabled"`
+	Functions []JITFunctionReport `json:"functions"`
+	Loops     []JITLoopReport     `json:"loops"`
+	Stubs     int                 `json:"stubs"` // RETURN stubs shared by cached calls
+	Hits      int                 `json:"hits"`
+	Misses    int                 `json:"misses"`
+	Cached    int                 `json:"cached"`
+	Evicted   int                 `json:"evicted"`
+	Loaded    int                 `json:"loaded"`
+	Verified  int                 `json:"verified"`
+	TimeSaved time.Duration       `json:"time_saved_ns"`
+	// Cached calls whose results differed from the interpreter, every one is a bug
+	Discrepancies []JITDiscrepancy `json:"discrepancies"`
+	// Instructions specialized by type feedback at the end of the run and those deoptimized at least once
+	Specialized int `json:"specialized"`
+	Deoptimized int `json:"deoptimized"`
+}
+
+// JITReport returns the JIT's decisions and statistics collected so far. Functions that were not called
+// are classified by their effects
+func (vm *VM) JITReport() *JITReport {
+	jit := vm.jit
+	// Lists are empty rather than nil, so the JSON report has the same shape for every program
+	report := &JITReport{
+		Enabled:       vm.jitEnabled,
+		Functions:     []JITFunctionReport{},
+		Loops:         []JITLoopReport{},
+		Stubs:         len(jit.stubs),
+		Discrepancies: append([]JITDiscrepancy{}, jit.discrepancies...),
+	}
+	addresses := make([]int, 0, len(vm.bytecode.FuncAddresses))
+	for addr := range vm.bytecode.FuncAddresses {
+		addresses = append(addresses, addr)
+	}
+	slices.Sort(addresses)
+
+	for _, addr := range addresses {
+		function := JITFunctionReport{
+			Name:    vm.bytecode.FuncAddresses[addr].Name,
+			Address: addr,
+			Kind:    FuncPendingCompiledReturn,
+			Reason:  jit.reason(addr),
+		}
+		if !jit.effects.ReadOnly(addr) {
+			function.Kind = FuncDynamic
+		}
+		if info, seen := jit.seenFunctions[FuncAddress(addr)]; seen {
+			function.Kind = info.Kind
+			function.Hits = info.hits
+			function.Misses = info.misses
+			function.Uncacheable = info.uncacheable
+			function.Cached = len(info.calls)
+			function.Evicted = info.evicted
+			function.Loaded = info.loaded
+			function.Verified = info.verified
+			function.TimeSaved = info.saved
+		}
+		report.Functions = append(report.Functions, function)
+		report.Hits += function.Hits
+		report.Misses += function.Misses
+		report.Cached += function.Cached
+		report.Evicted += function.Evicted
+		report.Loaded += function.Loaded
+		report.Verified += function.Verified
+		report.TimeSaved += function.TimeSaved
+	}
+	report.Specialized, report.Deoptimized = vm.specializations()
+
+	for header, loop := range vm.traces.loops {
+		if loop.trace == nil && loop.attempts == 0 {
+			continue
+		}
+		entry := JITLoopReport{Function: loop.function, Line: loop.line, Header: header, Reason: loop.reason}
+		if t := loop.trace; t != nil {
+			entry.Traced = true
+			entry.Length = t.length
+			entry.Guards = t.guards
+			entry.Entered = t.entered
+			entry.Iterations = t.iterations
+			entry.SideExits = t.sideExits
+		}
+		report.Loops = append(report.Loops, entry)
+	}
+	return report
+}
+
+// reason explains the classification of the function: pure or the instruction or call giving it effects
+func (jit *JITCompiler) reason(funcAddr int) string {
+	if info, seen := jit.seenFunctions[FuncAddress(funcAddr)]; seen && info.demoted {
+		return "cached results differed from the interpreter, demoted"
+	}
+	function, ok := jit.effects.Function(funcAddr)
+	if !ok {
+		return "not a function"
+	}
+	if function.Effect.Pure() {
+		return "pure"
+	}
+	if function.Effect.ReadOnly() {
+		return "reads arrays, cached for their versions"
+	}
+	if function.Graph.OutOfRange {
+		return "control leaves the program"
+	}
+	instr := jit.bytecode.Instructions[function.Cause]
+	if instr.Opcode == bytecode2.OpCall || instr.Opcode == bytecode2.OpTailCall {
+		callee, ok := jit.effects.Function(instr.Operands[0])
+		if !ok {
+			return fmt.Sprintf("calls a missing function at line %d", instr.Line)
+		}
+		name := jit.bytecode.FuncAddresses[instr.Operands[0]].Name
+		return fmt.Sprintf("%s: calls %s at line %d", callee.Effect, name, instr.Line)
+	}
+	return fmt.Sprintf("%s: %s at line %d", function.Own, instr.String(), instr.Line)
+}
+
+// WriteText writes the report as a table
+func (r *JITReport) WriteText(w io.Writer) error {
+	if !r.Enabled {
+		_, err := fmt.Fprintln(w, "JIT is disabled")
+		return err
+	}
+	fmt.Fprintf(w, "%-24s %-9s %8s %8s %8s %8s %10s  %s\n", "function", "kind", "hits", "misses", "cached", "evicted", "saved", "reason")
+	for _, f := range r.Functions {
+		fmt.Fprintf(w, "%-24s %-9s %8d %8d %8d %8d %10v  %s\n", f.Name, f.Kind, f.Hits, f.Misses, f.Cached, f.Evicted,
+			f.TimeSaved.Round(time.Microsecond), f.Reason)
+	}
+	if len(r.Loops) > 0 {
+		fmt.Fprintf(w, "\n%-24s %6s %-7s %8s %8s %10s %10s  %s\n", "loop", "line", "trace", "length", "guards", "iterations", "exits", "reason")
+		for _, l := range r.Loops {
+			status := "aborted"
+			if l.Traced {
+				status = "traced"
+			}
+			fmt.Fprintf(w, "%-24s %6d %-7s %8d %8d %10d %10d  %s\n", l.Function, l.Line, status, l.Length, l.Guards, l.Iterations, l.SideExits, l.Reason)
+		}
+	}
+	fmt.Fprintf(w, "total: %d hits, %d misses, %d cached, %d evicted, %d loaded, %d verified, %d stubs, %v saved\n",
+		r.Hits, r.Misses, r.Cached, r.Evicted, r.Loaded, r.Verified, r.Stubs, r.TimeSaved.Round(time.Microsecond))
+	_, err := fmt.Fprintf(w, "type feedback: %d instructions specialized, %d deoptimized\n", r.Specialized, r.Deoptimized)
+	for i := 0; i < len(r.Discrepancies) && err == nil; i++ {
+		_, err = fmt.Fprintf(w, "JIT bug: %s\n", r.Discrepancies[i])
+	}
+	return err
+}
+
+// WriteJSON writes the report as an indented JSON object
+func (r *JITReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
@@ -0,0 +1,78 @@
+package runtime
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// JITDiscrepancy is a cached call whose results differ from the results of the call executed by the interpreter.
+// The function is demoted to dynamic, the discrepancy is a bug of the JIT or of the effect analysis
+type JITDiscrepancy struct {
+	Function string `json:"function"`
+	Args     string `json:"args"`
+	Cached   string `json:"cached"`
+	Actual   string `json:"actual"`
+}
+
+func (d JITDiscrepancy) String() string {
+	return fmt.Sprintf("%s(%s) returned %s from the cache, the interpreter computed %s", d.Function, d.Args, d.Cached, d.Actual)
+}
+
+// SetJITVerify makes every n-th call answered from the JIT's cache run in the interpreter instead, its results are
+// compared with the cached ones. 0 disables verification
+func (vm *VM) SetJITVerify(every int) {
+	vm.jit.verifyEvery = max(every, 0)
+}
+
+// sampled reports whether the cache hit is re-executed for verification and remembers the expected results
+func (jit *JITCompiler) sampled(info *funcJITInfo, call *callInfo) bool {
+	if jit.verifyEvery == 0 {
+		return false
+	}
+	jit.sampledHits++
+	if jit.sampledHits%jit.verifyEvery != 0 {
+		return false
+	}
+	if _, running := info.verifying[call.key]; !running {
+		info.verifying[call.key] = call.results
+	}
+	return true
+}
+
+// verify compares the results of a re-executed call with the cached ones, a function whose results differ
+// is demoted
+func (jit *JITCompiler) verify(funcAddr int, info *funcJITInfo, key string, args, results []Value) {
+	expected := info.verifying[key]
+	delete(info.verifying, key)
+	info.verified++
+	if slices.EqualFunc(expected, results, Value.Identical) {
+		return
+	}
+	jit.discrepancies = append(jit.discrepancies, JITDiscrepancy{
+		Function: jit.bytecode.FuncAddresses[funcAddr].Name,
+		Args:     formatValues(args),
+		Cached:   formatValues(expected),
+		Actual:   formatValues(results),
+	})
+	jit.demote(info)
+}
+
+// demote removes all cached calls of the function and stops caching it
+func (jit *JITCompiler) demote(info *funcJITInfo) {
+	for info.recent.Len() > 0 {
+		jit.remove(info.recent.Back().Value.(*callInfo))
+	}
+	clear(info.pending)
+	clear(info.verifying)
+	info.Kind = FuncDynamic
+	info.demoted = true
+}
+
+func formatValues(values []Value) string {
+	texts := make([]string, len(values))
+	for i, value := range values {
+		texts[i] = fmt.Sprint(value.Interface())
+	}
+	return strings.Join(texts, ", ")
+}
@@ -0,0 +1,105 @@
+package runtime_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"twin-peaks-programming-language/internal/runtime"
+)
+
+// reassigning changes its parameter before it returns, the result has to be cached under the argument of the call
+const reassigning = `
+fn f(n int) int {
+	if (n == 0) {
+		return 100;
+	}
+	r int = f(n - 1);
+	n = n - 1;
+	return r + 1;
+}
+print(f(2));
+i int;
+for (i = 0; i < 5; i = i + 1) {
+	print(f(1));
+}`
+
+const reassigningOutput = "102\n101\n101\n101\n101\n101\n"
+
+// TestJITVerifyReassignedParameter re-executes every cached call. The calls of f(1) and of f(0) inside them
+// are compared with the cache, none of them differs
+func TestJITVerifyReassignedParameter(t *testing.T) {
+	for _, every := range []int{0, 1} {
+		var vm *runtime.VM
+		output := runProgram(t, reassigning, func(v *runtime.VM) {
+			vm = v
+			vm.SetJITVerify(every)
+		})
+		if output != reassigningOutput {
+			t.Errorf("verify every %d: expected %q, got %q", every, reassigningOutput, output)
+		}
+		report := vm.JITReport()
+		if len(report.Discrepancies) > 0 {
+			t.Errorf("verify every %d: unexpected discrepancies %v", every, report.Discrepancies)
+		}
+		if every == 1 && (report.Verified != 10 || report.Hits != 0) {
+			t.Errorf("verify every 1: %d calls verified and %d hits, expected 10 and 0", report.Verified, report.Hits)
+		}
+	}
+}
+
+// TestJITVerifyDiscrepancy preloads a cache with a wrong result of f(1), verification finds it and demotes f
+func TestJITVerifyDiscrepancy(t *testing.T) {
+	var cache bytes.Buffer
+	var first *runtime.VM
+	runProgram(t, reassigning, func(vm *runtime.VM) { first = vm })
+	if err := first.SaveMemoCache(&cache); err != nil {
+		t.Fatal(err)
+	}
+	tampered := tamperMemoCache(t, cache.Bytes())
+
+	var vm *runtime.VM
+	output := runProgram(t, reassigning, func(v *runtime.VM) {
+		vm = v
+		if _, err := vm.LoadMemoCache(bytes.NewReader(tampered)); err != nil {
+			t.Fatal(err)
+		}
+		vm.SetJITVerify(1)
+	})
+	if output != reassigningOutput {
+		t.Errorf("expected %q, got %q", reassigningOutput, output)
+	}
+	report := vm.JITReport()
+	if len(report.Discrepancies) != 1 || report.Discrepancies[0].Args != "1" {
+		t.Fatalf("expected one discrepancy of f(1), got %v", report.Discrepancies)
+	}
+	if report.Functions[0].Kind != runtime.FuncDynamic {
+		t.Errorf("f is %s after the discrepancy, expected dynamic", report.Functions[0].Kind)
+	}
+}
+
+// tamperMemoCache adds 1 to the saved result of f(1)
+func tamperMemoCache(t *testing.T, cache []byte) []byte {
+	t.Helper()
+	var file map[string]any
+	if err := json.Unmarshal(cache, &file); err != nil {
+		t.Fatal(err)
+	}
+	for _, function := range file["functions"].([]any) {
+		for _, call := range function.(map[string]any)["calls"].([]any) {
+			call := call.(map[string]any)
+			args, _ := base64.StdEncoding.DecodeString(call["args"].(string))
+			if args[1] != 1 { // a kind byte and the little endian int
+				continue
+			}
+			results, _ := base64.StdEncoding.DecodeString(call["results"].(string))
+			results[1]++
+			call["results"] = base64.StdEncoding.EncodeToString(results)
+		}
+	}
+	tampered, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tampered
+}
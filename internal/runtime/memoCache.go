@@ -0,0 +1,166 @@
+package runtime
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// memoCacheVersion changes when the format of the memo cache file or the encoding of values changes
+const memoCacheVersion = 1
+
+// memoCacheFile is the JIT's cache of call results saved between runs. Functions are identified by the hash
+// of their code, so results of a function whose body or callees changed are not loaded
+type memoCacheFile struct {
+	Version        int                 `json:"version"`
+	OverflowChecks bool                `json:"overflow_checks"` // results of int arithmetic depend on the mode
+	Functions      []memoCacheFunction `json:"functions"`
+}
+
+type memoCacheFunction struct {
+	Name  string          `json:"name"`
+	Hash  string          `json:"hash"`
+	Calls []memoCacheCall `json:"calls"` // the most recently used first
+}
+
+type memoCacheCall struct {
+	Args    []byte        `json:"args"` // values encoded by argumentsKey
+	Results []byte        `json:"results"`
+	Cost    time.Duration `json:"cost_ns"`
+}
+
+// SaveMemoCache writes cached results of calls of all functions, they can be loaded by LoadMemoCache in
+// a later run of the same or a changed program
+func (vm *VM) SaveMemoCache(w io.Writer) error {
+	jit := vm.jit
+	hashes := jit.effects.Hashes(jit.bytecode)
+	file := memoCacheFile{Version: memoCacheVersion, OverflowChecks: vm.overflowChecks}
+	addresses := make([]int, 0, len(jit.seenFunctions))
+	for addr := range jit.seenFunctions {
+		addresses = append(addresses, int(addr))
+	}
+	slices.Sort(addresses)
+
+	for _, addr := range addresses {
+		info := jit.seenFunctions[FuncAddress(addr)]
+		if info.Kind != FuncJITCompiled {
+			continue
+		}
+		function := memoCacheFunction{Name: jit.bytecode.FuncAddresses[addr].Name, Hash: hashes[addr]}
+		for element := info.recent.Front(); element != nil; element = element.Next() {
+			call := element.Value.(*callInfo)
+			if !persistent(call.args) || !persistent(call.results) {
+				continue // arrays of this run
+			}
+			results, _ := argumentsKey(call.results, nil)
+			function.Calls = append(function.Calls, memoCacheCall{Args: []byte(call.key), Results: []byte(results), Cost: call.cost})
+		}
+		file.Functions = append(file.Functions, function)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(file)
+}
+
+// LoadMemoCache preloads results of calls saved by SaveMemoCache and returns the number of loaded calls.
+// Calls of functions whose code changed since they were saved are discarded, as is the whole cache if it was
+// saved with different overflow checks. Loaded calls are subject to the memo limits
+func (vm *VM) LoadMemoCache(r io.Reader) (loaded int, err error) {
+	var file memoCacheFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return 0, fmt.Errorf("memo cache: %w", err)
+	}
+	if file.Version != memoCacheVersion {
+		return 0, fmt.Errorf("memo cache: unsupported version %d", file.Version)
+	}
+	if file.OverflowChecks != vm.overflowChecks {
+		return 0, nil
+	}
+
+	jit := vm.jit
+	functions := make(map[string][]int) // functions with identical code share a hash
+	for addr, hash := range jit.effects.Hashes(jit.bytecode) {
+		if jit.effects.ReadOnly(addr) {
+			functions[hash] = append(functions[hash], addr)
+		}
+	}
+	for _, saved := range file.Functions {
+		for _, addr := range functions[saved.Hash] {
+			n, err := jit.load(addr, saved)
+			loaded += n
+			if err != nil {
+				return loaded, fmt.Errorf("memo cache: %s: %w", saved.Name, err)
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// load caches the saved calls of the function with the same code
+func (jit *JITCompiler) load(addr int, saved memoCacheFunction) (loaded int, err error) {
+	function := jit.bytecode.FuncAddresses[addr]
+	info := jit.function(addr)
+	// The least recently used calls are inserted first, so the limits keep the most recent ones
+	for _, call := range slices.Backward(saved.Calls) {
+		args, err := decodeValues(call.Args)
+		if err != nil {
+			return loaded, err
+		}
+		results, err := decodeValues(call.Results)
+		if err != nil {
+			return loaded, err
+		}
+		if len(args) != function.ParamCount || len(results) != function.ReturnCount {
+			return loaded, fmt.Errorf("%d arguments and %d results saved for a function with %d and %d",
+				len(args), len(results), function.ParamCount, function.ReturnCount)
+		}
+		if _, cached := info.calls[string(call.Args)]; cached {
+			continue
+		}
+		jit.insert(info, string(call.Args), args, results, call.Cost)
+		info.loaded++
+		loaded++
+	}
+	return loaded, nil
+}
+
+// decodeValues decodes values encoded by argumentsKey
+func decodeValues(encoded []byte) ([]Value, error) {
+	var values []Value
+	for len(encoded) > 0 {
+		kind := ValueKind(encoded[0])
+		encoded = encoded[1:]
+		switch kind {
+		case ValNil, ValInt, ValUint, ValFloat, ValBool:
+			if len(encoded) < 8 {
+				return nil, errors.New("truncated value")
+			}
+			values = append(values, Value{Kind: kind, bits: binary.LittleEndian.Uint64(encoded)})
+			encoded = encoded[8:]
+		case ValString, ValBigInt:
+			length, n := binary.Uvarint(encoded)
+			if n <= 0 || uint64(len(encoded)-n) < length {
+				return nil, errors.New("truncated value")
+			}
+			text := string(encoded[n : n+int(length)])
+			encoded = encoded[n+int(length):]
+			if kind == ValString {
+				values = append(values, StringValue(text))
+				continue
+			}
+			number, ok := new(big.Int).SetString(text, 16)
+			if !ok {
+				return nil, fmt.Errorf("invalid bigint %q", text)
+			}
+			values = append(values, BigIntValue(number))
+		default:
+			return nil, fmt.Errorf("unsupported value kind %d", kind)
+		}
+	}
+	return values, nil
+}
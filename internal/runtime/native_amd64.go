@@ -0,0 +1,164 @@
+//go:build nativejit && linux
+
+package runtime
+
+import (
+	"fmt"
+	"syscall"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+	"unsafe"
+)
+
+// nativeStackSize is the size of the memory for frames of native functions. A call that needs more
+// bails out and is interpreted
+const nativeStackSize = 16 << 20
+
+// callNative runs machine code with RBX pointing to the first frame and R12 to the last frame that fits.
+// Status is 0 if the code returned, 1 if it bailed out. Implemented in native_amd64.s
+func callNative(code, frames, limit uintptr) (result, status uint64)
+
+// nativeTier compiles pure numeric functions to amd64 machine code in mmap'd executable memory.
+// A function is compiled for the kinds of its arguments: every param is an int or a float
+type nativeTier struct {
+	frames    []byte   // memory for frames of native calls
+	slots     []uint64 // frames as 64-bit slots
+	functions map[nativeKey]*nativeFunction
+	bailed    int // frames up to the call interpreted after a bail out, calls nested in it are interpreted too
+}
+
+type nativeKey struct {
+	address   int
+	signature uint64 // bit i is set when param i is a float
+	overflow  bool   // compiled with overflow checks
+}
+
+// nativeFunction is a compiled function, nil in the cache when the function cannot be compiled
+type nativeFunction struct {
+	code       []byte // mmap'd executable memory
+	frameSize  int    // bytes of a frame: return address, locals and operand stack
+	argSlot    int    // slot of the first argument in a frame
+	returns    bool   // the function returns a value
+	returnKind ValueKind
+}
+
+// UseNativeCode enables the amd64 code generator for functions using only int and float values,
+// arithmetic, comparisons, jumps and calls of themselves. Other functions are interpreted
+func (vm *VM) UseNativeCode() error {
+	frames, err := syscall.Mmap(-1, 0, nativeStackSize, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return fmt.Errorf("cannot allocate native frames: %w", err)
+	}
+	vm.native = &nativeTier{
+		frames:    frames,
+		slots:     unsafe.Slice((*uint64)(unsafe.Pointer(&frames[0])), len(frames)/8),
+		functions: make(map[nativeKey]*nativeFunction),
+	}
+	return nil
+}
+
+// runNative runs the function in the frame just pushed for it as machine code. It returns false when the function
+// cannot be compiled for the arguments or the code bailed out, the interpreter then executes the call from the start
+func (vm *VM) runNative(funcAddr int) bool {
+	if vm.native.bailed > 0 {
+		if len(vm.frames) > vm.native.bailed {
+			return false // a deep recursion would bail out again at every level
+		}
+		vm.native.bailed = 0
+	}
+	info := vm.bytecode.FuncAddresses[funcAddr]
+	base := vm.sp - info.ParamCount + 1
+	args := vm.stack[base : vm.sp+1]
+	key := nativeKey{address: funcAddr, overflow: vm.overflowChecks}
+	if len(args) > 64 {
+		return false
+	}
+	for i, arg := range args {
+		switch arg.Kind {
+		case ValInt:
+		case ValFloat:
+			key.signature |= 1 << i
+		default:
+			return false
+		}
+	}
+
+	fn, ok := vm.native.functions[key]
+	if !ok {
+		var err error
+		fn, err = compileNative(vm.bytecode, info, key)
+		if vm.jit.printInfo {
+			if err != nil {
+				fmt.Printf("INFO: Function %s has no native code: %v\n", info.Name, err)
+			} else {
+				fmt.Printf("INFO: Compiled function %s to %d bytes of native code\n", info.Name, len(fn.code))
+			}
+		}
+		vm.native.functions[key] = fn
+	}
+	if fn == nil {
+		return false
+	}
+
+	for i, arg := range args {
+		vm.native.slots[fn.argSlot+i] = arg.bits
+	}
+	frames := uintptr(unsafe.Pointer(&vm.native.frames[0]))
+	result, status := callNative(uintptr(unsafe.Pointer(&fn.code[0])), frames, frames+nativeStackSize-uintptr(fn.frameSize))
+	if status != 0 {
+		vm.native.bailed = len(vm.frames)
+		return false
+	}
+
+	frame := &vm.frames[len(vm.frames)-1]
+	if vm.jitEnabled {
+		frame.locals = append(frame.locals, args...) // the JIT caches the result for the arguments
+	}
+	vm.sp = base - 1
+	if !fn.returns {
+		vm.leaveFrame(-1)
+		return true
+	}
+	vm.push(Value{Kind: fn.returnKind, bits: result})
+	vm.leaveFrame(1)
+	return true
+}
+
+// compileNative generates machine code of the function for the kinds of arguments in the key
+func compileNative(bc *bytecode2.Bytecode, info *bytecode2.FunctionInfo, key nativeKey) (*nativeFunction, error) {
+	params := make([]nativeKind, info.ParamCount)
+	for i := range params {
+		params[i] = nativeInt
+		if key.signature&(1<<i) != 0 {
+			params[i] = nativeFloat
+		}
+	}
+	analysis, err := analyzeNative(bc, info, params)
+	if err != nil {
+		return nil, err
+	}
+	code := generateNative(bc, info, analysis, key.overflow)
+
+	memory, err := syscall.Mmap(-1, 0, len(code), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+	copy(memory, code)
+	if err := syscall.Mprotect(memory, syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		syscall.Munmap(memory)
+		return nil, err
+	}
+
+	fn := &nativeFunction{
+		code:      memory,
+		frameSize: analysis.frameSize(),
+		argSlot:   analysis.stackSlot(0),
+		returns:   analysis.returnKind != nativeUnknown,
+	}
+	if analysis.returnKind == nativeFloat {
+		fn.returnKind = ValFloat
+	} else {
+		fn.returnKind = ValInt
+	}
+	return fn, nil
+}
@@ -0,0 +1,15 @@
+//go:build nativejit && linux
+
+#include "textflag.h"
+
+// func callNative(code, frames, limit uintptr) (result, status uint64)
+// Generated code keeps its frames in the memory at RBX and never touches SP, so the only thing
+// it leaves on the goroutine stack is the return address of this CALL
+TEXT ·callNative(SB), NOSPLIT, $0-40
+	MOVQ code+0(FP), AX
+	MOVQ frames+8(FP), BX
+	MOVQ limit+16(FP), R12
+	CALL AX
+	MOVQ AX, result+24(FP)
+	MOVQ R13, status+32(FP)
+	RET
@@ -0,0 +1,732 @@
+//go:build nativejit && linux
+
+package runtime
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+)
+
+// nativeKind is the static kind of a local or an operand in native code
+type nativeKind uint8
+
+const (
+	nativeUnknown nativeKind = iota // local that is never assigned, no value of a void function
+	nativeInt
+	nativeFloat
+	nativeBool // result of a comparison, only used by jumps and logical operators
+)
+
+// nativeAnalysis is the result of kind inference: every local keeps one kind in the whole function
+// and every reachable instruction sees the same operand kinds on all paths
+type nativeAnalysis struct {
+	locals     []nativeKind
+	stacks     map[int][]nativeKind // operand kinds before every reachable instruction
+	maxDepth   int
+	returnKind nativeKind // nativeUnknown for void functions
+}
+
+// A frame is a return address, locals and the operand stack, every slot takes 8 bytes
+func (a *nativeAnalysis) localSlot(local int) int { return 1 + local }
+func (a *nativeAnalysis) stackSlot(depth int) int { return 1 + len(a.locals) + depth }
+func (a *nativeAnalysis) frameSize() int          { return 8 * (1 + len(a.locals) + a.maxDepth) }
+
+// analyzeNative infers kinds of locals and operands. Functions with other values, side effects,
+// calls of other functions or locals read before they are assigned cannot be compiled
+func analyzeNative(bc *bytecode2.Bytecode, info *bytecode2.FunctionInfo, params []nativeKind) (*nativeAnalysis, error) {
+	a := &nativeAnalysis{locals: slices.Clone(params), stacks: make(map[int][]nativeKind)}
+	switch info.ReturnType {
+	case "int":
+		a.returnKind = nativeInt
+	case "float":
+		a.returnKind = nativeFloat
+	}
+
+	type state struct {
+		addr     int
+		stack    []nativeKind
+		assigned uint64 // locals assigned on every path
+	}
+	assignedAt := make(map[int]uint64)
+	work := []state{{info.Address, slices.Clone(params), uint64(1)<<len(params) - 1}}
+	for len(work) > 0 {
+		s := work[len(work)-1]
+		work = work[:len(work)-1]
+		if s.addr < 0 || s.addr >= len(bc.Instructions) {
+			return nil, fmt.Errorf("jump out of the program at %d", s.addr)
+		}
+		if stack, ok := a.stacks[s.addr]; ok {
+			if !slices.Equal(stack, s.stack) {
+				return nil, fmt.Errorf("operands of different kinds at %d", s.addr)
+			}
+			merged := assignedAt[s.addr] & s.assigned
+			if merged == assignedAt[s.addr] {
+				continue
+			}
+			s.assigned = merged
+		}
+		a.stacks[s.addr] = s.stack
+		assignedAt[s.addr] = s.assigned
+
+		instr := bc.Instructions[s.addr].Generic()
+		stack, assigned, err := a.transfer(bc, info, instr, slices.Clone(s.stack), s.assigned)
+		if err == nil {
+			err = checkStackEffect(bc, instr, len(s.stack), len(stack))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s at %d: %w", instr.String(), s.addr, err)
+		}
+		a.maxDepth = max(a.maxDepth, len(s.stack), len(stack))
+
+		switch {
+		case instr.Opcode == bytecode2.OpJmp:
+			work = append(work, state{instr.Operands[0], stack, assigned})
+		case instr.IsConditionalJump():
+			work = append(work, state{instr.Operands[0], stack, assigned}, state{s.addr + 1, stack, assigned})
+		case !instr.IsTerminator():
+			work = append(work, state{s.addr + 1, stack, assigned})
+		}
+	}
+	return a, nil
+}
+
+// checkStackEffect makes sure the kinds follow the stack effect of the instruction shared by all tiers. A call
+// of a function declared without a return type that still returns a value is rejected here
+func checkStackEffect(bc *bytecode2.Bytecode, instr bytecode2.Instruction, before, after int) error {
+	pops, pushes, err := bc.StackEffect(instr, bc.ReturnCount)
+	if err != nil {
+		return err
+	}
+	if after != before-pops+pushes {
+		return fmt.Errorf("stack depth %d after the instruction, expected %d", after, before-pops+pushes)
+	}
+	return nil
+}
+
+// transfer returns operand kinds and assigned locals after the instruction
+func (a *nativeAnalysis) transfer(bc *bytecode2.Bytecode, info *bytecode2.FunctionInfo, instr bytecode2.Instruction,
+	stack []nativeKind, assigned uint64) ([]nativeKind, uint64, error) {
+	pop := func(kinds ...nativeKind) (nativeKind, error) {
+		if len(stack) == 0 {
+			return nativeUnknown, fmt.Errorf("stack underflow")
+		}
+		kind := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if !slices.Contains(kinds, kind) {
+			return nativeUnknown, fmt.Errorf("unsupported operand kind")
+		}
+		return kind, nil
+	}
+	load := func(local int) error {
+		if local >= 64 || assigned&(1<<local) == 0 {
+			return fmt.Errorf("local %d may be read before it is assigned", local)
+		}
+		stack = append(stack, a.locals[local])
+		return nil
+	}
+	store := func(local int, kind nativeKind) error {
+		if local >= 64 {
+			return fmt.Errorf("too many locals")
+		}
+		for len(a.locals) <= local {
+			a.locals = append(a.locals, nativeUnknown)
+		}
+		if a.locals[local] != nativeUnknown && a.locals[local] != kind {
+			return fmt.Errorf("local %d holds values of different kinds", local)
+		}
+		a.locals[local] = kind
+		assigned |= 1 << local
+		return nil
+	}
+	// numbers pops two operands of the same numeric kind
+	numbers := func(kinds ...nativeKind) (nativeKind, error) {
+		right, err := pop(kinds...)
+		if err != nil {
+			return right, err
+		}
+		left, err := pop(right)
+		return left, err
+	}
+
+	var err error
+	var kind nativeKind
+	switch instr.Opcode {
+	case bytecode2.OpConst:
+		switch bc.Constants[instr.Operands[0]].(type) {
+		case int:
+			stack = append(stack, nativeInt)
+		case float64:
+			stack = append(stack, nativeFloat)
+		case bool:
+			stack = append(stack, nativeBool)
+		default:
+			err = fmt.Errorf("unsupported constant")
+		}
+	case bytecode2.OpLoad:
+		err = load(instr.Operands[0])
+	case bytecode2.OpLoadLoad:
+		if err = load(instr.Operands[0]); err == nil {
+			err = load(instr.Operands[1])
+		}
+	case bytecode2.OpStore:
+		if kind, err = pop(nativeInt, nativeFloat); err == nil {
+			err = store(instr.Operands[0], kind)
+		}
+	case bytecode2.OpStoreKeep:
+		if kind, err = pop(nativeInt, nativeFloat); err == nil {
+			err = store(instr.Operands[0], kind)
+			stack = append(stack, kind)
+		}
+	case bytecode2.OpPop:
+		_, err = pop(nativeInt, nativeFloat, nativeBool)
+	case bytecode2.OpIncLocal:
+		local := instr.Operands[0]
+		if err = load(local); err == nil {
+			step := nativeInt
+			if _, ok := bc.Constants[instr.Operands[1]].(float64); ok {
+				step = nativeFloat
+			}
+			stack = stack[:len(stack)-1]
+			if a.locals[local] != step {
+				err = fmt.Errorf("operands of different kinds")
+			}
+		}
+	case bytecode2.OpAddInt:
+		if _, err = pop(nativeInt); err == nil {
+			stack = append(stack, nativeInt)
+		}
+	case bytecode2.OpAdd, bytecode2.OpSub, bytecode2.OpMul, bytecode2.OpDiv:
+		if kind, err = numbers(nativeInt, nativeFloat); err == nil {
+			stack = append(stack, kind)
+		}
+	case bytecode2.OpMod:
+		if kind, err = numbers(nativeInt); err == nil {
+			stack = append(stack, kind)
+		}
+	case bytecode2.OpLt, bytecode2.OpLe, bytecode2.OpGt, bytecode2.OpGe, bytecode2.OpEq, bytecode2.OpNeq:
+		if _, err = numbers(nativeInt, nativeFloat); err == nil {
+			stack = append(stack, nativeBool)
+		}
+	case bytecode2.OpAnd, bytecode2.OpOr:
+		if _, err = numbers(nativeBool); err == nil {
+			stack = append(stack, nativeBool)
+		}
+	case bytecode2.OpNot:
+		if _, err = pop(nativeBool); err == nil {
+			stack = append(stack, nativeBool)
+		}
+	case bytecode2.OpNeg:
+		if kind, err = pop(nativeInt, nativeFloat); err == nil {
+			stack = append(stack, kind)
+		}
+	case bytecode2.OpSqrt:
+		if _, err = pop(nativeInt, nativeFloat); err == nil {
+			stack = append(stack, nativeFloat)
+		}
+	case bytecode2.OpConvert:
+		if _, err = pop(nativeInt, nativeFloat); err == nil {
+			switch instr.Operands[0] {
+			case bytecode2.ConvertInt:
+				stack = append(stack, nativeInt)
+			case bytecode2.ConvertFloat:
+				stack = append(stack, nativeFloat)
+			default:
+				err = fmt.Errorf("unsupported conversion")
+			}
+		}
+	case bytecode2.OpJmp:
+	case bytecode2.OpJmpIfFalse:
+		_, err = pop(nativeBool, nativeInt)
+	case bytecode2.OpLtJmpIfFalse:
+		_, err = numbers(nativeInt, nativeFloat)
+	case bytecode2.OpCall, bytecode2.OpTailCall:
+		if instr.Operands[0] != info.Address {
+			return nil, 0, fmt.Errorf("calls of other functions are not supported")
+		}
+		if len(stack) < info.ParamCount || !slices.Equal(stack[len(stack)-info.ParamCount:], a.locals[:info.ParamCount]) {
+			return nil, 0, fmt.Errorf("arguments of different kinds")
+		}
+		stack = stack[:len(stack)-info.ParamCount]
+		if instr.Opcode == bytecode2.OpTailCall && len(stack) > 0 {
+			err = fmt.Errorf("operands below arguments of a tail call")
+		}
+		if instr.Opcode == bytecode2.OpCall && a.returnKind != nativeUnknown {
+			stack = append(stack, a.returnKind)
+		}
+	case bytecode2.OpReturn:
+		if len(instr.Operands) > 0 || a.returnKind == nativeUnknown {
+			err = fmt.Errorf("unsupported returned values")
+		} else if _, err = pop(a.returnKind); err == nil && len(stack) > 0 {
+			err = fmt.Errorf("operands left below the returned value")
+		}
+	case bytecode2.OpReturnVoid:
+		if a.returnKind != nativeUnknown || len(stack) > 0 {
+			err = fmt.Errorf("unsupported return")
+		}
+	default:
+		err = fmt.Errorf("unsupported instruction")
+	}
+	return stack, assigned, err
+}
+
+// x86-64 registers and condition codes used by the generated code
+const (
+	regRAX = 0
+	regRCX = 1
+	regRBX = 3
+
+	condO  = 0x0
+	condAE = 0x3
+	condE  = 0x4
+	condNE = 0x5
+	condBE = 0x6
+	condA  = 0x7
+	condP  = 0xA
+	condNP = 0xB
+	condL  = 0xC
+	condGE = 0xD
+	condLE = 0xE
+	condG  = 0xF
+)
+
+// nativeAssembler encodes the few instructions the generator needs. Locals and operands are
+// addressed relative to RBX, values are computed in RAX, RCX, RDX and XMM0-XMM2
+type nativeAssembler struct {
+	code    []byte
+	address map[int]int // code offset of every compiled bytecode instruction
+	fixups  []nativeFixup
+}
+
+// nativeFixup is a rel32 operand to be set to the code of a bytecode instruction
+type nativeFixup struct {
+	at     int
+	target int
+}
+
+func (asm *nativeAssembler) emit(bytes ...byte) {
+	asm.code = append(asm.code, bytes...)
+}
+
+func (asm *nativeAssembler) emit32(value int32) {
+	asm.code = binary.LittleEndian.AppendUint32(asm.code, uint32(value))
+}
+
+func modrm(mod, reg, rm byte) byte {
+	return mod<<6 | (reg&7)<<3 | rm&7
+}
+
+// load emits MOV reg, [RBX+8*slot]
+func (asm *nativeAssembler) load(reg byte, slot int) {
+	asm.emit(0x48, 0x8B, modrm(2, reg, regRBX))
+	asm.emit32(int32(8 * slot))
+}
+
+// store emits MOV [RBX+8*slot], reg
+func (asm *nativeAssembler) store(slot int, reg byte) {
+	asm.emit(0x48, 0x89, modrm(2, reg, regRBX))
+	asm.emit32(int32(8 * slot))
+}
+
+// loadFloat emits MOVSD xmm, [RBX+8*slot]
+func (asm *nativeAssembler) loadFloat(xmm byte, slot int) {
+	asm.emit(0xF2, 0x0F, 0x10, modrm(2, xmm, regRBX))
+	asm.emit32(int32(8 * slot))
+}
+
+// storeFloat emits MOVSD [RBX+8*slot], xmm
+func (asm *nativeAssembler) storeFloat(slot int, xmm byte) {
+	asm.emit(0xF2, 0x0F, 0x11, modrm(2, xmm, regRBX))
+	asm.emit32(int32(8 * slot))
+}
+
+// loadConstant emits MOV reg, imm64
+func (asm *nativeAssembler) loadConstant(reg byte, bits uint64) {
+	asm.emit(0x48, 0xB8+reg)
+	asm.code = binary.LittleEndian.AppendUint64(asm.code, bits)
+}
+
+// alu emits a 64-bit ADD (0x01), SUB (0x29), AND (0x21), OR (0x09) or CMP (0x39) of dst and src
+func (asm *nativeAssembler) alu(opcode, dst, src byte) {
+	asm.emit(0x48, opcode, modrm(3, src, dst))
+}
+
+// sse emits a scalar double instruction with a register operand: prefix 0F opcode /r
+func (asm *nativeAssembler) sse(prefix, opcode, dst, src byte) {
+	asm.emit(prefix, 0x0F, opcode, modrm(3, dst, src))
+}
+
+// setcc emits SETcc AL and MOVZX EAX, AL
+func (asm *nativeAssembler) setcc(cond byte) {
+	asm.emit(0x0F, 0x90+cond, 0xC0, 0x0F, 0xB6, 0xC0)
+}
+
+// jump emits JMP or Jcc to the bytecode instruction, -1 condition for JMP
+func (asm *nativeAssembler) jump(cond int, target int) {
+	if cond < 0 {
+		asm.emit(0xE9)
+	} else {
+		asm.emit(0x0F, 0x80+byte(cond))
+	}
+	asm.fixups = append(asm.fixups, nativeFixup{at: len(asm.code), target: target})
+	asm.emit32(0)
+}
+
+// jumpTo emits JMP or Jcc to a known code offset
+func (asm *nativeAssembler) jumpTo(cond int, offset int) {
+	if cond < 0 {
+		asm.emit(0xE9)
+	} else {
+		asm.emit(0x0F, 0x80+byte(cond))
+	}
+	asm.emit32(int32(offset - len(asm.code) - 4))
+}
+
+// forward emits Jcc with a rel32 set later by land, -1 condition for JMP
+func (asm *nativeAssembler) forward(cond int) int {
+	if cond < 0 {
+		asm.emit(0xE9)
+	} else {
+		asm.emit(0x0F, 0x80+byte(cond))
+	}
+	asm.emit32(0)
+	return len(asm.code) - 4
+}
+
+// land points the forward jump or LEA at the current offset
+func (asm *nativeAssembler) land(at int) {
+	binary.LittleEndian.PutUint32(asm.code[at:], uint32(int32(len(asm.code)-at-4)))
+}
+
+// leaRIP emits LEA RAX, [RIP+rel32] with the displacement set later by land
+func (asm *nativeAssembler) leaRIP() int {
+	asm.emit(0x48, 0x8D, 0x05)
+	asm.emit32(0)
+	return len(asm.code) - 4
+}
+
+// nativeGenerator translates bytecode of an analyzed function instruction by instruction, every operand
+// is kept in its stack slot. Errors of the interpreter (overflow, division by zero, too deep recursion)
+// make the code bail out, the call is then interpreted from the start
+type nativeGenerator struct {
+	nativeAssembler
+	analysis *nativeAnalysis
+	info     *bytecode2.FunctionInfo
+	overflow bool
+	bail     int // offset of the code returning status 1
+	body     int // offset of the function's first instruction
+}
+
+func generateNative(bc *bytecode2.Bytecode, info *bytecode2.FunctionInfo, analysis *nativeAnalysis, overflow bool) []byte {
+	g := &nativeGenerator{
+		nativeAssembler: nativeAssembler{address: make(map[int]int)},
+		analysis:        analysis,
+		info:            info,
+		overflow:        overflow,
+	}
+
+	// Entry: the first frame returns to the exit code, which returns to callNative with status 0
+	exit := g.leaRIP()
+	g.store(0, regRAX)
+	entry := g.forward(-1)
+	g.land(exit)
+	g.emit(0x45, 0x31, 0xED) // XOR R13D, R13D
+	g.emit(0xC3)             // RET
+	g.bail = len(g.code)
+	g.emit(0x41, 0xBD, 1, 0, 0, 0) // MOV R13D, 1
+	g.emit(0xC3)                   // RET
+	g.land(entry)
+	g.body = len(g.code)
+
+	addresses := make([]int, 0, len(analysis.stacks))
+	for addr := range analysis.stacks {
+		addresses = append(addresses, addr)
+	}
+	slices.Sort(addresses)
+	for _, addr := range addresses {
+		g.address[addr] = len(g.code)
+		g.instruction(bc, addr)
+	}
+	for _, fixup := range g.fixups {
+		binary.LittleEndian.PutUint32(g.code[fixup.at:], uint32(int32(g.address[fixup.target]-fixup.at-4)))
+	}
+	return g.code
+}
+
+// checkOverflow bails out if the last int operation overflowed and overflow checks are enabled
+func (g *nativeGenerator) checkOverflow() {
+	if g.overflow {
+		g.jumpTo(condO, g.bail)
+	}
+}
+
+func (g *nativeGenerator) instruction(bc *bytecode2.Bytecode, addr int) {
+	instr := bc.Instructions[addr].Generic()
+	stack := g.analysis.stacks[addr]
+	depth := len(stack)
+	top := g.analysis.stackSlot(depth - 1)
+	below := g.analysis.stackSlot(depth - 2)
+	next := g.analysis.stackSlot(depth)
+	local := func(i int) int { return g.analysis.localSlot(instr.Operands[i]) }
+
+	switch instr.Opcode {
+	case bytecode2.OpConst:
+		var bits uint64
+		switch c := bc.Constants[instr.Operands[0]].(type) {
+		case int:
+			bits = uint64(c)
+		case float64:
+			bits = math.Float64bits(c)
+		case bool:
+			bits = uint64(boolToInt(c))
+		}
+		g.loadConstant(regRAX, bits)
+		g.store(next, regRAX)
+	case bytecode2.OpLoad:
+		g.load(regRAX, local(0))
+		g.store(next, regRAX)
+	case bytecode2.OpLoadLoad:
+		g.load(regRAX, local(0))
+		g.store(next, regRAX)
+		g.load(regRAX, local(1))
+		g.store(next+1, regRAX)
+	case bytecode2.OpStore, bytecode2.OpStoreKeep:
+		g.load(regRAX, top)
+		g.store(local(0), regRAX)
+	case bytecode2.OpPop, bytecode2.OpJmp:
+		if instr.Opcode == bytecode2.OpJmp {
+			g.jump(-1, instr.Operands[0])
+		}
+	case bytecode2.OpIncLocal:
+		step := constantValue(bc.Constants[instr.Operands[1]])
+		if step.Kind == ValFloat {
+			g.loadFloat(0, local(0))
+			g.loadConstant(regRAX, step.bits)
+			g.emit(0x66, 0x48, 0x0F, 0x6E, 0xC8) // MOVQ XMM1, RAX
+			g.sse(0xF2, 0x58, 0, 1)              // ADDSD XMM0, XMM1
+			g.storeFloat(local(0), 0)
+			break
+		}
+		g.load(regRAX, local(0))
+		g.loadConstant(regRCX, step.bits)
+		g.alu(0x01, regRAX, regRCX)
+		g.checkOverflow()
+		g.store(local(0), regRAX)
+	case bytecode2.OpAddInt:
+		g.load(regRAX, top)
+		g.loadConstant(regRCX, constantValue(bc.Constants[instr.Operands[0]]).bits)
+		g.alu(0x01, regRAX, regRCX)
+		g.checkOverflow()
+		g.store(top, regRAX)
+
+	case bytecode2.OpAdd, bytecode2.OpSub, bytecode2.OpMul, bytecode2.OpDiv, bytecode2.OpMod:
+		if stack[depth-1] == nativeFloat {
+			g.floatArithmetic(instr.Opcode, below, top)
+		} else {
+			g.intArithmetic(instr.Opcode, below, top)
+		}
+	case bytecode2.OpLt, bytecode2.OpLe, bytecode2.OpGt, bytecode2.OpGe, bytecode2.OpEq, bytecode2.OpNeq:
+		g.compare(instr.Opcode, stack[depth-1], below, top)
+		g.store(below, regRAX)
+	case bytecode2.OpAnd, bytecode2.OpOr:
+		g.load(regRAX, below)
+		g.load(regRCX, top)
+		if instr.Opcode == bytecode2.OpAnd {
+			g.alu(0x21, regRAX, regRCX)
+		} else {
+			g.alu(0x09, regRAX, regRCX)
+		}
+		g.store(below, regRAX)
+	case bytecode2.OpNot:
+		g.load(regRAX, top)
+		g.emit(0x48, 0x83, 0xF0, 0x01) // XOR RAX, 1
+		g.store(top, regRAX)
+	case bytecode2.OpNeg:
+		g.load(regRAX, top)
+		if stack[depth-1] == nativeFloat {
+			g.emit(0x48, 0x0F, 0xBA, 0xF8, 0x3F) // BTC RAX, 63
+		} else {
+			g.emit(0x48, 0xF7, 0xD8) // NEG RAX
+			g.checkOverflow()
+		}
+		g.store(top, regRAX)
+	case bytecode2.OpSqrt:
+		g.toFloat(stack[depth-1], top)
+		g.sse(0xF2, 0x51, 0, 0) // SQRTSD XMM0, XMM0
+		g.storeFloat(top, 0)
+	case bytecode2.OpConvert:
+		if instr.Operands[0] == bytecode2.ConvertFloat {
+			g.toFloat(stack[depth-1], top)
+			g.storeFloat(top, 0)
+		} else if stack[depth-1] == nativeFloat {
+			g.loadFloat(0, top)
+			g.emit(0xF2, 0x48, 0x0F, 0x2C, 0xC0) // CVTTSD2SI RAX, XMM0
+			// NaN and floats out of range give MinInt64, the interpreter raises the error
+			g.loadConstant(regRCX, 1<<63)
+			g.alu(0x39, regRAX, regRCX)
+			g.jumpTo(condE, g.bail)
+			g.store(top, regRAX)
+		}
+
+	case bytecode2.OpJmpIfFalse:
+		g.load(regRAX, top)
+		g.emit(0x48, 0x85, 0xC0) // TEST RAX, RAX
+		g.jump(condE, instr.Operands[0])
+	case bytecode2.OpLtJmpIfFalse:
+		if stack[depth-1] == nativeFloat {
+			g.loadFloat(0, below)
+			g.loadFloat(1, top)
+			g.sse(0x66, 0x2E, 1, 0) // UCOMISD XMM1, XMM0: unordered sets CF
+			g.jump(condBE, instr.Operands[0])
+		} else {
+			g.load(regRAX, below)
+			g.load(regRCX, top)
+			g.alu(0x39, regRAX, regRCX)
+			g.jump(condGE, instr.Operands[0])
+		}
+
+	case bytecode2.OpCall:
+		// Arguments become the operands of the callee's frame, its return address is stored in the frame
+		frameSize := g.analysis.frameSize()
+		first := depth - g.info.ParamCount
+		g.emit(0x48, 0x81, 0xC3) // ADD RBX, frameSize
+		g.emit32(int32(frameSize))
+		g.emit(0x4C, 0x39, 0xE3) // CMP RBX, R12
+		g.jumpTo(condA, g.bail)
+		for i := 0; i < g.info.ParamCount; i++ {
+			g.load(regRAX, g.analysis.stackSlot(first+i)-frameSize/8)
+			g.store(g.analysis.stackSlot(i), regRAX)
+		}
+		returned := g.leaRIP()
+		g.store(0, regRAX)
+		g.jumpTo(-1, g.body)
+		g.land(returned)
+		if g.analysis.returnKind != nativeUnknown {
+			g.store(g.analysis.stackSlot(first), regRAX)
+		}
+	case bytecode2.OpTailCall:
+		g.jumpTo(-1, g.body) // arguments already are the only operands
+	case bytecode2.OpReturn, bytecode2.OpReturnVoid:
+		if instr.Opcode == bytecode2.OpReturn {
+			g.load(regRAX, top)
+		}
+		g.load(regRCX, 0)
+		g.emit(0x48, 0x81, 0xEB) // SUB RBX, frameSize
+		g.emit32(int32(g.analysis.frameSize()))
+		g.emit(0xFF, 0xE1) // JMP RCX
+	}
+}
+
+// intArithmetic computes an int operator of the operands in slots a and b into slot a
+func (g *nativeGenerator) intArithmetic(opcode byte, a, b int) {
+	g.load(regRAX, a)
+	g.load(regRCX, b)
+	switch opcode {
+	case bytecode2.OpAdd:
+		g.alu(0x01, regRAX, regRCX)
+		g.checkOverflow()
+	case bytecode2.OpSub:
+		g.alu(0x29, regRAX, regRCX)
+		g.checkOverflow()
+	case bytecode2.OpMul:
+		g.emit(0x48, 0x0F, 0xAF, 0xC1) // IMUL RAX, RCX
+		g.checkOverflow()
+	case bytecode2.OpDiv, bytecode2.OpMod:
+		g.emit(0x48, 0x85, 0xC9) // TEST RCX, RCX
+		g.jumpTo(condE, g.bail)
+		g.emit(0x48, 0x83, 0xF9, 0xFF) // CMP RCX, -1: IDIV faults on MinInt / -1, Go wraps around
+		divide := g.forward(condNE)
+		if opcode == bytecode2.OpDiv {
+			g.emit(0x48, 0xF7, 0xD8) // NEG RAX
+		} else {
+			g.emit(0x31, 0xC0) // XOR EAX, EAX
+		}
+		done := g.forward(-1)
+		g.land(divide)
+		g.emit(0x48, 0x99)       // CQO
+		g.emit(0x48, 0xF7, 0xF9) // IDIV RCX
+		if opcode == bytecode2.OpMod {
+			g.emit(0x48, 0x89, 0xD0) // MOV RAX, RDX
+		}
+		g.land(done)
+	}
+	g.store(a, regRAX)
+}
+
+// floatArithmetic computes a float operator of the operands in slots a and b into slot a
+func (g *nativeGenerator) floatArithmetic(opcode byte, a, b int) {
+	g.loadFloat(0, a)
+	g.loadFloat(1, b)
+	switch opcode {
+	case bytecode2.OpAdd:
+		g.sse(0xF2, 0x58, 0, 1)
+	case bytecode2.OpSub:
+		g.sse(0xF2, 0x5C, 0, 1)
+	case bytecode2.OpMul:
+		g.sse(0xF2, 0x59, 0, 1)
+	case bytecode2.OpDiv:
+		// The interpreter returns 0 for a division by zero
+		g.sse(0x66, 0x57, 2, 2) // XORPD XMM2, XMM2
+		g.sse(0x66, 0x2E, 1, 2) // UCOMISD XMM1, XMM2
+		nonZero := g.forward(condNE)
+		unordered := g.forward(condP)
+		g.sse(0x66, 0x57, 0, 0) // XORPD XMM0, XMM0
+		done := g.forward(-1)
+		g.land(nonZero)
+		g.land(unordered)
+		g.sse(0xF2, 0x5E, 0, 1)
+		g.land(done)
+	}
+	g.storeFloat(a, 0)
+}
+
+// compare sets RAX to the result of comparing operands in slots a and b. Comparisons with NaN are false
+func (g *nativeGenerator) compare(opcode byte, kind nativeKind, a, b int) {
+	if kind == nativeInt {
+		g.load(regRAX, a)
+		g.load(regRCX, b)
+		g.alu(0x39, regRAX, regRCX)
+		g.setcc(map[byte]byte{
+			bytecode2.OpLt: condL, bytecode2.OpLe: condLE, bytecode2.OpGt: condG,
+			bytecode2.OpGe: condGE, bytecode2.OpEq: condE, bytecode2.OpNeq: condNE,
+		}[opcode])
+		return
+	}
+
+	g.loadFloat(0, a)
+	g.loadFloat(1, b)
+	switch opcode {
+	case bytecode2.OpGt, bytecode2.OpGe:
+		g.sse(0x66, 0x2E, 0, 1) // UCOMISD XMM0, XMM1
+	default:
+		g.sse(0x66, 0x2E, 1, 0) // UCOMISD XMM1, XMM0
+	}
+	switch opcode {
+	case bytecode2.OpLt, bytecode2.OpGt:
+		g.setcc(condA)
+	case bytecode2.OpLe, bytecode2.OpGe:
+		g.setcc(condAE)
+	case bytecode2.OpEq:
+		g.emit(0x0F, 0x90+condE, 0xC0)  // SETE AL
+		g.emit(0x0F, 0x90+condNP, 0xC1) // SETNP CL
+		g.emit(0x20, 0xC8)              // AND AL, CL
+		g.emit(0x0F, 0xB6, 0xC0)        // MOVZX EAX, AL
+	case bytecode2.OpNeq:
+		g.emit(0x0F, 0x90+condNE, 0xC0) // SETNE AL
+		g.emit(0x0F, 0x90+condP, 0xC1)  // SETP CL
+		g.emit(0x08, 0xC8)              // OR AL, CL
+		g.emit(0x0F, 0xB6, 0xC0)        // MOVZX EAX, AL
+	}
+}
+
+// toFloat loads the operand in the slot to XMM0 converting an int
+func (g *nativeGenerator) toFloat(kind nativeKind, slot int) {
+	if kind == nativeFloat {
+		g.loadFloat(0, slot)
+		return
+	}
+	g.load(regRAX, slot)
+	g.emit(0xF2, 0x48, 0x0F, 0x2A, 0xC0) // CVTSI2SD XMM0, RAX
+}
@@ -0,0 +1,17 @@
+//go:build !nativejit || !linux || !amd64
+
+package runtime
+
+import "errors"
+
+// nativeTier is only available in amd64 Linux builds with the nativejit tag
+type nativeTier struct{}
+
+// UseNativeCode enables the amd64 code generator, this build does not include it
+func (vm *VM) UseNativeCode() error {
+	return errors.New("native code generation requires an amd64 Linux build with -tags nativejit")
+}
+
+func (vm *VM) runNative(funcAddr int) bool {
+	return false
+}
@@ -0,0 +1,26 @@
+//go:build nativejit && linux && amd64
+
+package runtime_test
+
+import (
+	"testing"
+	"twin-peaks-programming-language/internal/runtime"
+)
+
+// TestNativeDifferential runs every sample on the interpreter and with native code, their output and errors
+// must be the same
+func TestNativeDifferential(t *testing.T) {
+	for name, code := range samples(t) {
+		t.Run(name, func(t *testing.T) {
+			expected := runProgram(t, code, interpreted)
+			actual := runProgram(t, code, func(vm *runtime.VM) {
+				if err := vm.UseNativeCode(); err != nil {
+					t.Fatal(err)
+				}
+			})
+			if actual != expected {
+				t.Errorf("native output differs\ninterpreter: %q\nnative:      %q", expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package runtime
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/big"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+)
+
+var operatorNames = map[byte]string{
+	bytecode2.OpAdd: "+",
+	bytecode2.OpSub: "-",
+	bytecode2.OpMul: "*",
+	bytecode2.OpDiv: "/",
+	bytecode2.OpMod: "%",
+	bytecode2.OpLt:  "<",
+	bytecode2.OpLe:  "<=",
+	bytecode2.OpGt:  ">",
+	bytecode2.OpGe:  ">=",
+}
+
+// binary evaluates an arithmetic, comparison or logical operator given by its stack bytecode opcode.
+// Both backends use it, so operand checks and overflow detection are the same for them
+func (vm *VM) binary(opcode byte, a, b Value) (Value, error) {
+	switch opcode {
+	case bytecode2.OpAdd, bytecode2.OpSub, bytecode2.OpMul:
+		if err := checkOperands(a, b, operatorNames[opcode]); err != nil {
+			return Value{}, err
+		}
+		if vm.overflowChecks {
+			if err := checkOverflow(opcode, a, b); err != nil {
+				return Value{}, err
+			}
+		}
+		return arithmetic(opcode, a, b), nil
+	case bytecode2.OpDiv, bytecode2.OpMod:
+		if err := checkOperands(a, b, operatorNames[opcode]); err != nil {
+			return Value{}, err
+		}
+		if b.Kind == ValFloat && opcode == bytecode2.OpMod {
+			return Value{}, runtimeErrorf(ErrType, "invalid operand float for %%")
+		}
+		if err := checkIntDivisor(a, b); err != nil {
+			return Value{}, err
+		}
+		return arithmetic(opcode, a, b), nil
+	case bytecode2.OpLt, bytecode2.OpLe, bytecode2.OpGt, bytecode2.OpGe:
+		if err := checkComparable(a, b, operatorNames[opcode]); err != nil {
+			return Value{}, err
+		}
+		switch opcode {
+		case bytecode2.OpLt:
+			return valueLT(a, b), nil
+		case bytecode2.OpLe:
+			return valueLE(a, b), nil
+		case bytecode2.OpGt:
+			return valueGT(a, b), nil
+		default:
+			return valueGE(a, b), nil
+		}
+	case bytecode2.OpEq:
+		return valueEQ(a, b), nil
+	case bytecode2.OpNeq:
+		return valueNEQ(a, b), nil
+	case bytecode2.OpAnd:
+		return BoolValue(isTruthy(a) && isTruthy(b)), nil
+	case bytecode2.OpOr:
+		return BoolValue(isTruthy(a) || isTruthy(b)), nil
+	}
+	return Value{}, fmt.Errorf("unknown binary operator: %d", opcode)
+}
+
+// arithmetic applies +, -, *, / or % to checked operands of the same numeric kind
+func arithmetic(opcode byte, a, b Value) Value {
+	switch a.Kind {
+	case ValInt:
+		x, y := a.Int(), b.Int()
+		switch opcode {
+		case bytecode2.OpAdd:
+			return IntValue(x + y)
+		case bytecode2.OpSub:
+			return IntValue(x - y)
+		case bytecode2.OpMul:
+			return IntValue(x * y)
+		case bytecode2.OpDiv:
+			return IntValue(x / y)
+		case bytecode2.OpMod:
+			return IntValue(x % y)
+		}
+	case ValUint:
+		x, y := a.Uint(), b.Uint()
+		switch opcode {
+		case bytecode2.OpAdd:
+			return UintValue(x + y)
+		case bytecode2.OpSub:
+			return UintValue(x - y)
+		case bytecode2.OpMul:
+			return UintValue(x * y)
+		case bytecode2.OpDiv:
+			return UintValue(x / y)
+		case bytecode2.OpMod:
+			return UintValue(x % y)
+		}
+	case ValBigInt:
+		x, y := a.BigInt(), b.BigInt()
+		switch opcode {
+		case bytecode2.OpAdd:
+			return BigIntValue(new(big.Int).Add(x, y))
+		case bytecode2.OpSub:
+			return BigIntValue(new(big.Int).Sub(x, y))
+		case bytecode2.OpMul:
+			return BigIntValue(new(big.Int).Mul(x, y))
+		case bytecode2.OpDiv:
+			return BigIntValue(new(big.Int).Quo(x, y))
+		case bytecode2.OpMod:
+			return BigIntValue(new(big.Int).Rem(x, y))
+		}
+	case ValFloat:
+		x, y := a.Float(), b.Float()
+		switch opcode {
+		case bytecode2.OpAdd:
+			return FloatValue(x + y)
+		case bytecode2.OpSub:
+			return FloatValue(x - y)
+		case bytecode2.OpMul:
+			return FloatValue(x * y)
+		case bytecode2.OpDiv:
+			if y == 0 {
+				return FloatValue(0)
+			}
+			return FloatValue(x / y)
+		}
+	}
+	return IntValue(0)
+}
+
+// unary evaluates unary minus, logical NOT and square root
+func (vm *VM) unary(opcode byte, value Value) (Value, error) {
+	switch opcode {
+	case bytecode2.OpNeg:
+		switch value.Kind {
+		case ValInt:
+			if vm.overflowChecks && value.Int() == math.MinInt {
+				return Value{}, runtimeErrorf(ErrOverflow, "-(%d) does not fit in int", value.Int())
+			}
+			return IntValue(-value.Int()), nil
+		case ValUint:
+			return UintValue(-value.Uint()), nil // wraps around
+		case ValBigInt:
+			return BigIntValue(new(big.Int).Neg(value.BigInt())), nil
+		case ValFloat:
+			return FloatValue(-value.Float()), nil
+		default:
+			return value, nil
+		}
+	case bytecode2.OpNot:
+		return BoolValue(!isTruthy(value)), nil
+	case bytecode2.OpSqrt:
+		switch value.Kind {
+		case ValInt:
+			return FloatValue(math.Sqrt(float64(value.Int()))), nil
+		case ValUint:
+			return FloatValue(math.Sqrt(float64(value.Uint()))), nil
+		case ValBigInt:
+			f, _ := new(big.Float).SetInt(value.BigInt()).Float64()
+			return FloatValue(math.Sqrt(f)), nil
+		case ValFloat:
+			return FloatValue(math.Sqrt(value.Float())), nil
+		default:
+			return Value{}, runtimeErrorf(ErrType, "SQRT operation requires int or float64")
+		}
+	}
+	return Value{}, fmt.Errorf("unknown unary operator: %d", opcode)
+}
+
+// checkIntDivisor raises division by zero for an integer divisor
+func checkIntDivisor(a, b Value) error {
+	switch b.Kind {
+	case ValInt, ValUint:
+		if a.Kind == b.Kind && b.bits == 0 {
+			return runtimeErrorf(ErrDivisionByZero, "integer division by zero")
+		}
+	case ValBigInt:
+		if b.BigInt().Sign() == 0 {
+			return runtimeErrorf(ErrDivisionByZero, "integer division by zero")
+		}
+	}
+	return nil
+}
+
+// compare returns -1, 0 or 1 for operands of the same comparable kind, ok is false for other operands
+func compare(a, b Value) (result int, ok bool) {
+	if a.Kind != b.Kind {
+		return 0, false
+	}
+	switch a.Kind {
+	case ValInt:
+		return cmp.Compare(a.Int(), b.Int()), true
+	case ValUint:
+		return cmp.Compare(a.Uint(), b.Uint()), true
+	case ValBigInt:
+		return a.BigInt().Cmp(b.BigInt()), true
+	case ValFloat:
+		x, y := a.Float(), b.Float()
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		case x == y:
+			return 0, true
+		}
+		return 0, false // NaN is not ordered
+	case ValBool:
+		return boolToInt(a.Bool()) - boolToInt(b.Bool()), true // false < true
+	}
+	return 0, false
+}
+
+// Comparison helper functions. Each returns a Value containing a bool result.
+func valueLT(a, b Value) Value {
+	result, ok := compare(a, b)
+	return BoolValue(ok && result < 0)
+}
+
+func valueLE(a, b Value) Value {
+	result, ok := compare(a, b)
+	return BoolValue(ok && result <= 0)
+}
+
+func valueGT(a, b Value) Value {
+	result, ok := compare(a, b)
+	return BoolValue(ok && result > 0)
+}
+
+func valueGE(a, b Value) Value {
+	result, ok := compare(a, b)
+	return BoolValue(ok && result >= 0)
+}
+
+func valueEQ(a, b Value) Value {
+	if a.Kind == ValString && b.Kind == ValString {
+		return BoolValue(a.Str() == b.Str())
+	}
+	result, ok := compare(a, b)
+	return BoolValue(ok && result == 0)
+}
+
+func valueNEQ(a, b Value) Value {
+	return BoolValue(!valueEQ(a, b).Bool())
+}
+
+func isTruthy(value Value) bool {
+	switch value.Kind {
+	case ValBool, ValInt, ValUint:
+		return value.bits != 0
+	case ValBigInt:
+		return value.BigInt().Sign() != 0
+	case ValFloat:
+		return value.Float() != 0
+	case ValString:
+		return value.Str() != ""
+	default:
+		return false
+	}
+}
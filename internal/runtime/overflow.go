@@ -0,0 +1,39 @@
+package runtime
+
+import (
+	"math"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+)
+
+// checkOverflow returns ErrOverflow if the int operation does not fit in 64 bits.
+// Other operand kinds are not checked: uint wraps around by definition, bigint and float do not overflow
+func checkOverflow(opcode byte, left, right Value) error {
+	if left.Kind != ValInt || right.Kind != ValInt {
+		return nil
+	}
+	a, b := left.Int(), right.Int()
+
+	var overflow bool
+	var op string
+	switch opcode {
+	case bytecode2.OpAdd:
+		sum := a + b
+		overflow = (a > 0 && b > 0 && sum < 0) || (a < 0 && b < 0 && sum >= 0)
+		op = "+"
+	case bytecode2.OpSub:
+		diff := a - b
+		overflow = (a >= 0 && b < 0 && diff < 0) || (a < 0 && b > 0 && diff >= 0)
+		op = "-"
+	case bytecode2.OpMul:
+		if a != 0 && b != 0 {
+			product := a * b
+			overflow = product/b != a || (a == -1 && b == math.MinInt) || (b == -1 && a == math.MinInt)
+		}
+		op = "*"
+	}
+
+	if overflow {
+		return runtimeErrorf(ErrOverflow, "%d %s %d does not fit in int", a, op, b)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"twin-peaks-programming-language/internal/register"
+)
+
+// UseRegisterBackend lowers the program to register code, Run executes it instead of the stack bytecode.
+// The JIT memoization is not used by the register backend. If the program uses instructions the backend
+// does not support, the error says which one and the VM keeps the stack backend
+func (vm *VM) UseRegisterBackend() error {
+	program, err := register.Lower(vm.bytecode)
+	if err != nil {
+		return err
+	}
+	vm.registers = program
+	return nil
+}
+
+// runRegisters is the execution loop of the register backend. The stack of the VM serves as the register
+// file: every frame owns a window of it, frames of callees follow the window of the caller
+func (vm *VM) runRegisters() error {
+	program := vm.registers
+	code := program.Code
+	constants := make([]Value, len(program.Constants))
+	for i, constant := range program.Constants {
+		constants[i] = constantValue(constant)
+	}
+
+	vm.frames[0].locals = vm.stack[:program.Main.FrameSize]
+	vm.fp = 0
+	regs := vm.frames[0].locals
+	ip := program.Main.Entry
+
+	operand := func(x int) Value {
+		if x >= 0 {
+			return regs[x]
+		}
+		return constants[-x-1]
+	}
+
+	for ip < len(code) {
+		instr := &code[ip]
+		ip++
+		var err error
+
+		switch instr.Opcode {
+		case register.OpMove:
+			regs[instr.A] = operand(instr.B)
+
+		case register.OpAdd:
+			a, b := operand(instr.B), operand(instr.C)
+			if a.Kind == ValInt && b.Kind == ValInt && !vm.overflowChecks {
+				regs[instr.A] = IntValue(a.Int() + b.Int())
+				continue
+			}
+			if a.Kind == ValFloat && b.Kind == ValFloat {
+				regs[instr.A] = FloatValue(a.Float() + b.Float())
+				continue
+			}
+			regs[instr.A], err = vm.binary(register.StackOpcode(instr.Opcode), a, b)
+
+		case register.OpSub:
+			a, b := operand(instr.B), operand(instr.C)
+			if a.Kind == ValInt && b.Kind == ValInt && !vm.overflowChecks {
+				regs[instr.A] = IntValue(a.Int() - b.Int())
+				continue
+			}
+			if a.Kind == ValFloat && b.Kind == ValFloat {
+				regs[instr.A] = FloatValue(a.Float() - b.Float())
+				continue
+			}
+			regs[instr.A], err = vm.binary(register.StackOpcode(instr.Opcode), a, b)
+
+		case register.OpMul:
+			a, b := operand(instr.B), operand(instr.C)
+			if a.Kind == ValInt && b.Kind == ValInt && !vm.overflowChecks {
+				regs[instr.A] = IntValue(a.Int() * b.Int())
+				continue
+			}
+			if a.Kind == ValFloat && b.Kind == ValFloat {
+				regs[instr.A] = FloatValue(a.Float() * b.Float())
+				continue
+			}
+			regs[instr.A], err = vm.binary(register.StackOpcode(instr.Opcode), a, b)
+
+		case register.OpLt:
+			a, b := operand(instr.B), operand(instr.C)
+			if a.Kind == ValInt && b.Kind == ValInt {
+				regs[instr.A] = BoolValue(a.Int() < b.Int())
+				continue
+			}
+			regs[instr.A], err = vm.binary(register.StackOpcode(instr.Opcode), a, b)
+
+		case register.OpLe:
+			a, b := operand(instr.B), operand(instr.C)
+			if a.Kind == ValInt && b.Kind == ValInt {
+				regs[instr.A] = BoolValue(a.Int() <= b.Int())
+				continue
+			}
+			regs[instr.A], err = vm.binary(register.StackOpcode(instr.Opcode), a, b)
+
+		case register.OpDiv, register.OpMod, register.OpEq, register.OpNeq, register.OpGt, register.OpGe,
+			register.OpAnd, register.OpOr:
+			regs[instr.A], err = vm.binary(register.StackOpcode(instr.Opcode), operand(instr.B), operand(instr.C))
+
+		case register.OpNeg, register.OpNot, register.OpSqrt:
+			regs[instr.A], err = vm.unary(register.StackOpcode(instr.Opcode), operand(instr.B))
+
+		case register.OpConvert:
+			regs[instr.A], err = convert(operand(instr.B), instr.C)
+
+		case register.OpJmp:
+			ip = instr.A
+
+		case register.OpJmpIfFalse:
+			if !isTruthy(operand(instr.B)) {
+				ip = instr.A
+			}
+
+		case register.OpCall:
+			fn := program.Functions[instr.B]
+			caller := &vm.frames[vm.fp]
+			base := caller.regBase + len(caller.locals)
+			locals := vm.stack[base : base+fn.FrameSize]
+			clear(locals)
+			copy(locals[fn.Locals:], regs[instr.A:instr.A+fn.Info.ParamCount])
+
+			vm.frames = append(vm.frames, Frame{
+				returnIP:  ip,
+				prevFP:    vm.fp,
+				locals:    locals,
+				funcInfo:  fn.Info,
+				regBase:   base,
+				regResult: caller.regBase + instr.A,
+			})
+			vm.fp = len(vm.frames) - 1
+			regs = locals
+			ip = fn.Entry
+
+		case register.OpTailCall:
+			fn := program.Functions[instr.B]
+			frameIndex := len(vm.frames) - 1
+			args := regs[instr.A : instr.A+fn.Info.ParamCount]
+			vm.gc.Collect(vm.heap, vm.frames, args, frameIndex)
+			copy(regs[fn.Locals:], args)
+			clear(regs[:fn.Locals])
+			clear(regs[fn.Locals+len(args):])
+			vm.frames[frameIndex].elided++
+			ip = fn.Entry
+
+		case register.OpReturn:
+			frameIndex := len(vm.frames) - 1
+			frame := vm.frames[frameIndex]
+			if instr.C == 1 {
+				vm.stack[frame.regResult] = operand(instr.B)
+			} else {
+				copy(vm.stack[frame.regResult:frame.regResult+instr.C], regs[instr.B:instr.B+instr.C])
+			}
+			vm.gc.Collect(vm.heap, vm.frames, nil, frameIndex)
+
+			vm.frames = vm.frames[:frameIndex]
+			vm.fp = frame.prevFP
+			regs = vm.frames[vm.fp].locals
+			ip = frame.returnIP
+
+		case register.OpPrint:
+			fmt.Fprintln(vm.out, operand(instr.B).Interface())
+
+		case register.OpArrayAlloc:
+			length := operand(instr.B)
+			if length.Kind != ValInt {
+				err = runtimeErrorf(ErrType, "ARRAY_ALLOC expected int size")
+				break
+			}
+			regs[instr.A] = heapPtrValue(vm.allocArray(length.Int()))
+
+		case register.OpArrayLoad:
+			index := operand(instr.C)
+			if index.Kind != ValInt {
+				err = runtimeErrorf(ErrType, "ARRAY_LOAD expected intSize")
+				break
+			}
+			var array *Array
+			if array, err = vm.arrayAt(regs[instr.B], index.Int()); err == nil {
+				regs[instr.A] = array.Array[index.Int()]
+			}
+
+		case register.OpArrayStore:
+			index := operand(instr.B)
+			if index.Kind != ValInt {
+				err = runtimeErrorf(ErrType, "ARRAY_STORE expected intSize")
+				break
+			}
+			var array *Array
+			if array, err = vm.arrayAt(regs[instr.A], index.Int()); err == nil {
+				array.store(index.Int(), operand(instr.C))
+			}
+
+		case register.OpHalt:
+			return nil
+
+		default:
+			return fmt.Errorf("unknown opcode in register instruction: %s", instr.String())
+		}
+
+		if err != nil {
+			var rtErr *RuntimeError
+			if !errors.As(err, &rtErr) {
+				return err
+			}
+			if rtErr.Line == 0 {
+				rtErr.Line = instr.Line
+			}
+			return vm.raise(rtErr) // the register backend has no try blocks, the error is uncaught
+		}
+	}
+	return nil
+}
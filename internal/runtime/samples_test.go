@@ -0,0 +1,67 @@
+package runtime_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"twin-peaks-programming-language/internal/bytecode"
+	"twin-peaks-programming-language/internal/lexer"
+	"twin-peaks-programming-language/internal/optimizer"
+	"twin-peaks-programming-language/internal/parser"
+	"twin-peaks-programming-language/internal/runtime"
+)
+
+// runProgram compiles the program the way the command does and returns its output followed by its runtime error.
+// setup configures the VM before the run
+func runProgram(t *testing.T, code string, setup func(*runtime.VM)) string {
+	t.Helper()
+	tokens, err := lexer.NewLexer(code).Tokenize()
+	if err != nil {
+		t.Fatalf("lexer: %v", err)
+	}
+	ast, err := parser.NewParser(tokens).ParseProgram()
+	if err != nil {
+		t.Fatalf("parser: %v", err)
+	}
+	bc, err := bytecode.NewCompiler().Compile(ast)
+	if err != nil {
+		t.Fatalf("compiler: %v", err)
+	}
+	optimizer.ForLevel(1).Optimize(bc)
+	if err := bc.Verify(); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	var output bytes.Buffer
+	vm := runtime.NewVM(bc, true, false)
+	vm.SetOutput(&output)
+	setup(vm)
+	if err := vm.Run(); err != nil {
+		fmt.Fprintf(&output, "VM error: %v\n", err)
+	}
+	return output.String()
+}
+
+// samples returns the sample programs in testdata by their names
+func samples(t *testing.T) map[string]string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.tp"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no samples in testdata: %v", err)
+	}
+	programs := make(map[string]string, len(paths))
+	for _, path := range paths {
+		code, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		programs[strings.TrimSuffix(filepath.Base(path), ".tp")] = string(code)
+	}
+	return programs
+}
+
+// interpreted leaves the VM with its defaults
+func interpreted(*runtime.VM) {}
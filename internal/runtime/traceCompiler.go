@@ -0,0 +1,809 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+)
+
+// DefaultTraceThreshold is the number of backward jumps to a loop header after which the loop is traced
+const DefaultTraceThreshold = 100
+
+const (
+	maxTraceLength   = 1000 // recorded instructions of one iteration
+	maxTraceAttempts = 3    // aborted recordings before the loop is left to the interpreter
+)
+
+// unknownKind is the kind of a value the trace compiler knows nothing about
+const unknownKind ValueKind = 255
+
+// traceTier counts backward jumps of interpreted loops, records an iteration of a hot loop and compiles it
+// to a linear trace of type specialized operations. Guards leave the trace to the interpreter
+// at the instruction whose operands or branch differ from the recorded iteration
+type traceTier struct {
+	threshold int         // backward jumps before recording, 0 disables the tier
+	loops     []loopEntry // indexed by the address of the loop header
+	recording bool
+	depth     int // number of running traces, calls from a trace may run traces of other loops
+}
+
+type loopEntry struct {
+	jumps    int
+	attempts int // aborted recordings
+	reason   string
+	function string
+	line     int
+	trace    *loopTrace // nil until the loop is traced
+}
+
+// loopTrace is a compiled iteration of a loop starting and ending at its header
+type loopTrace struct {
+	header   int
+	length   int          // recorded instructions
+	locals   int          // locals of the frame used by the trace and the traces it runs
+	entry    []traceGuard // kinds of the locals read before the trace writes them
+	loopBack []traceGuard // entry guards that do not hold by construction at the end of an iteration
+	ops      []traceOp
+	guards   int // operand checks in ops
+
+	entered    int
+	iterations int
+	sideExits  int
+}
+
+type traceGuard struct {
+	local int
+	kind  ValueKind
+}
+
+// traceOp executes one instruction of the trace and returns -1 or the address the interpreter continues at.
+// An op leaving the trace before its instruction changes nothing, the interpreter executes the instruction again
+type traceOp func(r *traceRun) int
+
+// traceRun is the state of a running trace
+type traceRun struct {
+	vm     *VM
+	locals []Value
+	err    error // error of a call, returned when the trace exits
+}
+
+// traceStep is an instruction executed while the iteration was recorded
+type traceStep struct {
+	addr     int
+	instr    bytecode2.Instruction
+	operands [3]ValueKind // kinds of the values on top of the stack, operands[0] is the top
+	locals   [2]ValueKind // kinds of the locals given by the operands
+	taken    bool         // the conditional jump jumped
+	results  int          // values returned by a call
+	nested   *loopTrace   // trace of an inner loop run at addr
+	exit     int          // address where the nested trace exited
+}
+
+// SetTraceThreshold sets how many backward jumps make a loop hot enough to be traced, 0 disables tracing
+func (vm *VM) SetTraceThreshold(jumps int) {
+	vm.traces.threshold = jumps
+}
+
+// loopBack is called by a backward JMP that already set vm.ip to the loop header. It runs the loop's trace,
+// or counts the jump and records a trace when the loop becomes hot
+func (vm *VM) loopBack(header int) error {
+	tier := &vm.traces
+	if tier.threshold <= 0 || tier.depth >= maxCompiledDepth {
+		return nil
+	}
+	loop := vm.loopAt(header)
+	if loop == nil {
+		return nil
+	}
+	if loop.trace != nil {
+		return vm.runTrace(loop.trace)
+	}
+	if tier.recording || loop.attempts >= maxTraceAttempts {
+		return nil
+	}
+	loop.jumps++
+	if loop.jumps < tier.threshold {
+		return nil
+	}
+	loop.jumps = 0
+	return vm.recordTrace(loop, header)
+}
+
+// loopAt returns the loop with the header at the address, nil for addresses of the JIT's stubs
+func (vm *VM) loopAt(header int) *loopEntry {
+	tier := &vm.traces
+	if tier.loops == nil {
+		tier.loops = make([]loopEntry, len(vm.bytecode.Instructions))
+	}
+	if header < 0 || header >= len(tier.loops) {
+		return nil
+	}
+	return &tier.loops[header]
+}
+
+// runTrace runs iterations of the trace until a guard fails and leaves vm.ip at the instruction
+// the interpreter continues at. The loop header is left as is if the entry guards do not hold
+func (vm *VM) runTrace(t *loopTrace) error {
+	vm.ip = t.header
+	frame := &vm.frames[vm.fp]
+	for _, guard := range t.entry {
+		if guard.local >= len(frame.locals) || frame.locals[guard.local].Kind != guard.kind {
+			return nil
+		}
+	}
+	frame.ensureLocalsSize(t.locals)
+	r := &traceRun{vm: vm, locals: frame.locals}
+	t.entered++
+	vm.traces.depth++
+	defer func() { vm.traces.depth-- }()
+	for {
+		for _, op := range t.ops {
+			if exit := op(r); exit >= 0 {
+				vm.ip = exit
+				t.sideExits++
+				return r.err
+			}
+		}
+		t.iterations++
+		for _, guard := range t.loopBack {
+			if r.locals[guard.local].Kind != guard.kind {
+				t.sideExits++
+				return nil
+			}
+		}
+	}
+}
+
+// recordTrace executes one iteration of the loop in the interpreter, recording the instructions and kinds of
+// their operands, and compiles it. Recording is aborted at instructions a trace does not support, at a return
+// from the frame and at inner loops that are not traced yet
+func (vm *VM) recordTrace(loop *loopEntry, header int) error {
+	tier := &vm.traces
+	tier.recording = true
+	defer func() { tier.recording = false }()
+
+	loop.function = "main"
+	if info := vm.frames[vm.fp].funcInfo; info != nil {
+		loop.function = info.Name
+	}
+	loop.line = vm.bytecode.Instructions[header].Line
+
+	steps, reason, err := vm.record(header)
+	if err != nil || reason != "" {
+		loop.attempts++
+		loop.reason = reason
+		if err != nil {
+			loop.reason = "runtime error while recording"
+		}
+		if vm.jit.printInfo {
+			fmt.Printf("INFO: Loop at line %d is not traced: %s\n", loop.line, loop.reason)
+		}
+		return err
+	}
+	loop.trace = compileTrace(vm, header, steps)
+	loop.reason = ""
+	if vm.jit.printInfo {
+		fmt.Printf("INFO: Traced loop at line %d: %d instructions, %d guards\n", loop.line, loop.trace.length, loop.trace.guards)
+	}
+	return nil
+}
+
+// record executes the iteration starting at the header, reason is not empty if the iteration cannot be traced
+func (vm *VM) record(header int) (steps []traceStep, reason string, err error) {
+	sp, frames := vm.sp, len(vm.frames)
+	for {
+		addr := vm.ip
+		if addr == header && len(steps) > 0 {
+			if vm.sp != sp {
+				return nil, "stack depth differs between iterations", nil
+			}
+			return steps, "", nil
+		}
+		if len(steps) >= maxTraceLength {
+			return nil, "iteration is too long", nil
+		}
+		if addr < 0 || addr >= len(vm.bytecode.Instructions) {
+			return nil, "control leaves the program", nil
+		}
+		instr := vm.bytecode.Instructions[addr].Generic()
+
+		if inner := vm.loopAt(addr); addr != header && inner != nil && inner.trace != nil {
+			before := vm.sp
+			if err := vm.runTrace(inner.trace); err != nil {
+				return nil, "", err
+			}
+			if vm.ip == addr || vm.sp != before {
+				return nil, fmt.Sprintf("trace of the inner loop at line %d is not entered", instr.Line), nil
+			}
+			steps = append(steps, traceStep{addr: addr, instr: instr, nested: inner.trace, exit: vm.ip})
+			continue
+		}
+		if !traceable(instr) {
+			return nil, fmt.Sprintf("%s at line %d", instr.String(), instr.Line), nil
+		}
+
+		step := traceStep{addr: addr, instr: instr}
+		for i := range step.operands {
+			step.operands[i] = unknownKind
+			if vm.sp-i >= 0 {
+				step.operands[i] = vm.stack[vm.sp-i].Kind
+			}
+		}
+		locals := vm.frames[vm.fp].locals
+		for i := range step.locals {
+			step.locals[i] = unknownKind
+			if i < len(instr.Operands) && instr.Operands[i] < len(locals) {
+				step.locals[i] = locals[instr.Operands[i]].Kind
+			}
+		}
+
+		vm.ip = addr + 1
+		switch instr.Opcode {
+		case bytecode2.OpJmp:
+			vm.ip = instr.Operands[0]
+			if vm.ip <= addr && vm.ip != header {
+				return nil, fmt.Sprintf("inner loop at line %d is not traced", vm.bytecode.Instructions[vm.ip].Line), nil
+			}
+		case bytecode2.OpCall:
+			before := vm.sp
+			err = vm.callFromCompiled(instr.Operands[0], addr)
+			step.results = vm.sp - before + vm.bytecode.FuncAddresses[instr.Operands[0]].ParamCount
+		default:
+			err = vm.execute(instr)
+		}
+		if err != nil {
+			var rtErr *RuntimeError
+			if errors.As(err, &rtErr) && rtErr.Line == 0 {
+				rtErr.Line = instr.Line
+			}
+			return nil, "", err
+		}
+		if len(vm.frames) != frames {
+			return nil, "frame changed", nil
+		}
+		step.taken = vm.ip != addr+1
+		steps = append(steps, step)
+	}
+}
+
+// traceable reports whether a trace supports the instruction. Returns, tail calls, exceptions and closures
+// end the recording
+func traceable(instr bytecode2.Instruction) bool {
+	switch instr.Opcode {
+	case bytecode2.OpConst, bytecode2.OpLoad, bytecode2.OpStore, bytecode2.OpStoreKeep, bytecode2.OpPop,
+		bytecode2.OpAdd, bytecode2.OpSub, bytecode2.OpMul, bytecode2.OpDiv, bytecode2.OpMod,
+		bytecode2.OpEq, bytecode2.OpNeq, bytecode2.OpLt, bytecode2.OpLe, bytecode2.OpGt, bytecode2.OpGe,
+		bytecode2.OpAnd, bytecode2.OpOr, bytecode2.OpNeg, bytecode2.OpNot, bytecode2.OpSqrt, bytecode2.OpConvert,
+		bytecode2.OpJmp, bytecode2.OpJmpIfFalse, bytecode2.OpLtJmpIfFalse, bytecode2.OpPrint, bytecode2.OpCall,
+		bytecode2.OpIncLocal, bytecode2.OpLoadLoad, bytecode2.OpAddInt,
+		bytecode2.OpArrayAlloc, bytecode2.OpArrayLoad, bytecode2.OpArrayStore:
+		return true
+	default:
+		return false
+	}
+}
+
+// traceCompiler follows kinds of the stack and of the locals through the trace, so an operand is checked
+// only if its kind is not known from an earlier check or operation
+type traceCompiler struct {
+	vm        *VM
+	trace     *loopTrace
+	stack     []ValueKind
+	locals    map[int]ValueKind // kinds known at the current step
+	guarded   map[int]bool      // locals with entry guards
+	clobbered bool              // a nested trace ran, locals not in the map have unknown kinds
+}
+
+// compileTrace translates the recorded iteration to operations specialized for the recorded kinds
+func compileTrace(vm *VM, header int, steps []traceStep) *loopTrace {
+	c := &traceCompiler{
+		vm:      vm,
+		trace:   &loopTrace{header: header, length: len(steps)},
+		locals:  make(map[int]ValueKind),
+		guarded: make(map[int]bool),
+	}
+	for _, step := range steps {
+		c.compile(step)
+	}
+	for _, guard := range c.trace.entry {
+		if kind, ok := c.locals[guard.local]; !ok || kind != guard.kind {
+			c.trace.loopBack = append(c.trace.loopBack, guard)
+		}
+	}
+	return c.trace
+}
+
+func (c *traceCompiler) push(kind ValueKind) {
+	c.stack = append(c.stack, kind)
+}
+
+func (c *traceCompiler) pop() ValueKind {
+	if len(c.stack) == 0 {
+		return unknownKind // a value pushed before the loop
+	}
+	kind := c.stack[len(c.stack)-1]
+	c.stack = c.stack[:len(c.stack)-1]
+	return kind
+}
+
+// local returns the kind of the local read by the step, a local read before the trace writes it gets an entry guard
+func (c *traceCompiler) local(local int, recorded ValueKind) ValueKind {
+	c.trace.locals = max(c.trace.locals, local+1)
+	if kind, ok := c.locals[local]; ok {
+		return kind
+	}
+	if c.clobbered || recorded == unknownKind {
+		return unknownKind
+	}
+	if !c.guarded[local] {
+		c.guarded[local] = true
+		c.trace.entry = append(c.trace.entry, traceGuard{local: local, kind: recorded})
+	}
+	c.locals[local] = recorded
+	return recorded
+}
+
+func (c *traceCompiler) write(local int, kind ValueKind) {
+	c.locals[local] = kind
+	c.trace.locals = max(c.trace.locals, local+1)
+}
+
+// check reports whether operands of the kinds have to be checked against the recorded kinds
+func (c *traceCompiler) check(known []ValueKind, recorded []ValueKind) bool {
+	for i := range known {
+		if known[i] != recorded[i] {
+			c.trace.guards++
+			return true
+		}
+	}
+	return false
+}
+
+func (c *traceCompiler) emit(op traceOp) {
+	c.trace.ops = append(c.trace.ops, op)
+}
+
+// compile translates one recorded step
+func (c *traceCompiler) compile(step traceStep) {
+	addr, instr := step.addr, step.instr
+	switch {
+	case step.nested != nil:
+		c.compileNested(step)
+		return
+	case instr.Opcode == bytecode2.OpJmp:
+		return // the trace is linear
+	}
+
+	switch instr.Opcode {
+	case bytecode2.OpConst:
+		value := c.vm.constant(instr.Operands[0])
+		c.push(value.Kind)
+		c.emit(func(r *traceRun) int {
+			r.vm.push(value)
+			return -1
+		})
+	case bytecode2.OpLoad:
+		local := instr.Operands[0]
+		c.push(c.local(local, step.locals[0]))
+		c.emit(func(r *traceRun) int {
+			r.vm.push(r.locals[local])
+			return -1
+		})
+	case bytecode2.OpLoadLoad:
+		first, second := instr.Operands[0], instr.Operands[1]
+		c.push(c.local(first, step.locals[0]))
+		c.push(c.local(second, step.locals[1]))
+		c.emit(func(r *traceRun) int {
+			r.vm.push(r.locals[first])
+			r.vm.push(r.locals[second])
+			return -1
+		})
+	case bytecode2.OpStore:
+		local := instr.Operands[0]
+		c.write(local, c.pop())
+		c.emit(func(r *traceRun) int {
+			r.locals[local] = r.vm.pop()
+			return -1
+		})
+	case bytecode2.OpStoreKeep:
+		local := instr.Operands[0]
+		kind := c.pop()
+		c.write(local, kind)
+		c.push(kind)
+		c.emit(func(r *traceRun) int {
+			r.locals[local] = r.vm.stack[r.vm.sp]
+			return -1
+		})
+	case bytecode2.OpPop:
+		c.pop()
+		c.emit(func(r *traceRun) int {
+			r.vm.sp--
+			return -1
+		})
+	case bytecode2.OpPrint:
+		c.pop()
+		c.emit(func(r *traceRun) int {
+			fmt.Fprintln(r.vm.out, r.vm.pop().Interface())
+			return -1
+		})
+
+	case bytecode2.OpAdd, bytecode2.OpSub, bytecode2.OpMul, bytecode2.OpDiv, bytecode2.OpMod,
+		bytecode2.OpEq, bytecode2.OpNeq, bytecode2.OpLt, bytecode2.OpLe, bytecode2.OpGt, bytecode2.OpGe,
+		bytecode2.OpAnd, bytecode2.OpOr:
+		right := c.pop()
+		left := c.pop()
+		c.push(c.compileBinary(addr, instr.Opcode, left, right, step.operands[1], step.operands[0]))
+	case bytecode2.OpAddInt:
+		left := c.pop()
+		constant := c.vm.constant(instr.Operands[0])
+		c.push(c.compileAddConstant(addr, left, step.operands[0], constant))
+	case bytecode2.OpIncLocal:
+		local := instr.Operands[0]
+		kind := c.local(local, step.locals[0])
+		increment := c.vm.constant(instr.Operands[1])
+		c.write(local, c.compileIncLocal(addr, local, kind, increment))
+	case bytecode2.OpNeg, bytecode2.OpNot, bytecode2.OpSqrt:
+		c.push(c.compileUnary(addr, instr.Opcode, c.pop()))
+	case bytecode2.OpConvert:
+		c.pop()
+		target := instr.Operands[0]
+		c.push(convertKinds[target])
+		c.emit(func(r *traceRun) int {
+			converted, err := convert(r.vm.stack[r.vm.sp], target)
+			if err != nil {
+				return addr
+			}
+			r.vm.stack[r.vm.sp] = converted
+			return -1
+		})
+
+	case bytecode2.OpJmpIfFalse:
+		condition := c.pop()
+		c.compileBranch(addr, instr.Operands[0], step.taken, condition)
+	case bytecode2.OpLtJmpIfFalse:
+		right := c.pop()
+		left := c.pop()
+		c.compileLtBranch(addr, instr.Operands[0], step, left, right)
+
+	case bytecode2.OpCall:
+		funcAddr := instr.Operands[0]
+		pops, pushes, _ := c.vm.bytecode.StackEffect(instr, func(int) (int, error) { return step.results, nil })
+		for range pops {
+			c.pop()
+		}
+		for range pushes {
+			c.push(unknownKind)
+		}
+		c.emit(func(r *traceRun) int {
+			if err := r.vm.callFromCompiled(funcAddr, addr); err != nil {
+				r.err = err
+				return addr + 1
+			}
+			return -1
+		})
+
+	case bytecode2.OpArrayAlloc:
+		local := instr.Operands[0]
+		c.pop()
+		c.write(local, ValHeapPtr)
+		c.push(ValHeapPtr)
+		c.emit(func(r *traceRun) int {
+			vm := r.vm
+			size := vm.stack[vm.sp]
+			if size.Kind != ValInt {
+				return addr
+			}
+			r.locals[local] = heapPtrValue(vm.allocArray(size.Int()))
+			vm.stack[vm.sp] = r.locals[local]
+			return -1
+		})
+	case bytecode2.OpArrayLoad:
+		local := instr.Operands[0]
+		c.local(local, step.locals[0])
+		c.pop()
+		c.push(unknownKind)
+		c.emit(func(r *traceRun) int {
+			vm := r.vm
+			index := vm.stack[vm.sp]
+			array, err := vm.localArray(r.locals[local], index, "ARRAY_LOAD")
+			if err != nil {
+				return addr
+			}
+			vm.stack[vm.sp] = array.Array[index.Int()]
+			return -1
+		})
+	case bytecode2.OpArrayStore:
+		local := instr.Operands[0]
+		c.local(local, step.locals[0])
+		c.pop()
+		c.pop()
+		c.emit(func(r *traceRun) int {
+			vm := r.vm
+			index := vm.stack[vm.sp-1]
+			array, err := vm.localArray(r.locals[local], index, "ARRAY_STORE")
+			if err != nil {
+				return addr
+			}
+			array.store(index.Int(), vm.stack[vm.sp])
+			vm.sp -= 2
+			return -1
+		})
+	}
+}
+
+// convertKinds are the kinds of the results of CONVERT by its target
+var convertKinds = map[int]ValueKind{
+	bytecode2.ConvertInt:    ValInt,
+	bytecode2.ConvertUint:   ValUint,
+	bytecode2.ConvertFloat:  ValFloat,
+	bytecode2.ConvertString: ValString,
+	bytecode2.ConvertBool:   ValBool,
+	bytecode2.ConvertBigInt: ValBigInt,
+}
+
+var intOperators = map[byte]func(x, y int) Value{
+	bytecode2.OpAdd: func(x, y int) Value { return IntValue(x + y) },
+	bytecode2.OpSub: func(x, y int) Value { return IntValue(x - y) },
+	bytecode2.OpMul: func(x, y int) Value { return IntValue(x * y) },
+	bytecode2.OpDiv: func(x, y int) Value { return IntValue(x / y) },
+	bytecode2.OpMod: func(x, y int) Value { return IntValue(x % y) },
+	bytecode2.OpEq:  func(x, y int) Value { return BoolValue(x == y) },
+	bytecode2.OpNeq: func(x, y int) Value { return BoolValue(x != y) },
+	bytecode2.OpLt:  func(x, y int) Value { return BoolValue(x < y) },
+	bytecode2.OpLe:  func(x, y int) Value { return BoolValue(x <= y) },
+	bytecode2.OpGt:  func(x, y int) Value { return BoolValue(x > y) },
+	bytecode2.OpGe:  func(x, y int) Value { return BoolValue(x >= y) },
+}
+
+// floatOperators follow arithmetic and compare: division by zero is 0 and NaN is not ordered
+var floatOperators = map[byte]func(x, y float64) Value{
+	bytecode2.OpAdd: func(x, y float64) Value { return FloatValue(x + y) },
+	bytecode2.OpSub: func(x, y float64) Value { return FloatValue(x - y) },
+	bytecode2.OpMul: func(x, y float64) Value { return FloatValue(x * y) },
+	bytecode2.OpDiv: func(x, y float64) Value {
+		if y == 0 {
+			return FloatValue(0)
+		}
+		return FloatValue(x / y)
+	},
+	bytecode2.OpEq:  func(x, y float64) Value { return BoolValue(x == y) },
+	bytecode2.OpNeq: func(x, y float64) Value { return BoolValue(x != y) },
+	bytecode2.OpLt:  func(x, y float64) Value { return BoolValue(x < y) },
+	bytecode2.OpLe:  func(x, y float64) Value { return BoolValue(x <= y) },
+	bytecode2.OpGt:  func(x, y float64) Value { return BoolValue(x > y) },
+	bytecode2.OpGe:  func(x, y float64) Value { return BoolValue(x >= y) },
+}
+
+// resultKind returns the kind of the result of the operator, unknownKind if it depends on the operands
+func resultKind(opcode byte, operands ValueKind) ValueKind {
+	switch opcode {
+	case bytecode2.OpAdd, bytecode2.OpSub, bytecode2.OpMul, bytecode2.OpDiv, bytecode2.OpMod:
+		return operands
+	default:
+		return ValBool
+	}
+}
+
+// compileBinary emits the operator specialized for the recorded int or float operands and returns the kind
+// of its result. Other operands are evaluated by VM.binary, the trace exits on its errors
+func (c *traceCompiler) compileBinary(addr int, opcode byte, left, right, recordedLeft, recordedRight ValueKind) ValueKind {
+	recorded := []ValueKind{recordedLeft, recordedRight}
+	intOp, isInt := intOperators[opcode]
+	floatOp, isFloat := floatOperators[opcode]
+	switch {
+	case recordedLeft == ValInt && recordedRight == ValInt && isInt:
+		check := c.check([]ValueKind{left, right}, recorded)
+		divides := opcode == bytecode2.OpDiv || opcode == bytecode2.OpMod
+		overflows := c.vm.overflowChecks && (opcode == bytecode2.OpAdd || opcode == bytecode2.OpSub || opcode == bytecode2.OpMul)
+		c.emit(func(r *traceRun) int {
+			stack, sp := r.vm.stack, r.vm.sp
+			a, b := stack[sp-1], stack[sp]
+			if check && (a.Kind != ValInt || b.Kind != ValInt) {
+				return addr
+			}
+			if divides && b.bits == 0 || overflows && checkOverflow(opcode, a, b) != nil {
+				return addr // the interpreter raises the error
+			}
+			stack[sp-1] = intOp(a.Int(), b.Int())
+			r.vm.sp = sp - 1
+			return -1
+		})
+		return resultKind(opcode, ValInt)
+	case recordedLeft == ValFloat && recordedRight == ValFloat && isFloat:
+		check := c.check([]ValueKind{left, right}, recorded)
+		c.emit(func(r *traceRun) int {
+			stack, sp := r.vm.stack, r.vm.sp
+			a, b := stack[sp-1], stack[sp]
+			if check && (a.Kind != ValFloat || b.Kind != ValFloat) {
+				return addr
+			}
+			stack[sp-1] = floatOp(a.Float(), b.Float())
+			r.vm.sp = sp - 1
+			return -1
+		})
+		return resultKind(opcode, ValFloat)
+	}
+
+	c.emit(func(r *traceRun) int {
+		vm := r.vm
+		result, err := vm.binary(opcode, vm.stack[vm.sp-1], vm.stack[vm.sp])
+		if err != nil {
+			return addr
+		}
+		vm.sp--
+		vm.stack[vm.sp] = result
+		return -1
+	})
+	return resultKind(opcode, unknownKind)
+}
+
+// compileAddConstant emits ADD_INT
+func (c *traceCompiler) compileAddConstant(addr int, left, recorded ValueKind, constant Value) ValueKind {
+	if recorded == ValInt && constant.Kind == ValInt {
+		check := c.check([]ValueKind{left}, []ValueKind{ValInt})
+		overflows := c.vm.overflowChecks
+		k := constant.Int()
+		c.emit(func(r *traceRun) int {
+			a := r.vm.stack[r.vm.sp]
+			if check && a.Kind != ValInt || overflows && checkOverflow(bytecode2.OpAdd, a, constant) != nil {
+				return addr
+			}
+			r.vm.stack[r.vm.sp] = IntValue(a.Int() + k)
+			return -1
+		})
+		return ValInt
+	}
+	c.emit(func(r *traceRun) int {
+		vm := r.vm
+		result, err := vm.binary(bytecode2.OpAdd, vm.stack[vm.sp], constant)
+		if err != nil {
+			return addr
+		}
+		vm.stack[vm.sp] = result
+		return -1
+	})
+	return unknownKind
+}
+
+// compileIncLocal emits INC_LOCAL and returns the kind of the local after it
+func (c *traceCompiler) compileIncLocal(addr, local int, kind ValueKind, step Value) ValueKind {
+	if kind == ValInt && step.Kind == ValInt {
+		overflows := c.vm.overflowChecks
+		k := step.Int()
+		c.emit(func(r *traceRun) int {
+			value := r.locals[local]
+			if overflows && checkOverflow(bytecode2.OpAdd, value, step) != nil {
+				return addr
+			}
+			r.locals[local] = IntValue(value.Int() + k)
+			return -1
+		})
+		return ValInt
+	}
+	c.emit(func(r *traceRun) int {
+		result, err := r.vm.binary(bytecode2.OpAdd, r.locals[local], step)
+		if err != nil {
+			return addr
+		}
+		r.locals[local] = result
+		return -1
+	})
+	return unknownKind
+}
+
+// compileUnary emits NEG, NOT or SQRT
+func (c *traceCompiler) compileUnary(addr int, opcode byte, operand ValueKind) ValueKind {
+	switch {
+	case opcode == bytecode2.OpNeg && operand == ValFloat:
+		c.emit(func(r *traceRun) int {
+			r.vm.stack[r.vm.sp] = FloatValue(-r.vm.stack[r.vm.sp].Float())
+			return -1
+		})
+		return ValFloat
+	case opcode == bytecode2.OpNot:
+		c.emit(func(r *traceRun) int {
+			r.vm.stack[r.vm.sp] = BoolValue(!isTruthy(r.vm.stack[r.vm.sp]))
+			return -1
+		})
+		return ValBool
+	}
+	c.emit(func(r *traceRun) int {
+		vm := r.vm
+		result, err := vm.unary(opcode, vm.stack[vm.sp])
+		if err != nil {
+			return addr
+		}
+		vm.stack[vm.sp] = result
+		return -1
+	})
+	if opcode == bytecode2.OpSqrt {
+		return ValFloat
+	}
+	if operand == ValInt {
+		return ValInt
+	}
+	return unknownKind
+}
+
+// compileBranch emits JMP_IF_FALSE as a guard that the branch goes the recorded way, otherwise the trace
+// exits to the other successor after the condition is consumed
+func (c *traceCompiler) compileBranch(addr, target int, taken bool, condition ValueKind) {
+	exit := target
+	if taken {
+		exit = addr + 1
+	}
+	c.trace.guards++
+	if condition == ValBool {
+		c.emit(func(r *traceRun) int {
+			if (r.vm.pop().bits == 0) != taken {
+				return exit
+			}
+			return -1
+		})
+		return
+	}
+	c.emit(func(r *traceRun) int {
+		if !isTruthy(r.vm.pop()) != taken {
+			return exit
+		}
+		return -1
+	})
+}
+
+// compileLtBranch emits LT_JMP_IF_FALSE, a comparison of operands of unexpected kinds exits before the instruction
+func (c *traceCompiler) compileLtBranch(addr, target int, step traceStep, left, right ValueKind) {
+	exit, taken := target, step.taken
+	if taken {
+		exit = addr + 1
+	}
+	c.trace.guards++
+	if step.operands[1] == ValInt && step.operands[0] == ValInt {
+		check := c.check([]ValueKind{left, right}, []ValueKind{ValInt, ValInt})
+		c.emit(func(r *traceRun) int {
+			vm := r.vm
+			a, b := vm.stack[vm.sp-1], vm.stack[vm.sp]
+			if check && (a.Kind != ValInt || b.Kind != ValInt) {
+				return addr
+			}
+			vm.sp -= 2
+			if (a.Int() >= b.Int()) != taken {
+				return exit
+			}
+			return -1
+		})
+		return
+	}
+	c.emit(func(r *traceRun) int {
+		vm := r.vm
+		result, err := vm.binary(bytecode2.OpLt, vm.stack[vm.sp-1], vm.stack[vm.sp])
+		if err != nil {
+			return addr
+		}
+		vm.sp -= 2
+		if !result.Bool() != taken {
+			return exit
+		}
+		return -1
+	})
+}
+
+// compileNested emits a run of the inner loop's trace, the outer trace continues if the inner one exits
+// where it did when the iteration was recorded. Locals written by the inner loop have unknown kinds after it
+func (c *traceCompiler) compileNested(step traceStep) {
+	inner, exit := step.nested, step.exit
+	c.trace.locals = max(c.trace.locals, inner.locals)
+	c.trace.guards++
+	clear(c.locals)
+	c.clobbered = true
+	c.emit(func(r *traceRun) int {
+		vm := r.vm
+		if err := vm.runTrace(inner); err != nil {
+			r.err = err
+			return vm.ip
+		}
+		if vm.ip != exit {
+			return vm.ip
+		}
+		return -1
+	})
+}
@@ -0,0 +1,216 @@
+package runtime_test
+
+import (
+	"testing"
+	"twin-peaks-programming-language/internal/runtime"
+)
+
+var traceTests = []struct {
+	name           string
+	code           string
+	overflowChecks bool
+	expected       string
+}{
+	{
+		name: "branch guard",
+		code: `
+fn half(n int) int {
+	return n / 2;
+}
+i int;
+even int = 0;
+odd int = 0;
+for (i = 0; i < 1000; i = i + 1) {
+	if (i % 2 == 0) {
+		even = even + half(i);
+	} else {
+		odd = odd + 1;
+	}
+}
+print(even);
+print(odd);`,
+		expected: "124750\n500\n",
+	},
+	{
+		name: "division by zero",
+		code: `
+i int;
+s int = 0;
+try {
+	for (i = 300; i > -10; i = i - 1) {
+		s = s + 1000 / i;
+	}
+} catch (e) {
+	print(e);
+}
+print(s);
+print(i);`,
+		expected: "division by zero: integer division by zero at line 6\n6136\n0\n",
+	},
+	{
+		name: "index out of range",
+		code: `
+i int;
+arr int[250];
+try {
+	for (i = 0; i < 1000; i = i + 1) {
+		arr[i] = i * i;
+	}
+} catch (e) {
+	print(e);
+}
+print(arr[249]);
+print(i);`,
+		expected: "bounds error: index out of range: 250 at line 6\n62001\n250\n",
+	},
+	{
+		name:     "overflow wraps around",
+		code:     overflowLoop,
+		expected: "6627890308811632801\n200\n",
+	},
+	{
+		name:           "overflow check",
+		code:           overflowLoop,
+		overflowChecks: true,
+		expected:       "integer overflow: 4052555153018976267 * 3 does not fit in int at line 6\n4052555153018976267\n39\n",
+	},
+	{
+		name: "float",
+		code: `
+i int;
+f float = 0.5;
+for (i = 0; i < 500; i = i + 1) {
+	f = f * 1.01;
+	if (f > 10.0) {
+		f = f / 3.0;
+	}
+}
+print(f);`,
+		expected: "8.04293180180967\n",
+	},
+	{
+		name: "strings and bigints",
+		code: `
+i int;
+last string;
+for (i = 0; i < 300; i = i + 1) {
+	if (i > 298) {
+		print(last);
+	}
+	last = string(i);
+}
+print(last);
+big bigint;
+for (i = 1; i < 200; i = i + 1) {
+	big = big + bigint(i) * bigint(i);
+}
+print(big);`,
+		expected: "298\n299\n2646700\n",
+	},
+	{
+		name: "nested loops over arrays",
+		code: `
+n int = 40;
+a int[1600];
+b int[1600];
+c int[1600];
+i int;
+j int;
+k int;
+for (i = 0; i < n * n; i = i + 1) {
+	a[i] = i % 7;
+	b[i] = i % 5;
+}
+for (i = 0; i < n; i = i + 1) {
+	for (j = 0; j < n; j = j + 1) {
+		s int = 0;
+		for (k = 0; k < n; k = k + 1) {
+			s = s + a[i * n + k] * b[k * n + j];
+		}
+		c[i * n + j] = s;
+	}
+}
+total int = 0;
+for (i = 0; i < n * n; i = i + 1) {
+	total = total + c[i];
+}
+print(total);`,
+		expected: "383520\n",
+	},
+	{
+		name: "inner loop with varying trip count",
+		code: `
+i int;
+j int;
+count int = 0;
+for (i = 0; i < 300; i = i + 1) {
+	for (j = 0; j < i % 17; j = j + 1) {
+		if ((i + j) % 3 == 0) {
+			count = count + 2;
+		} else {
+			count = count - 1;
+		}
+	}
+}
+print(count);`,
+		expected: "0\n",
+	},
+	{
+		name: "several inner loops",
+		code: `
+i int;
+j int;
+k int;
+x float = 0.0;
+for (i = 0; i < 200; i = i + 1) {
+	for (j = 0; j < 50; j = j + 1) {
+		x = x + float(i) / float(j + 1);
+	}
+	for (k = 0; k < 3; k = k + 1) {
+		x = x - 1.5;
+	}
+}
+print(x);`,
+		expected: "88634.18623275548\n",
+	},
+}
+
+const overflowLoop = `
+i int;
+m int = 1;
+try {
+	for (i = 0; i < 200; i = i + 1) {
+		m = m * 3;
+	}
+} catch (e) {
+	print(e);
+}
+print(m);
+print(i);`
+
+// TestTraces runs every program without traces and with every loop traced after its first iteration,
+// so guards fail and side exits are taken as early as possible
+func TestTraces(t *testing.T) {
+	for _, test := range traceTests {
+		for _, threshold := range []int{0, 1, runtime.DefaultTraceThreshold} {
+			output := runProgram(t, test.code, func(vm *runtime.VM) {
+				vm.SetOverflowChecks(test.overflowChecks)
+				vm.SetTraceThreshold(threshold)
+			})
+			if output != test.expected {
+				t.Errorf("%s with trace threshold %d:\nexpected %q\ngot      %q", test.name, threshold, test.expected, output)
+			}
+		}
+	}
+}
+
+// TestTraceDifferential compares the output of every sample with and without traces
+func TestTraceDifferential(t *testing.T) {
+	for name, code := range samples(t) {
+		expected := runProgram(t, code, func(vm *runtime.VM) { vm.SetTraceThreshold(0) })
+		actual := runProgram(t, code, func(vm *runtime.VM) { vm.SetTraceThreshold(1) })
+		if actual != expected {
+			t.Errorf("%s: traced output differs\ninterpreter: %q\ntraces:      %q", name, expected, actual)
+		}
+	}
+}
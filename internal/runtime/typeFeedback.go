@@ -0,0 +1,177 @@
+package runtime
+
+import (
+	"fmt"
+	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+)
+
+// DefaultSpecializeThreshold is the number of executions of an arithmetic or comparison instruction
+// after which it is specialized if all its operands were ints or all were floats
+const DefaultSpecializeThreshold = 16
+
+// typeFeedback records kinds of operands of generic arithmetic and comparisons. Monomorphic instructions are
+// rewritten in the bytecode to specialized ones, which check the kinds and restore the generic instruction
+// when the check fails
+type typeFeedback struct {
+	threshold int            // 0 disables specialization, the feedback is still collected
+	sites     []siteFeedback // indexed by address
+}
+
+type siteFeedback struct {
+	count  int
+	kinds  bytecode2.OperandKinds
+	deopts int
+}
+
+// SetSpecializeThreshold sets the number of executions after which monomorphic instructions are specialized,
+// 0 disables specialization
+func (vm *VM) SetSpecializeThreshold(threshold int) {
+	vm.feedback.threshold = threshold
+}
+
+// observe records the operands of the generic instruction at addr
+func (vm *VM) observe(addr int, opcode byte, a, b Value) {
+	site := &vm.feedback.sites[addr]
+	switch {
+	case a.Kind == ValInt && b.Kind == ValInt:
+		site.kinds |= bytecode2.KindsInt
+	case a.Kind == ValFloat && b.Kind == ValFloat:
+		site.kinds |= bytecode2.KindsFloat
+	default:
+		site.kinds |= bytecode2.KindsOther
+	}
+	site.count++
+	if site.count != vm.feedback.threshold || !site.kinds.Monomorphic() {
+		return
+	}
+	if specialized, ok := bytecode2.Specialize(opcode, site.kinds); ok {
+		vm.bytecode.Instructions[addr].Opcode = specialized
+	}
+}
+
+// executeSpecialized runs an instruction specialized for ints or floats, vm.ip already points to the next one
+func (vm *VM) executeSpecialized(instr bytecode2.Instruction) error {
+	if vm.sp < 1 {
+		return fmt.Errorf("not enough values on stack for binary operation")
+	}
+	a, b := vm.stack[vm.sp-1], vm.stack[vm.sp]
+	var result Value
+	switch instr.SpecializedKinds() {
+	case bytecode2.KindsInt:
+		if a.Kind != ValInt || b.Kind != ValInt {
+			return vm.deoptimize(instr)
+		}
+		result = intOperation(instr.Opcode, a.Int(), b.Int())
+		if vm.overflowChecks && result.Kind != ValBool {
+			if err := checkOverflow(instr.Generic().Opcode, a, b); err != nil {
+				return err
+			}
+		}
+	default:
+		if a.Kind != ValFloat || b.Kind != ValFloat {
+			return vm.deoptimize(instr)
+		}
+		result = floatOperation(instr.Opcode, a.Float(), b.Float())
+	}
+	vm.sp--
+	vm.stack[vm.sp] = result
+	return nil
+}
+
+func intOperation(opcode byte, x, y int) Value {
+	switch opcode {
+	case bytecode2.OpIntAdd:
+		return IntValue(x + y)
+	case bytecode2.OpIntSub:
+		return IntValue(x - y)
+	case bytecode2.OpIntMul:
+		return IntValue(x * y)
+	case bytecode2.OpIntEq:
+		return BoolValue(x == y)
+	case bytecode2.OpIntNeq:
+		return BoolValue(x != y)
+	case bytecode2.OpIntLt:
+		return BoolValue(x < y)
+	case bytecode2.OpIntLe:
+		return BoolValue(x <= y)
+	case bytecode2.OpIntGt:
+		return BoolValue(x > y)
+	default:
+		return BoolValue(x >= y)
+	}
+}
+
+// floatOperation follows arithmetic and compare: division by zero is 0 and NaN is not ordered
+func floatOperation(opcode byte, x, y float64) Value {
+	switch opcode {
+	case bytecode2.OpFloatAdd:
+		return FloatValue(x + y)
+	case bytecode2.OpFloatSub:
+		return FloatValue(x - y)
+	case bytecode2.OpFloatMul:
+		return FloatValue(x * y)
+	case bytecode2.OpFloatDiv:
+		if y == 0 {
+			return FloatValue(0)
+		}
+		return FloatValue(x / y)
+	case bytecode2.OpFloatEq:
+		return BoolValue(x == y)
+	case bytecode2.OpFloatNeq:
+		return BoolValue(x != y)
+	case bytecode2.OpFloatLt:
+		return BoolValue(x < y)
+	case bytecode2.OpFloatLe:
+		return BoolValue(x <= y)
+	case bytecode2.OpFloatGt:
+		return BoolValue(x > y)
+	default:
+		return BoolValue(x >= y)
+	}
+}
+
+// deoptimize restores the generic instruction whose specialization does not hold and executes it. The operands
+// make the feedback of the site mixed, so it is not specialized again
+func (vm *VM) deoptimize(instr bytecode2.Instruction) error {
+	addr := vm.ip - 1
+	generic := instr.Generic()
+	vm.bytecode.Instructions[addr].Opcode = generic.Opcode
+	vm.feedback.sites[addr].kinds |= instr.SpecializedKinds()
+	vm.feedback.sites[addr].deopts++
+	return vm.execute(generic)
+}
+
+// TypeFeedback returns the operand kinds collected for the executed arithmetic and comparisons. Instructions
+// specialized ahead of time are reported with their kinds as long as they have not been deoptimized
+func (vm *VM) TypeFeedback() *bytecode2.TypeFeedback {
+	feedback := &bytecode2.TypeFeedback{Sites: []bytecode2.SiteFeedback{}}
+	for addr, site := range vm.feedback.sites {
+		instr := vm.bytecode.Instructions[addr]
+		kinds := site.kinds | instr.SpecializedKinds()
+		if kinds == 0 {
+			continue
+		}
+		feedback.Sites = append(feedback.Sites, bytecode2.SiteFeedback{
+			Addr:   addr,
+			Opcode: instr.Generic().String(),
+			Line:   instr.Line,
+			Kinds:  kinds,
+			Count:  site.count,
+			Deopts: site.deopts,
+		})
+	}
+	return feedback
+}
+
+// specializations counts instructions that are specialized now and those that were deoptimized
+func (vm *VM) specializations() (specialized, deoptimized int) {
+	for addr, site := range vm.feedback.sites {
+		if vm.bytecode.Instructions[addr].SpecializedKinds() != 0 {
+			specialized++
+		}
+		if site.deopts > 0 {
+			deoptimized++
+		}
+	}
+	return specialized, deoptimized
+}
@@ -0,0 +1,42 @@
+package runtime_test
+
+import (
+	"testing"
+	"twin-peaks-programming-language/internal/runtime"
+)
+
+// TestSpecializeDeoptimize specializes the addition for ints after its first execution, a thrown float
+// deoptimizes it
+func TestSpecializeDeoptimize(t *testing.T) {
+	code := `
+i int;
+for (i = 0; i < 6; i = i + 1) {
+	try {
+		if (i < 4) {
+			throw i;
+		}
+		throw 0.25;
+	} catch (e) {
+		print(e + e);
+	}
+}`
+	expected := "0\n2\n4\n6\n0.5\n0.5\n"
+	for _, threshold := range []int{0, 1} {
+		output := runProgram(t, code, func(vm *runtime.VM) { vm.SetSpecializeThreshold(threshold) })
+		if output != expected {
+			t.Errorf("specialize threshold %d:\nexpected %q\ngot      %q", threshold, expected, output)
+		}
+	}
+}
+
+// TestSpecializeDifferential compares the output of every sample without specialized instructions and with
+// every arithmetic specialized after its first execution
+func TestSpecializeDifferential(t *testing.T) {
+	for name, code := range samples(t) {
+		expected := runProgram(t, code, func(vm *runtime.VM) { vm.SetSpecializeThreshold(0) })
+		actual := runProgram(t, code, func(vm *runtime.VM) { vm.SetSpecializeThreshold(1) })
+		if actual != expected {
+			t.Errorf("%s: specialized output differs\ninterpreter: %q\nspecialized: %q", name, expected, actual)
+		}
+	}
+}
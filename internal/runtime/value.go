@@ -1,22 +1,145 @@
 package runtime
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
 
-// Value represents a value in vm during execution.
+// Value represents a value in vm during execution. The kind tells how the value is stored:
+// int, uint, float, bool and heap pointers are kept unboxed in bits, strings, bigints
+// and runtime objects (closures, cells, errors) in ref
 type Value struct {
-	Type int
-	Data interface{}
+	Kind ValueKind
+	bits uint64
+	ref  interface{}
 }
 
-func (v Value) String() string {
-	return fmt.Sprintf("%v", v.Data)
-}
+type ValueKind uint8
 
 const (
-	ValInt = iota
+	ValNil ValueKind = iota // zero Value: local that was never assigned
+	ValInt
+	ValUint
 	ValFloat
-	ValString
+	ValBigInt // ref is *big.Int
+	ValString // ref is string
 	ValBool
-	ValNil
-	ValHeapPtr
+	ValHeapPtr // bits is the index of an array in the heap
+	ValClosure // ref is *Closure
+	ValCell    // ref is *Value shared between a frame and closures capturing the variable
+	ValError   // ref is *RuntimeError
 )
+
+func IntValue(i int) Value {
+	return Value{Kind: ValInt, bits: uint64(i)}
+}
+
+func UintValue(u uint64) Value {
+	return Value{Kind: ValUint, bits: u}
+}
+
+func FloatValue(f float64) Value {
+	return Value{Kind: ValFloat, bits: math.Float64bits(f)}
+}
+
+func BoolValue(b bool) Value {
+	if b {
+		return Value{Kind: ValBool, bits: 1}
+	}
+	return Value{Kind: ValBool}
+}
+
+func StringValue(s string) Value {
+	return Value{Kind: ValString, ref: s}
+}
+
+func BigIntValue(n *big.Int) Value {
+	return Value{Kind: ValBigInt, ref: n}
+}
+
+func heapPtrValue(ptr int) Value {
+	return Value{Kind: ValHeapPtr, bits: uint64(ptr)}
+}
+
+func closureValue(closure *Closure) Value {
+	return Value{Kind: ValClosure, ref: closure}
+}
+
+func cellValue(cell *Value) Value {
+	return Value{Kind: ValCell, ref: cell}
+}
+
+func errorValue(err *RuntimeError) Value {
+	return Value{Kind: ValError, ref: err}
+}
+
+// constantValue converts a constant of the bytecode to a Value
+func constantValue(constant interface{}) Value {
+	switch c := constant.(type) {
+	case int:
+		return IntValue(c)
+	case uint64:
+		return UintValue(c)
+	case float64:
+		return FloatValue(c)
+	case bool:
+		return BoolValue(c)
+	case string:
+		return StringValue(c)
+	case *big.Int:
+		return BigIntValue(c)
+	default:
+		return Value{}
+	}
+}
+
+func (v Value) Int() int             { return int(v.bits) }
+func (v Value) Uint() uint64         { return v.bits }
+func (v Value) Float() float64       { return math.Float64frombits(v.bits) }
+func (v Value) Bool() bool           { return v.bits != 0 }
+func (v Value) Str() string          { return v.ref.(string) }
+func (v Value) BigInt() *big.Int     { return v.ref.(*big.Int) }
+func (v Value) HeapPtr() int         { return int(v.bits) }
+func (v Value) Closure() *Closure    { return v.ref.(*Closure) }
+func (v Value) Cell() *Value         { return v.ref.(*Value) }
+func (v Value) Err() *RuntimeError   { return v.ref.(*RuntimeError) }
+func (v Value) IsNumber() bool       { return v.Kind >= ValInt && v.Kind <= ValBigInt }
+func (v Value) holdsReference() bool { return v.Kind >= ValHeapPtr && v.Kind <= ValCell }
+
+// Interface returns the value as a Go value: int, uint64, float64, bool, string, *big.Int,
+// heap index (int) or a runtime object, nil for ValNil
+func (v Value) Interface() interface{} {
+	switch v.Kind {
+	case ValInt, ValHeapPtr:
+		return int(v.bits)
+	case ValUint:
+		return v.bits
+	case ValFloat:
+		return v.Float()
+	case ValBool:
+		return v.Bool()
+	default:
+		return v.ref
+	}
+}
+
+// Identical reports whether values are of the same kind and equal, bigints are compared by value.
+// Unlike ==, floats are compared by bits, so a NaN is identical to itself
+func (v Value) Identical(other Value) bool {
+	if v.Kind != other.Kind || v.bits != other.bits {
+		return false
+	}
+	switch v.Kind {
+	case ValBigInt:
+		return v.BigInt().Cmp(other.BigInt()) == 0
+	case ValString, ValClosure, ValCell, ValError:
+		return v.ref == other.ref
+	default:
+		return true
+	}
+}
+
+func (v Value) String() string {
+	return fmt.Sprintf("%v", v.Interface())
+}
@@ -1,9 +1,12 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
-	"math"
+	"io"
+	"os"
 	bytecode2 "twin-peaks-programming-language/internal/bytecode"
+	"twin-peaks-programming-language/internal/register"
 )
 
 type Frame struct {
@@ -11,6 +14,14 @@ type Frame struct {
 	returnIP int
 	prevFP   int
 	funcInfo *bytecode2.FunctionInfo
+	closure  *Closure // set when the function is called through a function value
+
+	elided    int     // number of tail calls that reused the frame
+	entryArgs []Value // arguments of the call that created the frame, the JIT caches its results under them
+
+	// Register backend: locals is the frame's window of the register file
+	regBase   int // index of the window's first register in the register file
+	regResult int // register of the caller receiving returned values
 }
 
 // ensureLocalsSize ensures the frame has at least `required` slots in locals.
@@ -24,15 +35,32 @@ func (f *Frame) ensureLocalsSize(required int) {
 
 type VM struct {
 	bytecode   *bytecode2.Bytecode
+	constants  []Value // constants of the bytecode converted to values
 	stack      []Value
 	frames     []Frame
 	heap       []*Array
-	ip         int // Instruction Pointer
-	sp         int // Stack Pointer
-	fp         int // Frame Pointer (index into frames slice)
+	arrays     uint64 // arrays allocated so far
+	ip         int    // Instruction Pointer
+	sp         int    // Stack Pointer
+	fp         int    // Frame Pointer (index into frames slice)
 	gc         GarbageCollector
 	jit        *JITCompiler
 	jitEnabled bool
+	tier       closureTier  // compiles hot functions to Go closures
+	traces     traceTier    // compiles iterations of hot loops to traces
+	feedback   typeFeedback // specializes monomorphic arithmetic and comparisons
+	native     *nativeTier  // runs pure numeric functions as machine code, nil when disabled
+	handlers   []handler    // active try blocks, innermost last
+
+	overflowChecks bool // int arithmetic raises ErrOverflow instead of wrapping around
+	out            io.Writer
+
+	registers *register.Program // register code executed by Run instead of the bytecode, nil for the stack backend
+}
+
+// SetOverflowChecks enables detection of int overflow in +, -, * and unary minus
+func (vm *VM) SetOverflowChecks(enabled bool) {
+	vm.overflowChecks = enabled
 }
 
 func (vm *VM) PrintHeapSize() {
@@ -46,11 +74,23 @@ func (vm *VM) PrintHeapSize() {
 }
 
 type Array struct {
-	size  int
-	Array []Value
+	size    int
+	Array   []Value
+	refs    bool   // an array pointer or a function value was stored, GC has to trace elements
+	id      uint64 // unique in the VM, heap pointers are reused
+	version uint64 // number of stores, the JIT caches calls reading the array for its version
+}
+
+func (a *Array) store(index int, data Value) {
+	a.Array[index] = data
+	a.version++
+	if data.Kind == ValHeapPtr || data.Kind == ValClosure {
+		a.refs = true
+	}
 }
 
 func NewVM(bytecode *bytecode2.Bytecode, jitEnabled, printInfo bool) *VM {
+	jit := NewJITCompiler(bytecode, printInfo)
 	return &VM{
 		bytecode:   bytecode,
 		stack:      make([]Value, 1024*1024*1024),
@@ -59,520 +99,558 @@ func NewVM(bytecode *bytecode2.Bytecode, jitEnabled, printInfo bool) *VM {
 		ip:         bytecode.ProgramStart,
 		sp:         -1,
 		fp:         0,
-		gc:         GarbageCollector{},
-		jit:        NewJITCompiler(bytecode, printInfo),
+		gc:         GarbageCollector{freed: jit.forgetArray},
+		jit:        jit,
 		jitEnabled: jitEnabled,
+		tier:       closureTier{threshold: DefaultCompileThreshold},
+		traces:     traceTier{threshold: DefaultTraceThreshold},
+		feedback:   typeFeedback{threshold: DefaultSpecializeThreshold, sites: make([]siteFeedback, len(bytecode.Instructions))},
+		out:        os.Stdout,
 	}
 }
 
+// SetOutput redirects the output of print statements
+func (vm *VM) SetOutput(out io.Writer) {
+	vm.out = out
+}
+
+// Run executes the program. Runtime errors (bounds, division by zero, type errors and thrown values)
+// are passed to the innermost try handler, uncaught ones stop the execution
 func (vm *VM) Run() error {
+	if vm.registers != nil {
+		return vm.runRegisters()
+	}
 	for vm.ip < len(vm.bytecode.Instructions) {
 		instr := vm.bytecode.Instructions[vm.ip]
 		vm.ip++
-		switch instr.Opcode {
-		case bytecode2.OpConst:
-			constIndex := instr.Operands[0]
-			if constIndex >= len(vm.bytecode.Constants) {
-				return fmt.Errorf("constant index out of bounds: %d", constIndex)
-			}
-			value := vm.bytecode.Constants[constIndex]
-			vm.push(Value{Data: value})
+		err := vm.execute(instr)
+		if err == nil {
+			continue
+		}
+		if err == errHalt {
+			return nil
+		}
+		var rtErr *RuntimeError
+		if !errors.As(err, &rtErr) {
+			return err // internal VM error, cannot be caught
+		}
+		if rtErr.Line == 0 {
+			rtErr.Line = instr.Line
+		}
+		if err := vm.raise(rtErr); err != nil {
+			return err
+		}
+	}
 
-		case bytecode2.OpLoad:
-			localIndex := instr.Operands[0]
-			if vm.fp < 0 || vm.fp >= len(vm.frames) {
-				return fmt.Errorf("invalid frame pointer: %d", vm.fp)
-			}
-			currentFrame := &vm.frames[vm.fp]
-			if localIndex >= len(currentFrame.locals) {
-				return fmt.Errorf("local index out of bounds: %d", localIndex)
-			}
-			vm.push(currentFrame.locals[localIndex])
+	return nil
+}
 
-		case bytecode2.OpStore:
-			localIndex := instr.Operands[0]
-			if vm.sp < 0 {
-				return fmt.Errorf("stack underflow")
-			}
-			value := vm.pop()
-			if vm.fp < 0 || vm.fp >= len(vm.frames) {
-				return fmt.Errorf("invalid frame pointer: %d", vm.fp)
-			}
-			currentFrame := &vm.frames[vm.fp]
-			currentFrame.ensureLocalsSize(localIndex + 1)
-			currentFrame.locals[localIndex] = value
+// execute runs a single instruction, vm.ip already points to the next one
+func (vm *VM) execute(instr bytecode2.Instruction) error {
+	switch instr.Opcode {
+	case bytecode2.OpConst:
+		constIndex := instr.Operands[0]
+		if constIndex >= len(vm.bytecode.Constants) {
+			return fmt.Errorf("constant index out of bounds: %d", constIndex)
+		}
+		vm.push(vm.constant(constIndex))
 
-		case bytecode2.OpPop:
-			if vm.sp < 0 {
-				return fmt.Errorf("stack underflow")
-			}
-			vm.pop()
-
-		case bytecode2.OpAdd:
-			if err := vm.binaryOp(func(a, b Value) Value {
-				switch a.Data.(type) {
-				case int:
-					return Value{Data: a.Data.(int) + b.Data.(int)}
-				case float64:
-					return Value{Data: a.Data.(float64) + b.Data.(float64)}
-				default:
-					return Value{Data: 0}
-				}
-			}); err != nil {
-				return err
-			}
+	case bytecode2.OpLoad:
+		localIndex := instr.Operands[0]
+		if vm.fp < 0 || vm.fp >= len(vm.frames) {
+			return fmt.Errorf("invalid frame pointer: %d", vm.fp)
+		}
+		currentFrame := &vm.frames[vm.fp]
+		if localIndex >= len(currentFrame.locals) {
+			return fmt.Errorf("local index out of bounds: %d", localIndex)
+		}
+		vm.push(currentFrame.locals[localIndex])
 
-		case bytecode2.OpSub:
-			if err := vm.binaryOp(func(a, b Value) Value {
-				switch a.Data.(type) {
-				case int:
-					return Value{Data: a.Data.(int) - b.Data.(int)}
-				case float64:
-					return Value{Data: a.Data.(float64) - b.Data.(float64)}
-				default:
-					return Value{Data: 0}
-				}
-			}); err != nil {
-				return err
-			}
+	case bytecode2.OpStore:
+		localIndex := instr.Operands[0]
+		if vm.sp < 0 {
+			return fmt.Errorf("stack underflow")
+		}
+		value := vm.pop()
+		if vm.fp < 0 || vm.fp >= len(vm.frames) {
+			return fmt.Errorf("invalid frame pointer: %d", vm.fp)
+		}
+		currentFrame := &vm.frames[vm.fp]
+		currentFrame.ensureLocalsSize(localIndex + 1)
+		currentFrame.locals[localIndex] = value
+
+	case bytecode2.OpStoreKeep:
+		localIndex := instr.Operands[0]
+		if vm.sp < 0 {
+			return fmt.Errorf("stack underflow")
+		}
+		currentFrame := &vm.frames[vm.fp]
+		currentFrame.ensureLocalsSize(localIndex + 1)
+		currentFrame.locals[localIndex] = vm.stack[vm.sp]
 
-		case bytecode2.OpMul:
-			if err := vm.binaryOp(func(a, b Value) Value {
-				switch a.Data.(type) {
-				case int:
-					return Value{Data: a.Data.(int) * b.Data.(int)}
-				case float64:
-					//fmt.Print(a.Data, b.Data)
-					return Value{Data: a.Data.(float64) * b.Data.(float64)}
-				default:
-					return Value{Data: 0}
-				}
-			}); err != nil {
-				return err
-			}
+	case bytecode2.OpPop:
+		if vm.sp < 0 {
+			return fmt.Errorf("stack underflow")
+		}
+		vm.pop()
 
-		case bytecode2.OpDiv:
-			if err := vm.binaryOp(func(a, b Value) Value {
-				switch a.Data.(type) {
-				case int:
-					bInt := b.Data.(int)
-					if bInt == 0 {
-						return Value{Data: 0}
-					}
-					return Value{Data: a.Data.(int) / bInt}
-				case float64:
-					bFloat := b.Data.(float64)
-					if bFloat == 0 {
-						return Value{Data: 0.0}
-					}
-					return Value{Data: a.Data.(float64) / bFloat}
-				default:
-					return Value{Data: 0}
-				}
-			}); err != nil {
-				return err
-			}
-		case bytecode2.OpMod:
-			if err := vm.binaryOp(func(a, b Value) Value {
-				switch a.Data.(type) {
-				case int:
-					bInt := b.Data.(int)
-					if bInt == 0 {
-						return Value{Data: 0}
-					}
-					return Value{Data: a.Data.(int) % bInt}
-				default:
-					return Value{Data: 0}
-				}
-			}); err != nil {
-				return err
-			}
-		case bytecode2.OpNeg:
-			if vm.sp < 0 {
-				return fmt.Errorf("stack underflow")
-			}
-			val := vm.pop()
-			var negated Value
-			switch val.Data.(type) {
-			case int:
-				negated = Value{Data: -val.Data.(int)}
-			case float64:
-				negated = Value{Data: -val.Data.(float64)}
-			default:
-				negated = val
-			}
-			vm.push(negated)
-		case bytecode2.OpLt:
-			if err := vm.binaryOp(func(a, b Value) Value { return valueLT(a, b) }); err != nil {
-				return err
-			}
-		case bytecode2.OpLe:
-			if err := vm.binaryOp(func(a, b Value) Value { return valueLE(a, b) }); err != nil {
-				return err
-			}
-		case bytecode2.OpEq:
-			if err := vm.binaryOp(func(a, b Value) Value { return valueEQ(a, b) }); err != nil {
-				return err
-			}
-		case bytecode2.OpNeq:
-			if err := vm.binaryOp(func(a, b Value) Value { return valueNEQ(a, b) }); err != nil {
-				return err
-			}
-		case bytecode2.OpGt:
-			if err := vm.binaryOp(func(a, b Value) Value { return valueGT(a, b) }); err != nil {
-				return err
-			}
-		case bytecode2.OpGe:
-			if err := vm.binaryOp(func(a, b Value) Value { return valueGE(a, b) }); err != nil {
-				return err
-			}
-		case bytecode2.OpAnd:
-			err := vm.binaryOp(func(a, b Value) Value {
-				return Value{Data: isTruthy(a) && isTruthy(b)}
-			})
-			if err != nil {
-				return err
-			}
-		case bytecode2.OpOr:
-			err := vm.binaryOp(func(a, b Value) Value {
-				return Value{Data: isTruthy(a) || isTruthy(b)}
-			})
-			if err != nil {
-				return err
-			}
-		case bytecode2.OpNot:
-			// Logical NOT: pop one value and push its negation
-			if vm.sp < 0 {
-				return fmt.Errorf("stack underflow")
-			}
-			val := vm.pop()
-			vm.push(Value{Data: !isTruthy(val)})
+	case bytecode2.OpAdd, bytecode2.OpSub, bytecode2.OpMul, bytecode2.OpDiv, bytecode2.OpMod,
+		bytecode2.OpEq, bytecode2.OpNeq, bytecode2.OpLt, bytecode2.OpLe, bytecode2.OpGt, bytecode2.OpGe,
+		bytecode2.OpAnd, bytecode2.OpOr:
+		if vm.sp < 1 {
+			return fmt.Errorf("not enough values on stack for binary operation")
+		}
+		b := vm.pop()
+		a := vm.pop()
+		if instr.Opcode != bytecode2.OpMod && instr.Opcode != bytecode2.OpAnd && instr.Opcode != bytecode2.OpOr {
+			vm.observe(vm.ip-1, instr.Opcode, a, b)
+		}
+		result, err := vm.binary(instr.Opcode, a, b)
+		if err != nil {
+			return err
+		}
+		vm.push(result)
 
-		case bytecode2.OpPrint:
-			if vm.sp < 0 {
-				return fmt.Errorf("stack underflow")
-			}
-			value := vm.pop()
-			fmt.Println(value.Data)
+	case bytecode2.OpIntAdd, bytecode2.OpIntSub, bytecode2.OpIntMul,
+		bytecode2.OpIntEq, bytecode2.OpIntNeq, bytecode2.OpIntLt, bytecode2.OpIntLe, bytecode2.OpIntGt, bytecode2.OpIntGe,
+		bytecode2.OpFloatAdd, bytecode2.OpFloatSub, bytecode2.OpFloatMul, bytecode2.OpFloatDiv,
+		bytecode2.OpFloatEq, bytecode2.OpFloatNeq, bytecode2.OpFloatLt, bytecode2.OpFloatLe, bytecode2.OpFloatGt, bytecode2.OpFloatGe:
+		return vm.executeSpecialized(instr)
+
+	case bytecode2.OpNeg, bytecode2.OpNot, bytecode2.OpSqrt:
+		if vm.sp < 0 {
+			return fmt.Errorf("stack underflow")
+		}
+		result, err := vm.unary(instr.Opcode, vm.pop())
+		if err != nil {
+			return err
+		}
+		vm.push(result)
 
-		case bytecode2.OpSqrt:
-			if vm.sp < 0 {
-				return fmt.Errorf("stack underflow")
+	case bytecode2.OpIncLocal:
+		currentFrame := &vm.frames[vm.fp]
+		localIndex := instr.Operands[0]
+		if localIndex >= len(currentFrame.locals) {
+			return fmt.Errorf("local index out of bounds: %d", localIndex)
+		}
+		local := &currentFrame.locals[localIndex]
+		step := vm.constant(instr.Operands[1])
+		if local.Kind == ValInt && step.Kind == ValInt && !vm.overflowChecks {
+			*local = IntValue(local.Int() + step.Int())
+			break
+		}
+		result, err := vm.binary(bytecode2.OpAdd, *local, step)
+		if err != nil {
+			return err
+		}
+		*local = result
+
+	case bytecode2.OpLoadLoad:
+		currentFrame := &vm.frames[vm.fp]
+		for _, localIndex := range instr.Operands {
+			if localIndex >= len(currentFrame.locals) {
+				return fmt.Errorf("local index out of bounds: %d", localIndex)
 			}
-			value := vm.pop()
-			switch v := value.Data.(type) {
-			case int:
-				result := math.Sqrt(float64(v))
-				vm.push(Value{Data: result})
-			case float64:
-				result := math.Sqrt(v)
-				vm.push(Value{Data: result})
-			default:
-				return fmt.Errorf("SQRT operation requires int or float64")
+			vm.push(currentFrame.locals[localIndex])
+		}
+
+	case bytecode2.OpAddInt:
+		if vm.sp < 0 {
+			return fmt.Errorf("stack underflow")
+		}
+		a := vm.pop()
+		b := vm.constant(instr.Operands[0])
+		if a.Kind == ValInt && !vm.overflowChecks {
+			vm.push(IntValue(a.Int() + b.Int()))
+			break
+		}
+		result, err := vm.binary(bytecode2.OpAdd, a, b)
+		if err != nil {
+			return err
+		}
+		vm.push(result)
+
+	case bytecode2.OpLtJmpIfFalse:
+		if vm.sp < 1 {
+			return fmt.Errorf("not enough values on stack for binary operation")
+		}
+		b := vm.pop()
+		a := vm.pop()
+		if a.Kind == ValInt && b.Kind == ValInt {
+			if a.Int() >= b.Int() {
+				vm.ip = instr.Operands[0]
 			}
+			break
+		}
+		result, err := vm.binary(bytecode2.OpLt, a, b)
+		if err != nil {
+			return err
+		}
+		if !result.Bool() {
+			vm.ip = instr.Operands[0]
+		}
 
-		case bytecode2.OpHalt:
-			return nil
+	case bytecode2.OpPrint:
+		if vm.sp < 0 {
+			return fmt.Errorf("stack underflow")
+		}
+		value := vm.pop()
+		fmt.Fprintln(vm.out, value.Interface())
 
-		case bytecode2.OpJmp:
+	case bytecode2.OpHalt:
+		return errHalt
+
+	case bytecode2.OpJmp:
+		if instr.Operands[0] < vm.ip {
 			vm.ip = instr.Operands[0]
+			return vm.loopBack(vm.ip)
+		}
+		vm.ip = instr.Operands[0]
 
-		case bytecode2.OpJmpIfFalse:
-			if vm.sp < 0 {
-				return fmt.Errorf("stack underflow")
-			}
-			condition := vm.pop()
-			if !isTruthy(condition) {
-				vm.ip = instr.Operands[0]
-			}
+	case bytecode2.OpJmpIfFalse:
+		if vm.sp < 0 {
+			return fmt.Errorf("stack underflow")
+		}
+		condition := vm.pop()
+		if !isTruthy(condition) {
+			vm.ip = instr.Operands[0]
+		}
 
-		case bytecode2.OpCall:
-			funcAddr := instr.Operands[0]
+	case bytecode2.OpCall:
+		return vm.call(instr.Operands[0], vm.ip-1)
 
-			frame := Frame{
-				returnIP: vm.ip,
-				prevFP:   vm.fp,
-				locals:   make([]Value, 0),
-				funcInfo: vm.bytecode.FuncAddresses[funcAddr],
-			}
+	case bytecode2.OpTailCall:
+		funcAddr := instr.Operands[0]
+		frameIndex := len(vm.frames) - 1
+		frame := &vm.frames[frameIndex]
 
-			vm.frames = append(vm.frames, frame)
-			vm.fp = len(vm.frames) - 1
-
-			if vm.jitEnabled {
-				callParams := make([]Value, frame.funcInfo.ParamCount)
-				for i := 0; i < frame.funcInfo.ParamCount; i++ {
-					callParams[i] = vm.stack[vm.sp-i]
-				}
-				if jitResult, newIP := vm.jit.GetCompiledAddress(vm.ip-1, callParams); jitResult == FuncJITCompiled {
-					vm.ip = newIP
-					break
-				}
-			}
+		// The frame is left as on return, arguments of the next call are on the stack
+		vm.gc.Collect(vm.heap, vm.frames, vm.stack[:vm.sp+1], frameIndex)
+		vm.dropHandlers(frameIndex)
+		// The first call returns the values of the last one, the JIT keeps its arguments in entryArgs.
+		// Intermediate calls are not registered, so a long tail recursion costs nothing to the JIT
+		frame.elided++
+		clear(frame.locals)
+		frame.locals = frame.locals[:0]
 
-			vm.ip = funcAddr
+		vm.ip = funcAddr
 
-		case bytecode2.OpReturn:
-			if len(vm.frames) == 0 {
-				return fmt.Errorf("no frame to return to")
-			}
-			frameIndex := len(vm.frames) - 1
-			if vm.jitEnabled {
-				returnValue := vm.stack[vm.sp]
-				info := vm.frames[frameIndex].funcInfo
-				vm.jit.NotifyReturn(info.Address, vm.frames[frameIndex].locals[:info.ParamCount], returnValue)
-			}
+	case bytecode2.OpReturn:
+		if len(vm.frames) == 0 {
+			return fmt.Errorf("no frame to return to")
+		}
+		// Returned values stay on the stack in order, the last one on top
+		returnCount := 1
+		if len(instr.Operands) > 0 {
+			returnCount = instr.Operands[0]
+		}
+		vm.leaveFrame(returnCount)
 
-			vm.gc.Collect(vm.heap, vm.frames, frameIndex)
+	case bytecode2.OpReturnVoid:
+		if len(vm.frames) == 0 {
+			return fmt.Errorf("no frame to return to")
+		}
+		vm.leaveFrame(-1)
 
-			frame := vm.frames[len(vm.frames)-1]
-			vm.frames = vm.frames[:len(vm.frames)-1]
+	case bytecode2.OpArrayAlloc:
+		arrLength := vm.pop()
+		if arrLength.Kind != ValInt {
+			return runtimeErrorf(ErrType, "ARRAY_ALLOC expected int size")
+		}
+		heapPointer := vm.allocArray(arrLength.Int())
 
-			// Restore previous frame
-			vm.ip = frame.returnIP
-			vm.fp = frame.prevFP
+		localIndex := instr.Operands[0]
+		if vm.fp < 0 || vm.fp >= len(vm.frames) {
+			return fmt.Errorf("invalid frame pointer: %d", vm.fp)
+		}
 
-		case bytecode2.OpReturnVoid:
-			if len(vm.frames) == 0 {
-				return fmt.Errorf("no frame to return to")
-			}
+		currentFrame := &vm.frames[vm.fp]
+		currentFrame.ensureLocalsSize(localIndex + 1)
+		currentFrame.locals[localIndex] = heapPtrValue(heapPointer)
+		vm.push(currentFrame.locals[localIndex])
+
+	case bytecode2.OpArrayStore:
+		data := vm.pop()
+		index := vm.pop()
+		array, err := vm.localArray(vm.frames[vm.fp].locals[instr.Operands[0]], index, "ARRAY_STORE")
+		if err != nil {
+			return err
+		}
+		array.store(index.Int(), data)
 
-			frameIndex := len(vm.frames) - 1
+	case bytecode2.OpArrayLoad:
+		index := vm.pop()
+		array, err := vm.localArray(vm.frames[vm.fp].locals[instr.Operands[0]], index, "ARRAY_LOAD")
+		if err != nil {
+			return err
+		}
+		vm.push(array.Array[index.Int()])
 
-			if vm.jitEnabled {
-				info := vm.frames[frameIndex].funcInfo
-				vm.jit.NotifyReturn(info.Address, vm.frames[frameIndex].locals[:info.ParamCount], Value{Type: ValNil})
-			}
+	case bytecode2.OpClosure:
+		closure, err := vm.newClosure(instr.Operands[0], instr.Operands[1:])
+		if err != nil {
+			return err
+		}
+		vm.push(closureValue(closure))
 
-			vm.gc.Collect(vm.heap, vm.frames, frameIndex)
+	case bytecode2.OpCallIndirect:
+		argCount := instr.Operands[0]
+		callee := vm.pop()
+		if callee.Kind != ValClosure {
+			return runtimeErrorf(ErrType, "cannot call non-function value: %v", callee.Interface())
+		}
+		closure := callee.Closure()
+		if closure.funcInfo.ParamCount != argCount {
+			return runtimeErrorf(ErrType, "function %s expects %d arguments, got %d", closure.funcInfo.Name, closure.funcInfo.ParamCount, argCount)
+		}
 
-			frame := vm.frames[len(vm.frames)-1]
-			vm.frames = vm.frames[:len(vm.frames)-1]
+		vm.frames = append(vm.frames, Frame{
+			returnIP: vm.ip,
+			prevFP:   vm.fp,
+			locals:   make([]Value, 0),
+			funcInfo: closure.funcInfo,
+			closure:  closure,
+		})
+		vm.fp = len(vm.frames) - 1
+		vm.ip = closure.funcInfo.Address
+
+	case bytecode2.OpMakeCell:
+		localIndex := instr.Operands[0]
+		currentFrame := &vm.frames[vm.fp]
+		currentFrame.ensureLocalsSize(localIndex + 1)
+		cell := currentFrame.locals[localIndex]
+		currentFrame.locals[localIndex] = cellValue(&cell)
+
+	case bytecode2.OpLoadCell:
+		cell, err := vm.localCell(instr.Operands[0])
+		if err != nil {
+			return err
+		}
+		vm.push(*cell)
 
-			// Restore previous frame
-			vm.ip = frame.returnIP
-			vm.fp = frame.prevFP
+	case bytecode2.OpStoreCell:
+		cell, err := vm.localCell(instr.Operands[0])
+		if err != nil {
+			return err
+		}
+		*cell = vm.pop()
 
-		case bytecode2.OpArrayAlloc:
-			arrLength, ok := vm.pop().Data.(int)
-			if !ok {
-				return fmt.Errorf("ARRAY_ALLOC expected int size")
-			}
-			heapPointer := -1
-			newArray := &Array{arrLength, make([]Value, arrLength)}
-			for i, v := range vm.heap {
-				if v == nil {
-					heapPointer = i
-					vm.heap[heapPointer] = newArray
-				}
-			}
-			if heapPointer == -1 {
-				vm.heap = append(vm.heap, newArray)
-				heapPointer = len(vm.heap) - 1
-			}
+	case bytecode2.OpGetUpvalue:
+		closure := vm.frames[vm.fp].closure
+		if closure == nil || instr.Operands[0] >= len(closure.upvalues) {
+			return fmt.Errorf("upvalue index out of bounds: %d", instr.Operands[0])
+		}
+		vm.push(*closure.upvalues[instr.Operands[0]])
 
-			localIndex := instr.Operands[0]
-			if vm.fp < 0 || vm.fp >= len(vm.frames) {
-				return fmt.Errorf("invalid frame pointer: %d", vm.fp)
-			}
+	case bytecode2.OpSetUpvalue:
+		closure := vm.frames[vm.fp].closure
+		if closure == nil || instr.Operands[0] >= len(closure.upvalues) {
+			return fmt.Errorf("upvalue index out of bounds: %d", instr.Operands[0])
+		}
+		*closure.upvalues[instr.Operands[0]] = vm.pop()
 
-			currentFrame := &vm.frames[vm.fp]
-			currentFrame.ensureLocalsSize(localIndex + 1)
-			currentFrame.locals[localIndex] = Value{Type: ValHeapPtr, Data: heapPointer}
-			vm.push(currentFrame.locals[localIndex])
+	case bytecode2.OpArrayLoadIndirect:
+		index := vm.pop()
+		if index.Kind != ValInt {
+			return runtimeErrorf(ErrType, "ARRAY_LOAD_INDIRECT expected int index")
+		}
+		arrIndex := index.Int()
+		array, err := vm.arrayAt(vm.pop(), arrIndex)
+		if err != nil {
+			return err
+		}
+		vm.push(array.Array[arrIndex])
 
-		case bytecode2.OpArrayStore:
-			data := vm.pop()
-			arrIndex, ok := vm.pop().Data.(int)
-			if !ok {
-				return fmt.Errorf("ARRAY_STORE expected intSize")
-			}
-			localIndex := instr.Operands[0]
+	case bytecode2.OpArrayStoreIndirect:
+		data := vm.pop()
+		index := vm.pop()
+		if index.Kind != ValInt {
+			return runtimeErrorf(ErrType, "ARRAY_STORE_INDIRECT expected int index")
+		}
+		arrIndex := index.Int()
+		array, err := vm.arrayAt(vm.pop(), arrIndex)
+		if err != nil {
+			return err
+		}
+		array.store(arrIndex, data)
 
-			currentFrame := &vm.frames[vm.fp]
-			heapPointer, ok := currentFrame.locals[localIndex].Data.(int)
-			if !ok {
-				return fmt.Errorf("ARRAY_STORE expected intSize")
-			}
-			if arrIndex >= vm.heap[heapPointer].size {
-				return fmt.Errorf("index out of range: %d", arrIndex)
-			} else if arrIndex < 0 {
-				return fmt.Errorf("negative index: %d", arrIndex)
-			}
-			vm.heap[heapPointer].Array[arrIndex] = data
+	case bytecode2.OpConvert:
+		converted, err := convert(vm.pop(), instr.Operands[0])
+		if err != nil {
+			return err
+		}
+		vm.push(converted)
 
-		case bytecode2.OpArrayLoad:
-			arrIndex, ok := vm.pop().Data.(int)
-			if !ok {
-				return fmt.Errorf("ARRAY_LOAD expected intSize")
-			}
-			localIndex := instr.Operands[0]
+	case bytecode2.OpTry:
+		vm.handlers = append(vm.handlers, handler{target: instr.Operands[0], frameIndex: vm.fp, sp: vm.sp})
 
-			currentFrame := &vm.frames[vm.fp]
-			heapPointer, ok := currentFrame.locals[localIndex].Data.(int)
-			if !ok {
-				return fmt.Errorf("ARRAY_LOAD expected intSize")
-			}
-			if arrIndex >= vm.heap[heapPointer].size {
-				return fmt.Errorf("index out of range: %d", arrIndex)
-			} else if arrIndex < 0 {
-				return fmt.Errorf("negative index: %d", arrIndex)
-			}
-			data := vm.heap[heapPointer].Array[arrIndex]
-			vm.push(data)
-		default:
-			return fmt.Errorf("unknown opcode in instruction: %s", instr.String())
+	case bytecode2.OpEndTry:
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+	case bytecode2.OpThrow:
+		value := vm.pop()
+		if value.Kind == ValError {
+			return value.Err() // rethrow keeps the original location
 		}
-	}
+		return &RuntimeError{Kind: ErrThrown, Message: fmt.Sprintf("%v", value.Interface()), Value: value}
 
+	default:
+		return fmt.Errorf("unknown opcode in instruction: %s", instr.String())
+	}
 	return nil
 }
 
-func (vm *VM) push(value Value) {
-	vm.sp++
-	vm.stack[vm.sp] = value
+// constant returns the constant as a Value. Constants added by the JIT while running are converted on first use
+func (vm *VM) constant(index int) Value {
+	for len(vm.constants) < len(vm.bytecode.Constants) {
+		vm.constants = append(vm.constants, constantValue(vm.bytecode.Constants[len(vm.constants)]))
+	}
+	return vm.constants[index]
 }
 
-func (vm *VM) pop() Value {
-	if vm.sp < 0 {
-		panic("stack underflow")
+// allocArray places a new array to the heap and returns its heap pointer
+func (vm *VM) allocArray(length int) int {
+	heapPointer := -1
+	vm.arrays++
+	newArray := &Array{size: length, Array: make([]Value, length), id: vm.arrays}
+	for i, v := range vm.heap {
+		if v == nil {
+			heapPointer = i
+			vm.heap[heapPointer] = newArray
+		}
 	}
-	value := vm.stack[vm.sp]
-	vm.sp--
-	return value
+	if heapPointer == -1 {
+		vm.heap = append(vm.heap, newArray)
+		heapPointer = len(vm.heap) - 1
+	}
+	return heapPointer
 }
 
-func (vm *VM) binaryOp(op func(Value, Value) Value) error {
-	if vm.sp < 1 {
-		return fmt.Errorf("not enough values on stack for binary operation")
+// call enters the function called by the instruction at callIndex. The interpreter continues at the function
+// or at the JIT's stub returning a cached result, native and compiled functions run to their return right away
+func (vm *VM) call(funcAddr, callIndex int) error {
+	frame := Frame{
+		returnIP: callIndex + 1,
+		prevFP:   vm.fp,
+		locals:   make([]Value, 0),
+		funcInfo: vm.bytecode.FuncAddresses[funcAddr],
 	}
-	b := vm.pop()
-	a := vm.pop()
 
-	result := op(a, b)
+	vm.frames = append(vm.frames, frame)
+	vm.fp = len(vm.frames) - 1
 
-	vm.push(result)
-	return nil
-}
-
-// Comparison helper functions. Each returns a Value containing a bool result.
-func valueLT(a, b Value) Value {
-	switch aVal := a.Data.(type) {
-	case int:
-		if bVal, ok := b.Data.(int); ok {
-			return Value{Data: aVal < bVal}
+	if vm.jitEnabled {
+		callParams := make([]Value, frame.funcInfo.ParamCount)
+		for i := 0; i < frame.funcInfo.ParamCount; i++ {
+			callParams[i] = vm.stack[vm.sp-i]
 		}
-	case float64:
-		if bVal, ok := b.Data.(float64); ok {
-			return Value{Data: aVal < bVal}
+		// The body may reassign its parameters, results are cached under the arguments of the call
+		vm.frames[vm.fp].entryArgs = callParams
+		results, stub, ok, verify := vm.jit.Lookup(funcAddr, callParams, vm.heap)
+		if ok {
+			// Arguments become locals as the prologue would store them, the stub returns the results
+			vm.frames[vm.fp].locals = callParams
+			vm.sp -= len(callParams)
+			for _, result := range results {
+				vm.push(result)
+			}
+			vm.ip = stub
+			return nil
 		}
-	case bool:
-		if bVal, ok := b.Data.(bool); ok {
-			// false < true
-			return Value{Data: !aVal && bVal}
+		if verify {
+			vm.ip = funcAddr // the interpreter recomputes the cached results
+			return nil
 		}
 	}
-	return Value{Data: false}
+	if vm.native != nil && vm.runNative(funcAddr) {
+		return nil
+	}
+	if compiled := vm.compiledFor(funcAddr); compiled != nil {
+		return vm.runCompiled(compiled)
+	}
+
+	vm.ip = funcAddr
+	return nil
 }
 
-func valueLE(a, b Value) Value {
-	switch aVal := a.Data.(type) {
-	case int:
-		if bVal, ok := b.Data.(int); ok {
-			return Value{Data: aVal <= bVal}
-		}
-	case float64:
-		if bVal, ok := b.Data.(float64); ok {
-			return Value{Data: aVal <= bVal}
+// leaveFrame returns from the current frame, returnCount values are on top of the stack, -1 for RETURN_VOID
+func (vm *VM) leaveFrame(returnCount int) {
+	frameIndex := len(vm.frames) - 1
+	frame := &vm.frames[frameIndex]
+	if vm.jitEnabled {
+		var returnValues []Value // nil for void functions
+		if returnCount >= 0 {
+			returnValues = make([]Value, returnCount)
+			copy(returnValues, vm.stack[vm.sp-returnCount+1:vm.sp+1])
 		}
-	case bool:
-		if bVal, ok := b.Data.(bool); ok {
-			// a <= b  is true when !a || b
-			return Value{Data: !aVal || bVal}
+		if frame.entryArgs != nil {
+			vm.jit.NotifyReturn(frame.funcInfo.Address, frame.entryArgs, returnValues, vm.heap)
 		}
 	}
-	return Value{Data: false}
+
+	vm.gc.Collect(vm.heap, vm.frames, vm.stack[:vm.sp+1], frameIndex)
+	vm.dropHandlers(frameIndex)
+
+	// Restore previous frame
+	vm.ip = frame.returnIP
+	vm.fp = frame.prevFP
+	vm.frames = vm.frames[:frameIndex]
 }
 
-func valueGT(a, b Value) Value {
-	switch aVal := a.Data.(type) {
-	case int:
-		if bVal, ok := b.Data.(int); ok {
-			return Value{Data: aVal > bVal}
-		}
-	case float64:
-		if bVal, ok := b.Data.(float64); ok {
-			return Value{Data: aVal > bVal}
-		}
-	case bool:
-		if bVal, ok := b.Data.(bool); ok {
-			// true > false
-			return Value{Data: aVal && !bVal}
-		}
+// localArray returns the array referenced by a local after checking the index of ARRAY_LOAD or ARRAY_STORE
+func (vm *VM) localArray(pointer, index Value, op string) (*Array, error) {
+	if index.Kind != ValInt {
+		return nil, runtimeErrorf(ErrType, "%s expected intSize", op)
 	}
-	return Value{Data: false}
+	if pointer.Kind != ValHeapPtr {
+		return nil, runtimeErrorf(ErrType, "%s expected intSize", op)
+	}
+	array := vm.heap[pointer.HeapPtr()]
+	if arrIndex := index.Int(); arrIndex >= array.size {
+		return nil, runtimeErrorf(ErrBounds, "index out of range: %d", arrIndex)
+	} else if arrIndex < 0 {
+		return nil, runtimeErrorf(ErrBounds, "negative index: %d", arrIndex)
+	}
+	return array, nil
 }
 
-func valueGE(a, b Value) Value {
-	switch aVal := a.Data.(type) {
-	case int:
-		if bVal, ok := b.Data.(int); ok {
-			return Value{Data: aVal >= bVal}
-		}
-	case float64:
-		if bVal, ok := b.Data.(float64); ok {
-			return Value{Data: aVal >= bVal}
-		}
-	case bool:
-		if bVal, ok := b.Data.(bool); ok {
-			// a >= b is true when a || !b
-			return Value{Data: aVal || !bVal}
-		}
+// localCell returns the cell stored in a local variable captured by closures
+func (vm *VM) localCell(localIndex int) (*Value, error) {
+	currentFrame := &vm.frames[vm.fp]
+	if localIndex >= len(currentFrame.locals) {
+		return nil, fmt.Errorf("local index out of bounds: %d", localIndex)
+	}
+	if currentFrame.locals[localIndex].Kind != ValCell {
+		return nil, fmt.Errorf("local %d is not a cell", localIndex)
 	}
-	return Value{Data: false}
+	return currentFrame.locals[localIndex].Cell(), nil
 }
 
-func valueEQ(a, b Value) Value {
-	switch aVal := a.Data.(type) {
-	case int:
-		if bVal, ok := b.Data.(int); ok {
-			return Value{Data: aVal == bVal}
-		}
-	case float64:
-		if bVal, ok := b.Data.(float64); ok {
-			return Value{Data: aVal == bVal}
-		}
-	case string:
-		if bVal, ok := b.Data.(string); ok {
-			return Value{Data: aVal == bVal}
-		}
-	case bool:
-		if bVal, ok := b.Data.(bool); ok {
-			return Value{Data: aVal == bVal}
-		}
+// arrayAt returns the array referenced by the pointer value after checking the index bounds
+func (vm *VM) arrayAt(pointer Value, arrIndex int) (*Array, error) {
+	heapPointer := pointer.HeapPtr()
+	if pointer.Kind != ValHeapPtr || heapPointer >= len(vm.heap) || vm.heap[heapPointer] == nil {
+		return nil, runtimeErrorf(ErrType, "value is not an array: %v", pointer.Interface())
+	}
+	array := vm.heap[heapPointer]
+	if arrIndex >= array.size {
+		return nil, runtimeErrorf(ErrBounds, "index out of range: %d", arrIndex)
+	} else if arrIndex < 0 {
+		return nil, runtimeErrorf(ErrBounds, "negative index: %d", arrIndex)
 	}
-	return Value{Data: false}
+	return array, nil
 }
 
-func valueNEQ(a, b Value) Value {
-	eq := valueEQ(a, b)
-	if bBool, ok := eq.Data.(bool); ok {
-		return Value{Data: !bBool}
-	}
-	return Value{Data: true}
+func (vm *VM) push(value Value) {
+	vm.sp++
+	vm.stack[vm.sp] = value
 }
 
-func isTruthy(value Value) bool {
-	switch v := value.Data.(type) {
-	case bool:
-		return v
-	case int:
-		return v != 0
-	case float64:
-		return v != 0
-	case string:
-		return v != ""
-	default:
-		return false
+func (vm *VM) pop() Value {
+	if vm.sp < 0 {
+		panic("stack underflow")
 	}
+	value := vm.stack[vm.sp]
+	vm.sp--
+	return value
 }